@@ -170,6 +170,9 @@ func (p *Proxy) MarshalJSON() ([]byte, error) {
 	mapping["interface"] = proxyInfo.Interface
 	mapping["dialer-proxy"] = proxyInfo.DialerProxy
 	mapping["routing-mark"] = proxyInfo.RoutingMark
+	if proxyInfo.ECH != "" {
+		mapping["ech"] = proxyInfo.ECH
+	}
 
 	return json.Marshal(mapping)
 }
@@ -71,6 +71,11 @@ func (t *AnyTLS) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (t *AnyTLS) Capabilities() C.Capabilities {
+	return t.Base.Capabilities() | C.CapUOT
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (t *AnyTLS) ProxyInfo() C.ProxyInfo {
 	info := t.Base.ProxyInfo()
@@ -95,6 +100,12 @@ func NewAnyTLS(option AnyTLSOption) (*AnyTLS, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		option: &option,
@@ -3,18 +3,26 @@ package outbound
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/metacubex/mihomo/common/atomic"
+	"github.com/metacubex/mihomo/common/buf"
 	N "github.com/metacubex/mihomo/common/net"
 	"github.com/metacubex/mihomo/common/utils"
 	"github.com/metacubex/mihomo/component/dialer"
 	"github.com/metacubex/mihomo/component/resolver"
 	C "github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/log"
+
+	"golang.org/x/time/rate"
 )
 
 type ProxyAdapter interface {
@@ -33,15 +41,37 @@ type Base struct {
 	tfo    bool
 	mpTcp  bool
 	rmark  int
+	bport  int
+	fdelay int // ms
+	dtime  int // seconds
+	uidle  int // seconds
+	rdial  bool
+	sopts  []string
 	id     string
 	prefer C.DNSPrefer
+
+	// renamed is set by SetName, name is only written when Base is built so adapters
+	// may keep reading it while the proxy is renamed
+	renamed atomic.TypedValue[string]
+
+	lastUsed  atomic.Int64 // unix nano
+	lastFresh atomic.Int64 // unix nano, last dial resolved bypassing the dns cache
 }
 
 // Name implements C.ProxyAdapter
 func (b *Base) Name() string {
+	if name, ok := b.renamed.LoadOk(); ok {
+		return name
+	}
 	return b.name
 }
 
+// SetName renames the proxy in place, e.g. on a reload that keeps its connections.
+// Connections already dialed keep the name in their chains from when they were dialed.
+func (b *Base) SetName(name string) {
+	b.renamed.Store(name)
+}
+
 // Id implements C.ProxyAdapter
 func (b *Base) Id() string {
 	if b.id == "" {
@@ -51,6 +81,30 @@ func (b *Base) Id() string {
 	return b.id
 }
 
+// WithInterface returns a copy of b bound to the interface name with a fresh id,
+// adapters embedding Base can build their own clone on top of it
+func (b *Base) WithInterface(name string) *Base {
+	return &Base{
+		name:   b.Name(),
+		addr:   b.addr,
+		iface:  name,
+		tp:     b.tp,
+		udp:    b.udp,
+		xudp:   b.xudp,
+		tfo:    b.tfo,
+		mpTcp:  b.mpTcp,
+		rmark:  b.rmark,
+		bport:  b.bport,
+		fdelay: b.fdelay,
+		dtime:  b.dtime,
+		uidle:  b.uidle,
+		rdial:  b.rdial,
+		sopts:  append([]string(nil), b.sopts...),
+		id:     utils.NewUUIDV6().String(),
+		prefer: b.prefer,
+	}
+}
+
 // Type implements C.ProxyAdapter
 func (b *Base) Type() C.AdapterType {
 	return b.tp
@@ -70,6 +124,22 @@ func (b *Base) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metad
 	return nil, C.ErrNotSupport
 }
 
+// DialRawWithDialer reaches addr with dialer and relays the raw stream, adapters
+// without a handshake of their own may call it from their DialContextWithDialer
+func (b *Base) DialRawWithDialer(ctx context.Context, dialer C.Dialer) (_ C.Conn, err error) {
+	if b.addr == "" {
+		return nil, C.ErrNotSupport
+	}
+	dialCtx, dialCancel := b.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", b.addr)
+	dialCancel()
+	if err != nil {
+		return nil, fmt.Errorf("%s connect error: %w", b.addr, err)
+	}
+	markDialConnected(ctx)
+	return NewConn(c, b), nil
+}
+
 // ListenPacketContext implements C.ProxyAdapter
 func (b *Base) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
 	return nil, C.ErrNotSupport
@@ -95,6 +165,27 @@ func (b *Base) SupportUDP() bool {
 	return b.udp
 }
 
+// Capabilities combines SupportUDP, SupportUOT and the xudp, tfo and mptcp settings,
+// adapters overriding SupportUOT override it too
+func (b *Base) Capabilities() (caps C.Capabilities) {
+	if b.SupportUDP() {
+		caps |= C.CapUDP
+	}
+	if b.xudp {
+		caps |= C.CapXUDP
+	}
+	if b.tfo {
+		caps |= C.CapTFO
+	}
+	if b.mpTcp {
+		caps |= C.CapMPTCP
+	}
+	if b.SupportUOT() {
+		caps |= C.CapUOT
+	}
+	return
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (b *Base) ProxyInfo() (info C.ProxyInfo) {
 	info.XUDP = b.xudp
@@ -103,9 +194,18 @@ func (b *Base) ProxyInfo() (info C.ProxyInfo) {
 	info.SMUX = false
 	info.Interface = b.iface
 	info.RoutingMark = b.rmark
+	info.Addr = redactAddr(b.addr)
 	return
 }
 
+// redactAddr strips the userinfo of a server written as user:pass@host:port
+func redactAddr(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return addr[i+1:]
+	}
+	return addr
+}
+
 // IsL3Protocol implements C.ProxyAdapter
 func (b *Base) IsL3Protocol(metadata *C.Metadata) bool {
 	return false
@@ -113,9 +213,12 @@ func (b *Base) IsL3Protocol(metadata *C.Metadata) bool {
 
 // MarshalJSON implements C.ProxyAdapter
 func (b *Base) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]string{
+	return json.Marshal(map[string]any{
 		"type": b.Type().String(),
 		"id":   b.Id(),
+		"addr": redactAddr(b.addr),
+		"udp":  b.udp,
+		"xudp": b.xudp,
 	})
 }
 
@@ -131,6 +234,12 @@ func (b *Base) Unwrap(metadata *C.Metadata, touch bool) C.Proxy {
 
 // DialOptions return []dialer.Option from struct
 func (b *Base) DialOptions() (opts []dialer.Option) {
+	return b.DialOptionsFor(nil)
+}
+
+// DialOptionsFor is DialOptions for dialing metadata. An ip version hint in metadata other
+// than DualStack takes precedence over the proxy's ip-version, DualStack or a nil metadata keep it.
+func (b *Base) DialOptionsFor(metadata *C.Metadata) (opts []dialer.Option) {
 	if b.iface != "" {
 		opts = append(opts, dialer.WithInterface(b.iface))
 	}
@@ -139,7 +248,26 @@ func (b *Base) DialOptions() (opts []dialer.Option) {
 		opts = append(opts, dialer.WithRoutingMark(b.rmark))
 	}
 
-	switch b.prefer {
+	if b.bport != 0 {
+		opts = append(opts, dialer.WithBindPort(b.bport))
+	}
+
+	if b.fdelay != 0 {
+		opts = append(opts, dialer.WithFallbackDelay(time.Duration(b.fdelay)*time.Millisecond))
+	}
+
+	if len(b.sopts) != 0 {
+		// already validated by ValidateSockOpts when the proxy was parsed
+		if sockOpts, err := dialer.ParseSockOpts(b.sopts); err == nil {
+			opts = append(opts, dialer.WithSockOpt(sockOpts...))
+		}
+	}
+
+	prefer := b.prefer
+	if metadata != nil && metadata.IPVersion != C.DualStack {
+		prefer = metadata.IPVersion
+	}
+	switch prefer {
 	case C.IPv4Only:
 		opts = append(opts, dialer.WithOnlySingleStack(true))
 	case C.IPv6Only:
@@ -162,9 +290,58 @@ func (b *Base) DialOptions() (opts []dialer.Option) {
 	return opts
 }
 
+// LastUsed returns the last time the proxy was dialed, zero if never
+func (b *Base) LastUsed() time.Time {
+	if lastUsed := b.lastUsed.Load(); lastUsed != 0 {
+		return time.Unix(0, lastUsed)
+	}
+	return time.Time{}
+}
+
+func (b *Base) markUsed() {
+	b.lastUsed.Store(time.Now().UnixNano())
+}
+
+type lastUsedAdapter interface {
+	LastUsed() time.Time
+	markUsed()
+}
+
+// dialContext bounds ctx with the configured dial timeout, the earlier of the
+// caller's deadline and the timeout wins
+func (b *Base) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = b.resolveContext(ctx)
+	if b.dtime <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(b.dtime)*time.Second)
+}
+
+func (b *Base) udpIdleTimeout() time.Duration {
+	return time.Duration(b.uidle) * time.Second
+}
+
+// resolveEveryDialFloor is the minimum time between two dials of a resolve-every-dial
+// adapter bypassing the dns cache, so a busy adapter can't hammer the dns server
+var resolveEveryDialFloor = 5 * time.Second
+
+// resolveContext makes lookups with ctx skip the dns cache when resolve-every-dial is
+// set, unless the cache was already bypassed within resolveEveryDialFloor
+func (b *Base) resolveContext(ctx context.Context) context.Context {
+	if !b.rdial {
+		return ctx
+	}
+	now := time.Now().UnixNano()
+	last := b.lastFresh.Load()
+	if now-last < int64(resolveEveryDialFloor) || !b.lastFresh.CompareAndSwap(last, now) {
+		return ctx
+	}
+	return resolver.WithBypassCache(ctx)
+}
+
 func (b *Base) ResolveUDP(ctx context.Context, metadata *C.Metadata) error {
 	if !metadata.Resolved() {
-		ip, err := resolver.ResolveIP(ctx, metadata.Host)
+		ip, err := resolver.ResolveIP(b.resolveContext(ctx), metadata.Host)
 		if err != nil {
 			return fmt.Errorf("can't resolve ip: %w", err)
 		}
@@ -178,25 +355,84 @@ func (b *Base) Close() error {
 }
 
 type BasicOption struct {
-	TFO         bool   `proxy:"tfo,omitempty"`
-	MPTCP       bool   `proxy:"mptcp,omitempty"`
-	Interface   string `proxy:"interface-name,omitempty"`
-	RoutingMark int    `proxy:"routing-mark,omitempty"`
-	IPVersion   string `proxy:"ip-version,omitempty"`
-	DialerProxy string `proxy:"dialer-proxy,omitempty"` // don't apply this option into groups, but can set a group name in a proxy
+	TFO              bool     `proxy:"tfo,omitempty"`
+	MPTCP            bool     `proxy:"mptcp,omitempty"`
+	Interface        string   `proxy:"interface-name,omitempty"`
+	RoutingMark      int      `proxy:"routing-mark,omitempty"`
+	BindPort         int      `proxy:"bind-port,omitempty"`
+	FallbackDelay    int      `proxy:"fallback-delay,omitempty"`
+	DialTimeout      int      `proxy:"dial-timeout,omitempty"`
+	UDPIdleTimeout   int      `proxy:"udp-idle-timeout,omitempty"`
+	ResolveEveryDial bool     `proxy:"resolve-every-dial,omitempty"`
+	SockOpts         []string `proxy:"sock-opts,omitempty"`
+	IPVersion        string   `proxy:"ip-version,omitempty"`
+	DialerProxy      string   `proxy:"dialer-proxy,omitempty"` // don't apply this option into groups, but can set a group name in a proxy
+	DialerProxies    []string `proxy:"-"`                      // dialer-proxy given as a list, see SplitDialerProxyChain
+	RateLimit        string   `proxy:"rate-limit,omitempty"`
+}
+
+// DialerProxyChain returns the proxies to dial through, the first hop first
+func (b BasicOption) DialerProxyChain() []string {
+	if len(b.DialerProxies) > 0 {
+		return b.DialerProxies
+	}
+	if len(b.DialerProxy) > 0 {
+		return []string{b.DialerProxy}
+	}
+	return nil
+}
+
+// SplitDialerProxyChain takes a list of proxies out of dialer-proxy, the first hop first, and returns a copy of
+// mapping with dialer-proxy set to the last hop, so that it decodes as the single proxy the server is dialed through.
+// A string dialer-proxy returns mapping as is and a nil chain.
+func SplitDialerProxyChain(mapping map[string]any) (map[string]any, []string, error) {
+	list, ok := mapping["dialer-proxy"].([]any)
+	if !ok {
+		return mapping, nil, nil
+	}
+	if len(list) == 0 {
+		return nil, nil, errors.New("dialer-proxy is an empty list")
+	}
+	chain := make([]string, 0, len(list))
+	for i, item := range list {
+		name, ok := item.(string)
+		if !ok || name == "" {
+			return nil, nil, fmt.Errorf("dialer-proxy[%d] is not a proxy name", i)
+		}
+		chain = append(chain, name)
+	}
+	cloned := make(map[string]any, len(mapping))
+	for key, value := range mapping {
+		cloned[key] = value
+	}
+	cloned["dialer-proxy"] = chain[len(chain)-1]
+	return cloned, chain, nil
+}
+
+// ValidateSockOpts reports the first invalid sock-opts entry, so a bad spec
+// fails the proxy at construction instead of silently at dial time
+func (b BasicOption) ValidateSockOpts() error {
+	_, err := dialer.ParseSockOpts(b.SockOpts)
+	return err
 }
 
 type BaseOption struct {
-	Name        string
-	Addr        string
-	Type        C.AdapterType
-	UDP         bool
-	XUDP        bool
-	TFO         bool
-	MPTCP       bool
-	Interface   string
-	RoutingMark int
-	Prefer      C.DNSPrefer
+	Name             string
+	Addr             string
+	Type             C.AdapterType
+	UDP              bool
+	XUDP             bool
+	TFO              bool
+	MPTCP            bool
+	Interface        string
+	RoutingMark      int
+	BindPort         int
+	FallbackDelay    int // ms
+	DialTimeout      int // seconds
+	UDPIdleTimeout   int // seconds
+	ResolveEveryDial bool
+	SockOpts         []string
+	Prefer           C.DNSPrefer
 }
 
 func NewBase(opt BaseOption) *Base {
@@ -210,6 +446,12 @@ func NewBase(opt BaseOption) *Base {
 		mpTcp:  opt.MPTCP,
 		iface:  opt.Interface,
 		rmark:  opt.RoutingMark,
+		bport:  opt.BindPort,
+		fdelay: opt.FallbackDelay,
+		dtime:  opt.DialTimeout,
+		uidle:  opt.UDPIdleTimeout,
+		rdial:  opt.ResolveEveryDial,
+		sopts:  opt.SockOpts,
 		prefer: opt.Prefer,
 	}
 }
@@ -218,6 +460,13 @@ type conn struct {
 	N.ExtendedConn
 	chain       C.Chain
 	adapterAddr string
+	refs        []releasableRef
+	up, down    atomic.Uint64
+}
+
+// Stats returns the bytes written to and read from the proxy through this conn
+func (c *conn) Stats() (up, down uint64) {
+	return c.up.Load(), c.down.Load()
 }
 
 func (c *conn) RemoteDestination() string {
@@ -257,13 +506,218 @@ func (c *conn) ReaderReplaceable() bool {
 
 func (c *conn) AddRef(ref any) {
 	c.ExtendedConn = N.NewRefConn(c.ExtendedConn, ref) // add ref for autoCloseProxyAdapter
+	if ref, ok := ref.(releasableRef); ok {
+		c.refs = append(c.refs, ref)
+	}
+}
+
+func (c *conn) Close() error {
+	for _, ref := range c.refs {
+		ref.release()
+	}
+	return c.ExtendedConn.Close()
 }
 
 func NewConn(c net.Conn, a C.ProxyAdapter) C.Conn {
 	if _, ok := c.(syscall.Conn); !ok { // exclusion system conn like *net.TCPConn
 		c = N.NewDeadlineConn(c) // most conn from outbound can't handle readDeadline correctly
 	}
-	return &conn{N.NewExtendedConn(c), []string{a.Name()}, a.Addr()}
+	cc := &conn{
+		chain:       []string{a.Name()},
+		adapterAddr: a.Addr(),
+	}
+	// the counter layer isn't replaceable, copies unwrapping cc stop there and keep counting
+	cc.ExtendedConn = N.NewCounterConn(c,
+		[]N.CountFunc{func(n int64) { cc.down.Add(uint64(n)) }},
+		[]N.CountFunc{func(n int64) { cc.up.Add(uint64(n)) }},
+	)
+	return cc
+}
+
+// limitRate caps the throughput of c, see RateLimitedConn, closing c cancels the
+// limiter so no context of the dial is needed
+func (c *conn) limitRate(bytesPerSecond uint64) {
+	c.ExtendedConn = NewRateLimitedConn(context.Background(), c.ExtendedConn, bytesPerSecond)
+}
+
+// RateLimitedConn caps the throughput of a conn in each direction with a token bucket.
+// Reads and writes blocked on the limiter return once ctx is done, the conn is closed
+// or their deadline is exceeded.
+type RateLimitedConn struct {
+	N.ExtendedConn
+	ctx                         context.Context
+	cancel                      context.CancelCauseFunc
+	read, write                 *rate.Limiter
+	readDeadline, writeDeadline rateDeadline
+}
+
+// rateDeadline is the read or write deadline of a RateLimitedConn, changing it
+// interrupts the pending wait so that the new deadline applies
+type rateDeadline struct {
+	access sync.Mutex
+	t      time.Time
+	cancel context.CancelFunc // of the pending wait
+}
+
+func (d *rateDeadline) set(t time.Time) {
+	d.access.Lock()
+	defer d.access.Unlock()
+	d.t = t
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// rateLimitMinBurst keeps the bucket of a low rate large enough for a typical buffer
+const rateLimitMinBurst = 16 * 1024
+
+func NewRateLimitedConn(ctx context.Context, c N.ExtendedConn, bytesPerSecond uint64) *RateLimitedConn {
+	burst := int(bytesPerSecond / 10)
+	if burst < rateLimitMinBurst {
+		burst = rateLimitMinBurst
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &RateLimitedConn{
+		ExtendedConn: c,
+		ctx:          ctx,
+		cancel:       cancel,
+		read:         rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		write:        rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// wait takes n tokens from limiter, in pieces no larger than its burst
+func (c *RateLimitedConn) wait(limiter *rate.Limiter, deadline *rateDeadline, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+		if err := c.waitN(limiter, deadline, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (c *RateLimitedConn) waitN(limiter *rate.Limiter, deadline *rateDeadline, n int) error {
+	if limiter.AllowN(time.Now(), n) {
+		return nil
+	}
+	for {
+		deadline.access.Lock()
+		t := deadline.t
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if t.IsZero() {
+			ctx, cancel = context.WithCancel(c.ctx)
+		} else {
+			ctx, cancel = context.WithDeadline(c.ctx, t)
+		}
+		deadline.cancel = cancel
+		deadline.access.Unlock()
+		err := limiter.WaitN(ctx, n)
+		deadline.access.Lock()
+		deadline.cancel = nil
+		changed := !deadline.t.Equal(t)
+		deadline.access.Unlock()
+		cancel()
+		switch {
+		case err == nil:
+			return nil
+		case c.ctx.Err() != nil:
+			return context.Cause(c.ctx)
+		case changed:
+			continue
+		case !t.IsZero():
+			// the deadline passed or comes before enough tokens would
+			return os.ErrDeadlineExceeded
+		default:
+			return err
+		}
+	}
+}
+
+func (c *RateLimitedConn) Read(b []byte) (int, error) {
+	if len(b) > c.read.Burst() {
+		b = b[:c.read.Burst()]
+	}
+	n, err := c.ExtendedConn.Read(b)
+	if waitErr := c.wait(c.read, &c.readDeadline, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (c *RateLimitedConn) ReadBuffer(buffer *buf.Buffer) error {
+	err := c.ExtendedConn.ReadBuffer(buffer)
+	if waitErr := c.wait(c.read, &c.readDeadline, buffer.Len()); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+func (c *RateLimitedConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.write.Burst() {
+			chunk = chunk[:c.write.Burst()]
+		}
+		if err = c.wait(c.write, &c.writeDeadline, len(chunk)); err != nil {
+			return
+		}
+		var written int
+		written, err = c.ExtendedConn.Write(chunk)
+		n += written
+		if err != nil {
+			return
+		}
+		b = b[written:]
+	}
+	return
+}
+
+func (c *RateLimitedConn) WriteBuffer(buffer *buf.Buffer) error {
+	if err := c.wait(c.write, &c.writeDeadline, buffer.Len()); err != nil {
+		buffer.Release()
+		return err
+	}
+	return c.ExtendedConn.WriteBuffer(buffer)
+}
+
+func (c *RateLimitedConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return c.ExtendedConn.SetDeadline(t)
+}
+
+func (c *RateLimitedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.ExtendedConn.SetReadDeadline(t)
+}
+
+func (c *RateLimitedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.ExtendedConn.SetWriteDeadline(t)
+}
+
+func (c *RateLimitedConn) Upstream() any {
+	return c.ExtendedConn
+}
+
+// WriterReplaceable and ReaderReplaceable stay false so that copies can't bypass the limiter
+func (c *RateLimitedConn) WriterReplaceable() bool {
+	return false
+}
+
+func (c *RateLimitedConn) ReaderReplaceable() bool {
+	return false
+}
+
+func (c *RateLimitedConn) Close() error {
+	c.cancel(net.ErrClosed)
+	return c.ExtendedConn.Close()
 }
 
 type packetConn struct {
@@ -273,17 +727,140 @@ type packetConn struct {
 	connID      string
 	adapterAddr string
 	resolveUDP  func(ctx context.Context, metadata *C.Metadata) error
+	refs        []releasableRef
+	up, down    atomic.Uint64
+	firstPeer   atomic.TypedValue[string]
+
+	peerAccess     sync.Mutex
+	peers          map[string]struct{} // distinct WriteTo destinations, up to packetConnMaxPeers
+	overflowWrites uint64              // writes to a destination not tracked as the set was full
+
+	idleTimeout time.Duration
+	idleAccess  sync.Mutex
+	idleTimer   *time.Timer
+	idleClosed  bool         // set by Close, checkIdle must not rearm the timer afterwards
+	lastActive  atomic.Int64 // unix nano
+}
+
+// packetConnMaxPeers bounds the destinations a packetConn remembers for PeerCount
+var packetConnMaxPeers = 1024
+
+type packetConnOption func(c *packetConn)
+
+// withIdleTimeout closes the conn like an expired NAT mapping once no packet
+// was read or written within timeout
+func withIdleTimeout(timeout time.Duration) packetConnOption {
+	return func(c *packetConn) {
+		c.idleTimeout = timeout
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.recordPeer(addr)
+	c.countPeer(addr)
+	return c.EnhancePacketConn.WriteTo(p, addr)
+}
+
+func (c *packetConn) countDown(n int) {
+	c.down.Add(uint64(n))
+	c.markActive()
+}
+
+func (c *packetConn) countUp(n int) {
+	c.up.Add(uint64(n))
+	c.markActive()
+}
+
+func (c *packetConn) markActive() {
+	if c.idleTimeout > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+func (c *packetConn) startIdleTimer() {
+	c.markActive()
+	c.idleAccess.Lock()
+	defer c.idleAccess.Unlock()
+	c.idleTimer = time.AfterFunc(c.idleTimeout, c.checkIdle)
+}
+
+func (c *packetConn) checkIdle() {
+	idle := time.Since(time.Unix(0, c.lastActive.Load()))
+	if idle < c.idleTimeout {
+		c.idleAccess.Lock()
+		defer c.idleAccess.Unlock()
+		if !c.idleClosed {
+			c.idleTimer.Reset(c.idleTimeout - idle)
+		}
+		return
+	}
+	_ = c.Close()
+}
+
+// Stats returns the bytes written to and read from the proxy through this conn
+func (c *packetConn) Stats() (up, down uint64) {
+	return c.up.Load(), c.down.Load()
 }
 
 func (c *packetConn) ResolveUDP(ctx context.Context, metadata *C.Metadata) error {
 	return c.resolveUDP(ctx, metadata)
 }
 
+// RemoteDestination returns the first peer written to, or the adapter host before any write
 func (c *packetConn) RemoteDestination() string {
+	if peer := c.firstPeer.Load(); peer != "" {
+		return peer
+	}
 	host, _, _ := net.SplitHostPort(c.adapterAddr)
 	return host
 }
 
+func (c *packetConn) recordPeer(addr net.Addr) {
+	if c.firstPeer.Load() != "" {
+		return
+	}
+	m := C.Metadata{}
+	if err := m.SetRemoteAddr(addr); err == nil && m.Valid() {
+		c.firstPeer.CompareAndSwap("", m.String())
+	}
+}
+
+func (c *packetConn) countPeer(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
+	c.peerAccess.Lock()
+	defer c.peerAccess.Unlock()
+	if _, ok := c.peers[key]; ok {
+		return
+	}
+	if len(c.peers) >= packetConnMaxPeers {
+		c.overflowWrites++
+		return
+	}
+	if c.peers == nil {
+		c.peers = make(map[string]struct{})
+	}
+	c.peers[key] = struct{}{}
+}
+
+// PeerCount returns the number of distinct destinations written to, at most packetConnMaxPeers
+func (c *packetConn) PeerCount() int {
+	c.peerAccess.Lock()
+	defer c.peerAccess.Unlock()
+	return len(c.peers)
+}
+
+// OverflowWrites returns the writes to destinations left untracked once PeerCount reached
+// its bound. It counts writes, not peers, repeated writes to one untracked destination all
+// add up. Non zero means PeerCount is a lower bound.
+func (c *packetConn) OverflowWrites() uint64 {
+	c.peerAccess.Lock()
+	defer c.peerAccess.Unlock()
+	return c.overflowWrites
+}
+
 // Chains implements C.Connection
 func (c *packetConn) Chains() C.Chain {
 	return c.chain
@@ -313,84 +890,304 @@ func (c *packetConn) ReaderReplaceable() bool {
 
 func (c *packetConn) AddRef(ref any) {
 	c.EnhancePacketConn = N.NewRefPacketConn(c.EnhancePacketConn, ref) // add ref for autoCloseProxyAdapter
+	if ref, ok := ref.(releasableRef); ok {
+		c.refs = append(c.refs, ref)
+	}
 }
 
-func newPacketConn(pc net.PacketConn, a ProxyAdapter) C.PacketConn {
+func (c *packetConn) Close() error {
+	c.idleAccess.Lock()
+	c.idleClosed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.idleAccess.Unlock()
+	for _, ref := range c.refs {
+		ref.release()
+	}
+	return c.EnhancePacketConn.Close()
+}
+
+func newPacketConn(pc net.PacketConn, a ProxyAdapter, options ...packetConnOption) C.PacketConn {
 	epc := N.NewEnhancePacketConn(pc)
 	if _, ok := pc.(syscall.Conn); !ok { // exclusion system conn like *net.UDPConn
 		epc = N.NewDeadlineEnhancePacketConn(epc) // most conn from outbound can't handle readDeadline correctly
 	}
-	return &packetConn{epc, []string{a.Name()}, a.Name(), utils.NewUUIDV4().String(), a.Addr(), a.ResolveUDP}
+	c := &packetConn{
+		chain:       []string{a.Name()},
+		adapterName: a.Name(),
+		connID:      utils.NewUUIDV4().String(),
+		adapterAddr: a.Addr(),
+		resolveUDP:  a.ResolveUDP,
+	}
+	c.EnhancePacketConn = &counterPacketConn{EnhancePacketConn: epc, read: c.countDown, write: c.countUp}
+	if a, ok := a.(interface{ udpIdleTimeout() time.Duration }); ok {
+		c.idleTimeout = a.udpIdleTimeout()
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.idleTimeout > 0 {
+		c.startIdleTimer()
+	}
+	return c
+}
+
+// counterPacketConn counts the bytes of a packetConn, it isn't replaceable so that
+// unwrapping the packetConn stops here
+type counterPacketConn struct {
+	N.EnhancePacketConn
+	read, write func(n int)
+}
+
+func (c *counterPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.EnhancePacketConn.ReadFrom(p)
+	c.read(n)
+	return
+}
+
+func (c *counterPacketConn) WaitReadFrom() (data []byte, put func(), addr net.Addr, err error) {
+	data, put, addr, err = c.EnhancePacketConn.WaitReadFrom()
+	c.read(len(data))
+	return
+}
+
+func (c *counterPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.EnhancePacketConn.WriteTo(p, addr)
+	c.write(n)
+	return
+}
+
+func (c *counterPacketConn) Upstream() any {
+	return c.EnhancePacketConn
 }
 
 type AddRef interface {
 	AddRef(ref any)
 }
 
+// releasableRef is a ref which is told when the conn holding it is closed
+type releasableRef interface {
+	release()
+}
+
+// adapterRef keeps its autoCloseProxyAdapter alive and counts one live conn of it until released,
+// by the conn's Close or by the finalizer for a conn dropped without closing
+type adapterRef struct {
+	adapter *autoCloseProxyAdapter
+	once    sync.Once
+}
+
+func (r *adapterRef) release() {
+	r.once.Do(func() {
+		runtime.SetFinalizer(r, nil)
+		r.adapter.releaseRef()
+	})
+}
+
 type autoCloseProxyAdapter struct {
 	ProxyAdapter
 	closeOnce sync.Once
 	closeErr  error
+	closed    atomic.Bool
+
+	refs     atomic.Int64
+	released chan struct{} // signaled when a ref is released
+
+	onClose func(name string) // told once the wrapped proxy is closed
 }
 
 func (p *autoCloseProxyAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (_ C.Conn, err error) {
+	p.markUsed()
 	c, err := p.ProxyAdapter.DialContext(ctx, metadata)
 	if err != nil {
 		return nil, err
 	}
 	if c, ok := c.(AddRef); ok {
-		c.AddRef(p)
+		c.AddRef(p.newRef())
 	}
 	return c, nil
 }
 
 func (p *autoCloseProxyAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (_ C.Conn, err error) {
+	p.markUsed()
 	c, err := p.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
 	if err != nil {
 		return nil, err
 	}
 	if c, ok := c.(AddRef); ok {
-		c.AddRef(p)
+		c.AddRef(p.newRef())
 	}
 	return c, nil
 }
 
 func (p *autoCloseProxyAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (_ C.PacketConn, err error) {
+	p.markUsed()
 	pc, err := p.ProxyAdapter.ListenPacketContext(ctx, metadata)
 	if err != nil {
 		return nil, err
 	}
 	if pc, ok := pc.(AddRef); ok {
-		pc.AddRef(p)
+		pc.AddRef(p.newRef())
 	}
 	return pc, nil
 }
 
 func (p *autoCloseProxyAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (_ C.PacketConn, err error) {
+	p.markUsed()
 	pc, err := p.ProxyAdapter.ListenPacketWithDialer(ctx, dialer, metadata)
 	if err != nil {
 		return nil, err
 	}
 	if pc, ok := pc.(AddRef); ok {
-		pc.AddRef(p)
+		pc.AddRef(p.newRef())
 	}
 	return pc, nil
 }
 
+// LastUsed returns the last time the wrapped proxy was dialed
+func (p *autoCloseProxyAdapter) LastUsed() time.Time {
+	if a, ok := p.ProxyAdapter.(lastUsedAdapter); ok {
+		return a.LastUsed()
+	}
+	return time.Time{}
+}
+
+func (p *autoCloseProxyAdapter) markUsed() {
+	if a, ok := p.ProxyAdapter.(lastUsedAdapter); ok {
+		a.markUsed()
+	}
+}
+
+func (p *autoCloseProxyAdapter) newRef() *adapterRef {
+	p.refs.Add(1)
+	ref := &adapterRef{adapter: p}
+	runtime.SetFinalizer(ref, (*adapterRef).release)
+	return ref
+}
+
+// ActiveConns returns the number of conns dialed through the proxy and not yet closed
+func (p *autoCloseProxyAdapter) ActiveConns() int {
+	return int(p.refs.Load())
+}
+
+func (p *autoCloseProxyAdapter) releaseRef() {
+	p.refs.Add(-1)
+	select {
+	case p.released <- struct{}{}:
+	default:
+	}
+}
+
+// Drain waits up to timeout for the conns dialed through the proxy to be closed, then closes it.
+// Close stays the immediate path.
+func (p *autoCloseProxyAdapter) Drain(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for p.refs.Load() > 0 {
+		select {
+		case <-p.released:
+		case <-timer.C:
+			log.Debugln("Proxy [%s] still has %d connections after draining for %s", p.Name(), p.refs.Load(), timeout)
+			return p.Close()
+		}
+	}
+	return p.Close()
+}
+
 func (p *autoCloseProxyAdapter) Close() error {
 	p.closeOnce.Do(func() {
 		log.Debugln("Closing outdated proxy [%s]", p.Name())
 		runtime.SetFinalizer(p, nil)
 		p.closeErr = p.ProxyAdapter.Close()
+		p.closed.Store(true)
+		if p.onClose != nil {
+			p.onClose(p.Name())
+		}
 	})
 	return p.closeErr
 }
 
+// IsClosed reports whether Close has run, either called directly or by the finalizer
+func (p *autoCloseProxyAdapter) IsClosed() bool {
+	return p.closed.Load()
+}
+
 func NewAutoCloseProxyAdapter(adapter ProxyAdapter) ProxyAdapter {
+	return NewAutoCloseProxyAdapterWithOnClose(adapter, nil)
+}
+
+// NewAutoCloseProxyAdapterWithOnClose is NewAutoCloseProxyAdapter calling onClose with the proxy
+// name once it has been closed, whether by Close, Drain or the finalizer
+func NewAutoCloseProxyAdapterWithOnClose(adapter ProxyAdapter, onClose func(name string)) ProxyAdapter {
 	proxy := &autoCloseProxyAdapter{
 		ProxyAdapter: adapter,
+		released:     make(chan struct{}, 1),
+		onClose:      onClose,
 	}
 	// auto close ProxyAdapter
 	runtime.SetFinalizer(proxy, (*autoCloseProxyAdapter).Close)
 	return proxy
 }
+
+// rateLimitedProxyAdapter caps the throughput of every tcp conn dialed through the proxy,
+// udp is left as is
+type rateLimitedProxyAdapter struct {
+	ProxyAdapter
+	bytesPerSecond uint64
+}
+
+func (p *rateLimitedProxyAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	c, err := p.ProxyAdapter.DialContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return p.limit(c), nil
+}
+
+func (p *rateLimitedProxyAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	c, err := p.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return p.limit(c), nil
+}
+
+// limit caps the conn of this package under c, looking through wrappers like the loopback detector's
+func (p *rateLimitedProxyAdapter) limit(c C.Conn) C.Conn {
+	var inner any = c
+	for inner != nil {
+		if limited, ok := inner.(interface{ limitRate(uint64) }); ok {
+			limited.limitRate(p.bytesPerSecond)
+			break
+		}
+		upstream, ok := inner.(interface{ Upstream() any })
+		if !ok {
+			break
+		}
+		inner = upstream.Upstream()
+	}
+	return c
+}
+
+// LastUsed returns the last time the wrapped proxy was dialed
+func (p *rateLimitedProxyAdapter) LastUsed() time.Time {
+	if a, ok := p.ProxyAdapter.(lastUsedAdapter); ok {
+		return a.LastUsed()
+	}
+	return time.Time{}
+}
+
+func (p *rateLimitedProxyAdapter) markUsed() {
+	if a, ok := p.ProxyAdapter.(lastUsedAdapter); ok {
+		a.markUsed()
+	}
+}
+
+// NewRateLimitedProxyAdapter caps each tcp conn of adapter at bytesPerSecond in each direction
+func NewRateLimitedProxyAdapter(adapter ProxyAdapter, bytesPerSecond uint64) ProxyAdapter {
+	return &rateLimitedProxyAdapter{
+		ProxyAdapter:   adapter,
+		bytesPerSecond: bytesPerSecond,
+	}
+}
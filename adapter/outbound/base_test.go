@@ -0,0 +1,887 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	N "github.com/metacubex/mihomo/common/net"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/resolver"
+	C "github.com/metacubex/mihomo/constant"
+
+	"github.com/metacubex/sing/common/bufio"
+	"github.com/metacubex/sing/common/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseBindPort(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	assert.Len(t, base.DialOptions(), 0)
+
+	// pick a free local port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	base = NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, BindPort: port})
+	opts := base.DialOptions()
+	assert.Len(t, opts, 1)
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	c, err := dialer.DialContext(context.Background(), "tcp", server.Addr().String(), opts...)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, port, c.LocalAddr().(*net.TCPAddr).Port)
+
+	pc, err := dialer.ListenPacket(context.Background(), "udp", "127.0.0.1:0", netip.MustParseAddrPort("127.0.0.1:53"), opts...)
+	require.NoError(t, err)
+	defer pc.Close()
+	assert.Equal(t, port, pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestBaseFallbackDelay(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, Prefer: C.IPv4Prefer})
+	assert.Len(t, base.DialOptions(), 1)
+
+	base = NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, Prefer: C.IPv4Prefer, FallbackDelay: 50})
+	opts := base.DialOptions()
+	assert.Len(t, opts, 2)
+	assert.Equal(t, dialer.NewDialer(dialer.WithPreferIPv4(), dialer.WithFallbackDelay(50*time.Millisecond)), dialer.NewDialer(opts...))
+	assert.NotEqual(t, dialer.NewDialer(dialer.WithPreferIPv4(), dialer.WithFallbackDelay(time.Second)), dialer.NewDialer(opts...))
+}
+
+func TestBaseWithInterface(t *testing.T) {
+	base := NewBase(BaseOption{
+		Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, UDP: true, XUDP: true, TFO: true, MPTCP: true,
+		Interface: "eth0", RoutingMark: 1, BindPort: 2, FallbackDelay: 3, DialTimeout: 4, UDPIdleTimeout: 5,
+		SockOpts: []string{"SO_SNDBUF=1024"}, Prefer: C.IPv4Prefer,
+	})
+	id := base.Id()
+
+	clone := base.WithInterface("wlan0")
+	assert.Equal(t, "wlan0", clone.iface)
+	assert.Equal(t, "eth0", base.iface)
+	assert.NotEqual(t, id, clone.Id())
+	assert.Equal(t, id, base.Id())
+
+	// no shared mutable state
+	clone.sopts[0] = "SO_RCVBUF=1024"
+	assert.Equal(t, []string{"SO_SNDBUF=1024"}, base.sopts)
+	clone.markUsed()
+	assert.True(t, base.LastUsed().IsZero())
+
+	// everything else is identical
+	clone = base.WithInterface("wlan0")
+	clone.iface, clone.id = base.iface, base.id
+	assert.Equal(t, base, clone)
+}
+
+func TestBaseSockOpts(t *testing.T) {
+	assert.NoError(t, BasicOption{SockOpts: []string{"SO_SNDBUF=1048576", "SO_RCVBUF=1048576"}}.ValidateSockOpts())
+	assert.Error(t, BasicOption{SockOpts: []string{"SO_SNDBUF=1048576", "SO_SNDBUF"}}.ValidateSockOpts())
+	assert.Error(t, BasicOption{SockOpts: []string{"SO_NOPE=1"}}.ValidateSockOpts())
+
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, SockOpts: []string{"SO_SNDBUF=1048576"}})
+	opts := base.DialOptions()
+	assert.Len(t, opts, 1)
+
+	sockOpt, err := dialer.ParseSockOpt("SO_SNDBUF=1048576")
+	require.NoError(t, err)
+	assert.Equal(t, dialer.NewDialer(dialer.WithSockOpt(sockOpt)), dialer.NewDialer(opts...))
+}
+
+func TestBaseDialOptionsFor(t *testing.T) {
+	preferOpts := map[C.DNSPrefer][]dialer.Option{
+		C.DualStack:  nil,
+		C.IPv4Only:   {dialer.WithOnlySingleStack(true)},
+		C.IPv6Only:   {dialer.WithOnlySingleStack(false)},
+		C.IPv4Prefer: {dialer.WithPreferIPv4()},
+		C.IPv6Prefer: {dialer.WithPreferIPv6()},
+	}
+	for base := range preferOpts {
+		for hint := range preferOpts {
+			b := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, Prefer: base})
+			want := preferOpts[hint]
+			if hint == C.DualStack { // no hint keeps the proxy's ip-version
+				want = preferOpts[base]
+			}
+			assert.Equal(t, dialer.NewDialer(want...), dialer.NewDialer(b.DialOptionsFor(&C.Metadata{IPVersion: hint})...), "base %s, hint %s", base, hint)
+		}
+		b := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, Prefer: base})
+		assert.Equal(t, dialer.NewDialer(b.DialOptions()...), dialer.NewDialer(b.DialOptionsFor(nil)...))
+	}
+}
+
+func TestBaseLastUsed(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	proxy := NewAutoCloseProxyAdapter(base).(*autoCloseProxyAdapter)
+	assert.True(t, proxy.LastUsed().IsZero())
+
+	before := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = proxy.DialContext(context.Background(), &C.Metadata{})
+			_, _ = proxy.ListenPacketContext(context.Background(), &C.Metadata{})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = proxy.LastUsed()
+		}()
+	}
+	wg.Wait()
+	assert.False(t, proxy.LastUsed().Before(before))
+	assert.Equal(t, base.LastUsed(), proxy.LastUsed())
+}
+
+func TestConnStats(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := NewConn(c1, base)
+	defer conn.Close()
+	stats := conn.(interface{ Stats() (uint64, uint64) })
+
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := c2.Read(buf)
+		_, _ = c2.Write(append(buf[:n], buf[:n]...))
+	}()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	up, down := stats.Stats()
+	assert.EqualValues(t, 5, up)
+	assert.EqualValues(t, 10, down)
+
+	// the conn stays replaceable, copies unwrap it down to the counter layer
+	assert.True(t, conn.(interface{ ReaderReplaceable() bool }).ReaderReplaceable())
+	assert.True(t, conn.(interface{ WriterReplaceable() bool }).WriterReplaceable())
+	_, counters := network.UnwrapCountReader(conn, nil)
+	assert.Len(t, counters, 1)
+	go func() { _, _ = c2.Write(bytes.Repeat([]byte{'x'}, 100)); _ = c2.Close() }()
+	n, err := bufio.Copy(io.Discard, conn)
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, n)
+	_, down = stats.Stats()
+	assert.EqualValues(t, 110, down)
+}
+
+func TestPacketConnStats(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	packetConn := newPacketConn(pc, base)
+	defer packetConn.Close()
+	stats := packetConn.(interface{ Stats() (uint64, uint64) })
+
+	_, err = packetConn.WriteTo([]byte("hello"), server.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	_, addr, err := server.ReadFrom(buf)
+	require.NoError(t, err)
+	_, err = server.WriteTo([]byte("hello world"), addr)
+	require.NoError(t, err)
+	_, err = server.WriteTo([]byte("bye"), addr)
+	require.NoError(t, err)
+
+	n, _, err := packetConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 11, n)
+	data, put, _, err := packetConn.WaitReadFrom()
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(data))
+	if put != nil {
+		put()
+	}
+	up, down := stats.Stats()
+	assert.EqualValues(t, 5, up)
+	assert.EqualValues(t, 14, down)
+
+	// unwrapping the replaceable packetConn stops at the counter layer
+	assert.True(t, packetConn.(interface{ ReaderReplaceable() bool }).ReaderReplaceable())
+	inner, ok := packetConn.(interface{ Upstream() any }).Upstream().(*counterPacketConn)
+	require.True(t, ok)
+	_, err = inner.WriteTo([]byte("again"), server.LocalAddr())
+	require.NoError(t, err)
+	up, _ = stats.Stats()
+	assert.EqualValues(t, 10, up)
+}
+
+func TestBaseDialContext(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	ctx, cancel := base.dialContext(context.Background())
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+
+	base = NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, DialTimeout: 2})
+	parent, parentCancel := context.WithTimeout(context.Background(), time.Minute)
+	defer parentCancel()
+	ctx, cancel = base.dialContext(parent)
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), deadline, time.Second)
+	cancel()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.NoError(t, parent.Err())
+
+	parent, parentCancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer parentCancel()
+	parentDeadline, _ := parent.Deadline()
+	ctx, cancel = base.dialContext(parent)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.Equal(t, parentDeadline, deadline)
+}
+
+type testRecordDialer struct {
+	C.Dialer
+	network, address string
+	err              error
+}
+
+func (d *testRecordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.network, d.address = network, address
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestBaseDialContextWithDialer(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "10.0.0.1:443", Type: C.Http})
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("1.1.1.1"), DstPort: 80}
+	d := &testRecordDialer{}
+	_, err := base.DialContextWithDialer(context.Background(), d, metadata)
+	assert.ErrorIs(t, err, C.ErrNotSupport)
+	assert.Equal(t, C.NetWork(C.InvalidNet), base.SupportWithDialer())
+	assert.Empty(t, d.address)
+}
+
+func TestBaseDialRawWithDialer(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "10.0.0.1:443", Type: C.Http})
+	d := &testRecordDialer{}
+	conn, err := base.DialRawWithDialer(context.Background(), d)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "tcp", d.network)
+	assert.Equal(t, "10.0.0.1:443", d.address) // the adapter, not the destination
+	assert.Equal(t, C.Chain{"test"}, conn.Chains())
+
+	d.err = errors.New("refused")
+	_, err = base.DialRawWithDialer(context.Background(), d)
+	assert.ErrorIs(t, err, d.err)
+	assert.ErrorContains(t, err, "10.0.0.1:443 connect error")
+
+	// nothing to dial without an addr
+	base = NewBase(BaseOption{Name: "direct", Type: C.Direct})
+	d = &testRecordDialer{}
+	_, err = base.DialRawWithDialer(context.Background(), d)
+	assert.ErrorIs(t, err, C.ErrNotSupport)
+	assert.Empty(t, d.address)
+}
+
+type testCacheResolver struct {
+	resolver.Resolver
+	cached  atomic.Bool
+	lookups atomic.Int32 // lookups that missed the cache
+}
+
+func (r *testCacheResolver) lookup(ctx context.Context) []netip.Addr {
+	if !r.cached.Load() || resolver.BypassCache(ctx) {
+		r.lookups.Add(1)
+		r.cached.Store(true)
+	}
+	return []netip.Addr{netip.MustParseAddr("1.2.3.4")}
+}
+
+func (r *testCacheResolver) Invalid() bool { return true }
+
+func (r *testCacheResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	return r.lookup(ctx), nil
+}
+
+func (r *testCacheResolver) LookupIPv4(ctx context.Context, host string) ([]netip.Addr, error) {
+	return r.lookup(ctx), nil
+}
+
+func (r *testCacheResolver) LookupIPv6(ctx context.Context, host string) ([]netip.Addr, error) {
+	return nil, nil
+}
+
+func TestBaseResolveEveryDial(t *testing.T) {
+	oldResolver, oldFloor := resolver.DefaultResolver, resolveEveryDialFloor
+	defer func() { resolver.DefaultResolver, resolveEveryDialFloor = oldResolver, oldFloor }()
+	resolveDials := func(base *Base, n int) int32 {
+		r := &testCacheResolver{}
+		resolver.DefaultResolver = r
+		for i := 0; i < n; i++ {
+			metadata := &C.Metadata{Host: "cdn.example.com", DstPort: 443}
+			require.NoError(t, base.ResolveUDP(context.Background(), metadata))
+			assert.Equal(t, "1.2.3.4", metadata.DstIP.String())
+		}
+		return r.lookups.Load()
+	}
+
+	resolveEveryDialFloor = 0
+	assert.Equal(t, int32(1), resolveDials(NewBase(BaseOption{Name: "test"}), 3))
+	assert.Equal(t, int32(3), resolveDials(NewBase(BaseOption{Name: "test", ResolveEveryDial: true}), 3))
+
+	// dials within the floor share the cached answer
+	resolveEveryDialFloor = time.Hour
+	assert.Equal(t, int32(1), resolveDials(NewBase(BaseOption{Name: "test", ResolveEveryDial: true}), 3))
+
+	// the tcp path bypasses through the dial context
+	base := NewBase(BaseOption{Name: "test", ResolveEveryDial: true})
+	ctx, cancel := base.dialContext(context.Background())
+	defer cancel()
+	assert.True(t, resolver.BypassCache(ctx))
+	ctx, cancel = base.dialContext(context.Background())
+	defer cancel()
+	assert.False(t, resolver.BypassCache(ctx))
+	ctx, cancel = NewBase(BaseOption{Name: "test"}).dialContext(context.Background())
+	defer cancel()
+	assert.False(t, resolver.BypassCache(ctx))
+}
+
+func TestPacketConnIdleTimeout(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	newConn := func() C.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return newPacketConn(pc, base, withIdleTimeout(200*time.Millisecond))
+	}
+
+	idle := newConn()
+	active := newConn()
+	defer active.Close()
+	for i := 0; i < 10; i++ {
+		_, err = active.WriteTo([]byte("ping"), server.LocalAddr())
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	_, err = idle.WriteTo([]byte("ping"), server.LocalAddr())
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = active.WriteTo([]byte("ping"), server.LocalAddr())
+	assert.NoError(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	base = NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct, UDPIdleTimeout: 30})
+	configured := newPacketConn(pc, base).(*packetConn)
+	defer configured.Close()
+	assert.Equal(t, 30*time.Second, configured.idleTimeout)
+}
+
+func TestPacketConnIdleTimerClose(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	for i := 0; i < 50; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		c := newPacketConn(pc, base, withIdleTimeout(time.Millisecond)).(*packetConn)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 20; j++ {
+				c.markActive() // keeps checkIdle rearming the timer
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+		time.Sleep(time.Duration(i%5) * 500 * time.Microsecond)
+		_ = c.Close() // the timer may have closed it already
+		<-done
+
+		// a checkIdle fired right before Close mustn't rearm the timer
+		c.markActive()
+		c.checkIdle()
+		c.idleAccess.Lock()
+		assert.False(t, c.idleTimer.Stop())
+		c.idleAccess.Unlock()
+	}
+}
+
+type closeErrAdapter struct {
+	*Base
+	closes int
+}
+
+func (a *closeErrAdapter) Close() error {
+	a.closes++
+	return errors.New("close failed")
+}
+
+func TestAutoCloseProxyAdapterIsClosed(t *testing.T) {
+	adapter := &closeErrAdapter{Base: NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})}
+	proxy := NewAutoCloseProxyAdapter(adapter).(*autoCloseProxyAdapter)
+	assert.False(t, proxy.IsClosed())
+
+	err := proxy.Close()
+	assert.EqualError(t, err, "close failed")
+	assert.True(t, proxy.IsClosed())
+	assert.Equal(t, err, proxy.Close())
+	assert.Equal(t, 1, adapter.closes)
+}
+
+func TestAutoCloseProxyAdapterOnClose(t *testing.T) {
+	adapter := &closeErrAdapter{Base: NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})}
+	var closed []string
+	proxy := NewAutoCloseProxyAdapterWithOnClose(adapter, func(name string) {
+		assert.Equal(t, 1, adapter.closes) // after the underlying close
+		closed = append(closed, name)
+	}).(*autoCloseProxyAdapter)
+	assert.Empty(t, closed)
+
+	_ = proxy.Close()
+	assert.Equal(t, []string{"test"}, closed)
+	_ = proxy.Close()
+	_ = proxy.Drain(time.Millisecond)
+	assert.Equal(t, []string{"test"}, closed)
+}
+
+type pipeAdapter struct {
+	*Base
+	closed atomic.Bool
+}
+
+func (a *pipeAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	c, _ := net.Pipe()
+	return NewConn(c, a), nil
+}
+
+func (a *pipeAdapter) Close() error {
+	a.closed.Store(true)
+	return nil
+}
+
+func TestAutoCloseProxyAdapterDrain(t *testing.T) {
+	adapter := &pipeAdapter{Base: NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})}
+	proxy := NewAutoCloseProxyAdapter(adapter).(*autoCloseProxyAdapter)
+	conn, err := proxy.DialContext(context.Background(), &C.Metadata{})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, proxy.Drain(5*time.Second))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, adapter.closed.Load(), "closed while a conn is still open")
+
+	require.NoError(t, conn.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't return after the conn was closed")
+	}
+	assert.True(t, adapter.closed.Load())
+	assert.True(t, proxy.IsClosed())
+
+	// a conn outliving the timeout doesn't hold the close back
+	adapter = &pipeAdapter{Base: NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})}
+	proxy = NewAutoCloseProxyAdapter(adapter).(*autoCloseProxyAdapter)
+	conn, err = proxy.DialContext(context.Background(), &C.Metadata{})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, proxy.Drain(20*time.Millisecond))
+	assert.True(t, adapter.closed.Load())
+}
+
+func TestAutoCloseProxyAdapterActiveConns(t *testing.T) {
+	adapter := &pipeAdapter{Base: NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})}
+	proxy := NewAutoCloseProxyAdapter(adapter).(*autoCloseProxyAdapter)
+
+	const count = 8
+	conns := make(chan C.Conn, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := proxy.DialContext(context.Background(), &C.Metadata{})
+			if assert.NoError(t, err) {
+				conns <- conn
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	assert.Equal(t, count, proxy.ActiveConns())
+
+	for conn := range conns {
+		wg.Add(1)
+		go func(conn C.Conn) {
+			defer wg.Done()
+			_ = conn.Close()
+			_ = conn.Close() // closing twice releases once
+		}(conn)
+	}
+	wg.Wait()
+	assert.Zero(t, proxy.ActiveConns())
+
+	// a conn dropped without Close is released by the finalizer
+	_, err := proxy.DialContext(context.Background(), &C.Metadata{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, proxy.ActiveConns())
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return proxy.ActiveConns() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSplitDialerProxyChain(t *testing.T) {
+	mapping := map[string]any{"name": "test", "dialer-proxy": "a"}
+	split, chain, err := SplitDialerProxyChain(mapping)
+	require.NoError(t, err)
+	assert.Nil(t, chain)
+	assert.Equal(t, mapping, split)
+	assert.Equal(t, []string{"a"}, BasicOption{DialerProxy: "a"}.DialerProxyChain())
+	assert.Nil(t, BasicOption{}.DialerProxyChain())
+
+	mapping = map[string]any{"name": "test", "dialer-proxy": []any{"a", "b", "c"}}
+	split, chain, err = SplitDialerProxyChain(mapping)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, chain)
+	assert.Equal(t, "c", split["dialer-proxy"])
+	assert.Equal(t, []any{"a", "b", "c"}, mapping["dialer-proxy"], "the input mapping is left alone")
+	assert.Equal(t, chain, BasicOption{DialerProxy: "c", DialerProxies: chain}.DialerProxyChain())
+
+	_, _, err = SplitDialerProxyChain(map[string]any{"dialer-proxy": []any{}})
+	assert.Error(t, err)
+	_, _, err = SplitDialerProxyChain(map[string]any{"dialer-proxy": []any{"a", 1}})
+	assert.Error(t, err)
+}
+
+func TestBaseMarshalJSON(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Vless, UDP: true, XUDP: true})
+	data, err := json.Marshal(base)
+	require.NoError(t, err)
+
+	var mapping map[string]any
+	require.NoError(t, json.Unmarshal(data, &mapping))
+	assert.Equal(t, "Vless", mapping["type"])
+	assert.Equal(t, base.Id(), mapping["id"])
+	assert.Equal(t, "127.0.0.1:10000", mapping["addr"])
+	assert.Equal(t, true, mapping["udp"])
+	assert.Equal(t, true, mapping["xudp"])
+}
+
+func TestBaseProxyInfoAddr(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "proxy.example.com:10000", Type: C.Http})
+	assert.Equal(t, "proxy.example.com:10000", base.ProxyInfo().Addr)
+
+	base = NewBase(BaseOption{Name: "test", Addr: "user:p@ss@proxy.example.com:10000", Type: C.Http})
+	assert.Equal(t, "proxy.example.com:10000", base.ProxyInfo().Addr)
+	data, err := json.Marshal(base)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "p@ss")
+
+	h, err := NewHttp(HttpOption{Name: "http", Server: "::1", Port: 8080, UserName: "user", Password: "secret"})
+	require.NoError(t, err)
+	info := h.ProxyInfo()
+	assert.Equal(t, "[::1]:8080", info.Addr)
+	assert.NotContains(t, info.Addr, "secret")
+}
+
+func TestPacketConnRemoteDestination(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "proxy.example.com:10000", Type: C.Direct})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	packetConn := newPacketConn(pc, base)
+	defer packetConn.Close()
+	assert.Equal(t, "proxy.example.com", packetConn.RemoteDestination())
+
+	_, err = packetConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", packetConn.RemoteDestination())
+	// later peers of a connectionless flow don't replace the first one
+	_, _ = packetConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9})
+	assert.Equal(t, "127.0.0.1", packetConn.RemoteDestination())
+}
+
+func TestPacketConnPeerCount(t *testing.T) {
+	oldMax := packetConnMaxPeers
+	packetConnMaxPeers = 3
+	defer func() { packetConnMaxPeers = oldMax }()
+
+	base := NewBase(BaseOption{Name: "test", Addr: "proxy.example.com:10000", Type: C.Direct})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	packetConn := newPacketConn(pc, base).(*packetConn)
+	defer packetConn.Close()
+	assert.Equal(t, 0, packetConn.PeerCount())
+
+	write := func(port int) {
+		_, err := packetConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		require.NoError(t, err)
+	}
+	write(9)
+	write(9)
+	write(10)
+	assert.Equal(t, 2, packetConn.PeerCount())
+	assert.Zero(t, packetConn.OverflowWrites())
+
+	write(11)
+	write(12)
+	write(13)
+	write(13) // every write to an untracked peer counts
+	write(9)  // tracked peers are still recognized once full
+	assert.Equal(t, 3, packetConn.PeerCount())
+	assert.EqualValues(t, 3, packetConn.OverflowWrites())
+}
+
+func TestBaseCapabilities(t *testing.T) {
+	type capabilityAdapter interface {
+		C.ProxyAdapter
+		Capabilities() C.Capabilities
+	}
+	check := func(p capabilityAdapter) {
+		caps := p.Capabilities()
+		info := p.ProxyInfo()
+		assert.Equal(t, p.SupportUDP(), caps.Has(C.CapUDP))
+		assert.Equal(t, info.XUDP, caps.Has(C.CapXUDP))
+		assert.Equal(t, info.TFO, caps.Has(C.CapTFO))
+		assert.Equal(t, info.MPTCP, caps.Has(C.CapMPTCP))
+		assert.Equal(t, p.SupportUOT(), caps.Has(C.CapUOT))
+	}
+
+	for _, opt := range []BaseOption{
+		{Name: "none", Type: C.Http},
+		{Name: "udp", Type: C.Socks5, UDP: true},
+		{Name: "all", Type: C.Vmess, UDP: true, XUDP: true, TFO: true, MPTCP: true},
+		{Name: "tfo", Type: C.Http, TFO: true},
+	} {
+		check(NewBase(opt))
+	}
+	assert.Equal(t, C.CapUDP|C.CapXUDP|C.CapTFO|C.CapMPTCP,
+		NewBase(BaseOption{UDP: true, XUDP: true, TFO: true, MPTCP: true}).Capabilities())
+	assert.True(t, C.Capabilities(0).Has(0))
+	assert.False(t, (C.CapUDP | C.CapTFO).Has(C.CapUDP|C.CapUOT))
+
+	for _, uot := range []bool{false, true} {
+		ss, err := NewShadowSocks(ShadowSocksOption{
+			Name:       "ss",
+			Server:     "127.0.0.1",
+			Port:       10000,
+			Password:   "password",
+			Cipher:     "aes-128-gcm",
+			UDP:        true,
+			UDPOverTCP: uot,
+		})
+		require.NoError(t, err)
+		check(ss)
+		assert.Equal(t, uot, ss.Capabilities().Has(C.CapUOT))
+	}
+
+	trojan, err := NewTrojan(TrojanOption{Name: "trojan", Server: "127.0.0.1", Port: 10000, Password: "password"})
+	require.NoError(t, err)
+	check(trojan)
+	assert.True(t, trojan.Capabilities().Has(C.CapUOT))
+}
+
+func TestRateLimitedConn(t *testing.T) {
+	const limit = 256 * 1024 // bytes per second
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	c := NewConn(c1, base)
+	defer c.Close()
+	c.(*conn).limitRate(limit)
+
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	payload := make([]byte, limit/2)
+	start := time.Now()
+	n, err := c.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+	elapsed := time.Since(start)
+	// the first burst goes out right away, the rest at the limit
+	burst := limit / 10
+	if burst < rateLimitMinBurst {
+		burst = rateLimitMinBurst
+	}
+	minElapsed := time.Duration(float64(len(payload)-burst) / limit * float64(time.Second))
+	assert.GreaterOrEqual(t, elapsed, minElapsed*9/10)
+
+	// copies can't bypass the limiter and still count the bytes
+	go func() { _, _ = c2.Write(make([]byte, limit/2)); _ = c2.Close() }()
+	start = time.Now()
+	copied, err := bufio.Copy(io.Discard, c)
+	require.NoError(t, err)
+	assert.EqualValues(t, limit/2, copied)
+	assert.GreaterOrEqual(t, time.Since(start), minElapsed*9/10)
+	_, down := c.(interface{ Stats() (uint64, uint64) }).Stats()
+	assert.EqualValues(t, limit/2, down)
+}
+
+func TestRateLimitedConnCancel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewRateLimitedConn(ctx, N.NewExtendedConn(c1), 1024)
+	defer conn.Close()
+	assert.False(t, conn.WriterReplaceable())
+	assert.False(t, conn.ReaderReplaceable())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 4*rateLimitMinBurst)) // blocks for seconds at 1 KiB/s
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("blocked write not cancelled")
+	}
+}
+
+func TestRateLimitedConnCloseAndDeadline(t *testing.T) {
+	base := NewBase(BaseOption{Name: "test", Addr: "127.0.0.1:10000", Type: C.Direct})
+	newLimited := func() (*conn, *RateLimitedConn) {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { _ = c2.Close() })
+		go func() { _, _ = io.Copy(io.Discard, c2) }()
+		c := NewConn(c1, base).(*conn)
+		c.limitRate(1024)
+		return c, c.ExtendedConn.(*RateLimitedConn)
+	}
+	blockedWrite := func(c net.Conn) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Write(make([]byte, 4*rateLimitMinBurst)) // blocks for seconds at 1 KiB/s
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return done
+	}
+	expect := func(done chan error, target error) {
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, target)
+		case <-time.After(time.Second):
+			t.Fatal("blocked write not interrupted")
+		}
+	}
+
+	c, _ := newLimited()
+	done := blockedWrite(c)
+	require.NoError(t, c.Close())
+	expect(done, net.ErrClosed)
+
+	c, limited := newLimited()
+	defer c.Close()
+	done = blockedWrite(c)
+	require.NoError(t, c.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	expect(done, os.ErrDeadlineExceeded)
+
+	// a deadline set before the write applies as well, clearing it lifts it
+	require.NoError(t, c.SetDeadline(time.Now().Add(50*time.Millisecond)))
+	expect(blockedWrite(c), os.ErrDeadlineExceeded)
+	require.NoError(t, c.SetDeadline(time.Time{}))
+	assert.NoError(t, limited.wait(limited.write, &limited.writeDeadline, 1))
+}
+
+func TestRateLimitedProxyAdapter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			defer c.Close()
+			_, _ = io.Copy(io.Discard, c)
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+
+	proxy := NewRateLimitedProxyAdapter(NewDirect(), StringToBps("8 Mbps"))
+	assert.Equal(t, "DIRECT", proxy.Name())
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(addr.Port)}
+	c, err := proxy.DialContext(context.Background(), metadata)
+	require.NoError(t, err)
+	defer c.Close()
+	inner := c.(interface{ Upstream() any }).Upstream().(*conn) // under the loopback detector
+	limited, ok := inner.ExtendedConn.(*RateLimitedConn)
+	require.True(t, ok)
+	assert.EqualValues(t, 1000000, limited.write.Limit())
+}
+
+func TestBaseSetName(t *testing.T) {
+	base := NewBase(BaseOption{Name: "old", Type: C.Http})
+	clone := base.WithInterface("eth0")
+	base.SetName("new")
+	assert.Equal(t, "new", base.Name())
+	assert.Equal(t, "old", clone.Name()) // a copy taken before the rename keeps its name
+
+	names := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				base.SetName(names[i%len(names)])
+			}
+		}
+	}()
+	chains := make([]C.Chain, 8)
+	for i := range chains {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c1, c2 := net.Pipe()
+				c := NewConn(c1, base)
+				c.AppendToChains(base)
+				chains[i] = c.Chains()
+				_ = c.Close()
+				_ = c2.Close()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	for _, chain := range chains {
+		require.Len(t, chain, 2)
+		for _, name := range chain {
+			assert.Contains(t, append(names, "new"), name)
+		}
+	}
+}
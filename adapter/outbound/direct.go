@@ -25,12 +25,13 @@ func (d *Direct) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn,
 	if err := d.loopBack.CheckConn(metadata); err != nil {
 		return nil, err
 	}
-	opts := d.DialOptions()
+	opts := d.DialOptionsFor(metadata)
 	opts = append(opts, dialer.WithResolver(resolver.DirectHostResolver))
 	c, err := dialer.DialContext(ctx, "tcp", metadata.RemoteAddress(), opts...)
 	if err != nil {
 		return nil, err
 	}
+	markDialConnected(ctx)
 	return d.loopBack.NewConn(NewConn(c, d)), nil
 }
 
@@ -42,7 +43,7 @@ func (d *Direct) ListenPacketContext(ctx context.Context, metadata *C.Metadata)
 	if err := d.ResolveUDP(ctx, metadata); err != nil {
 		return nil, err
 	}
-	pc, err := dialer.NewDialer(d.DialOptions()...).ListenPacket(ctx, "udp", "", metadata.AddrPort())
+	pc, err := dialer.NewDialer(d.DialOptionsFor(metadata)...).ListenPacket(ctx, "udp", "", metadata.AddrPort())
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +75,12 @@ func NewDirectWithOption(option DirectOption) *Direct {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		loopBack: loopback.NewDetector(),
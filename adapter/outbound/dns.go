@@ -163,6 +163,12 @@ func NewDnsWithOption(option DnsOption) *Dns {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 	}
@@ -70,7 +70,9 @@ func (h *Http) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metad
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", h.addr)
+	dialCtx, dialCancel := h.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", h.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", h.addr, err)
 	}
@@ -185,6 +187,12 @@ func NewHttp(option HttpOption) (*Http, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		user:      option.UserName,
@@ -1,15 +1,26 @@
 package outbound
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/metacubex/mihomo/common/atomic"
+	"github.com/metacubex/mihomo/common/contextutils"
+	"github.com/metacubex/mihomo/common/net/deadline"
 	"github.com/metacubex/mihomo/component/ca"
 	"github.com/metacubex/mihomo/component/dialer"
 	"github.com/metacubex/mihomo/component/ech"
@@ -18,15 +29,18 @@ import (
 	C "github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/log"
 	hyCongestion "github.com/metacubex/mihomo/transport/hysteria/congestion"
+	"github.com/metacubex/mihomo/transport/hysteria/conns/udp"
 	"github.com/metacubex/mihomo/transport/hysteria/core"
 	"github.com/metacubex/mihomo/transport/hysteria/obfs"
 	"github.com/metacubex/mihomo/transport/hysteria/pmtud_fix"
 	"github.com/metacubex/mihomo/transport/hysteria/transport"
 	"github.com/metacubex/mihomo/transport/hysteria/utils"
 
+	"github.com/metacubex/fswatch"
 	"github.com/metacubex/quic-go"
 	"github.com/metacubex/quic-go/congestion"
 	M "github.com/metacubex/sing/common/metadata"
+	"github.com/metacubex/sing/common/uot"
 )
 
 const (
@@ -38,121 +52,803 @@ const (
 	DefaultALPN        = "hysteria"
 	DefaultProtocol    = "udp"
 	DefaultHopInterval = 10
+
+	DefaultWriteCoalesceSize  = 4096
+	DefaultWriteCoalesceDelay = 5 // ms
+)
+
+// package level defaults used by NewHysteria when an option is left zero,
+// embedders can override them before constructing adapters
+var (
+	hysteriaDefaultsMutex           sync.RWMutex
+	hysteriaStreamReceiveWindow     uint64 = DefaultStreamReceiveWindow
+	hysteriaConnectionReceiveWindow uint64 = DefaultConnectionReceiveWindow
+	hysteriaHopInterval                    = DefaultHopInterval * time.Second
 )
 
+// SetDefaultStreamReceiveWindow sets the stream receive window used when recv-window-conn is not set
+func SetDefaultStreamReceiveWindow(window uint64) {
+	hysteriaDefaultsMutex.Lock()
+	defer hysteriaDefaultsMutex.Unlock()
+	hysteriaStreamReceiveWindow = window
+}
+
+// SetDefaultConnectionReceiveWindow sets the connection receive window used when recv-window is not set
+func SetDefaultConnectionReceiveWindow(window uint64) {
+	hysteriaDefaultsMutex.Lock()
+	defer hysteriaDefaultsMutex.Unlock()
+	hysteriaConnectionReceiveWindow = window
+}
+
+// SetDefaultHopInterval sets the port hopping interval used when hop-interval is not set
+func SetDefaultHopInterval(d time.Duration) {
+	hysteriaDefaultsMutex.Lock()
+	defer hysteriaDefaultsMutex.Unlock()
+	hysteriaHopInterval = d
+}
+
+func hysteriaDefaults() (streamReceiveWindow, connectionReceiveWindow uint64, hopInterval time.Duration) {
+	hysteriaDefaultsMutex.RLock()
+	defer hysteriaDefaultsMutex.RUnlock()
+	return hysteriaStreamReceiveWindow, hysteriaConnectionReceiveWindow, hysteriaHopInterval
+}
+
+type HysteriaDialErrorKind int
+
+const (
+	HysteriaDialErrorNetwork HysteriaDialErrorKind = iota
+	HysteriaDialErrorAuth
+	HysteriaDialErrorTimeout
+	HysteriaDialErrorTLS
+)
+
+func (k HysteriaDialErrorKind) String() string {
+	switch k {
+	case HysteriaDialErrorAuth:
+		return "auth"
+	case HysteriaDialErrorTimeout:
+		return "timeout"
+	case HysteriaDialErrorTLS:
+		return "tls"
+	default:
+		return "network"
+	}
+}
+
+// HysteriaDialError is returned by Hysteria.DialContext and Hysteria.ListenPacketContext
+// when the underlying client failed to open a stream
+type HysteriaDialError struct {
+	Kind HysteriaDialErrorKind
+	Err  error
+}
+
+func (e *HysteriaDialError) Error() string {
+	return fmt.Sprintf("hysteria %s error: %s", e.Kind, e.Err.Error())
+}
+
+func (e *HysteriaDialError) Unwrap() error {
+	return e.Err
+}
+
+func newHysteriaDialError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HysteriaDialError{Kind: classifyHysteriaError(err), Err: err}
+}
+
+func classifyHysteriaError(err error) HysteriaDialErrorKind {
+	if errors.Is(err, core.ErrAuth) {
+		return HysteriaDialErrorAuth
+	}
+
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError() {
+		return HysteriaDialErrorTLS
+	}
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certInvalidErr) {
+		return HysteriaDialErrorTLS
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return HysteriaDialErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return HysteriaDialErrorTimeout
+	}
+
+	return HysteriaDialErrorNetwork
+}
+
+// hysteriaMaxInitCwnd is the largest init-cwnd accepted, in packets
+const hysteriaMaxInitCwnd = 1024
+
+// newHysteriaCongestion creates the congestion control of every connection, a var so tests can
+// see what reaches it
+var newHysteriaCongestion = func(refBPS uint64, initCwnd int) congestion.CongestionControl {
+	sender := hyCongestion.NewBrutalSender(congestion.ByteCount(refBPS))
+	if initCwnd > 0 {
+		sender.SetInitCongestionWindow(congestion.ByteCount(initCwnd))
+	}
+	return sender
+}
+
+// errHysteriaUDPDisabled is returned for udp when the udp option is false
+var errHysteriaUDPDisabled = fmt.Errorf("%w: udp disabled", C.ErrNotSupport)
+
+// hysteriaDialRetryDelay is the wait before the first dial retry, doubled for every further one
+var hysteriaDialRetryDelay = 100 * time.Millisecond
+
+// hysteriaDialWithRetries calls dial, then up to retries more times while it fails with an error
+// a new handshake may get past. It gives up early rather than wait beyond the deadline of ctx.
+func hysteriaDialWithRetries[T any](ctx context.Context, retries int, dial func() (T, error)) (T, error) {
+	delay := hysteriaDialRetryDelay
+	for attempt := 0; ; attempt++ {
+		result, err := dial()
+		if err == nil || attempt >= retries || !isRetryableHysteriaError(err) || ctx.Err() != nil {
+			return result, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return result, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableHysteriaError reports whether err may be transient, the server refusing
+// the client or a stream and certificate failures are final
+func isRetryableHysteriaError(err error) bool {
+	if errors.Is(err, core.ErrRejected) || errors.Is(err, core.ErrUDPRejected) || errors.Is(err, core.ErrClosed) {
+		return false
+	}
+	switch classifyHysteriaError(err) {
+	case HysteriaDialErrorAuth, HysteriaDialErrorTLS:
+		return false
+	default:
+		return true
+	}
+}
+
 type Hysteria struct {
 	*Base
 
 	option *HysteriaOption
 	client *core.Client
 
-	tlsConfig *tlsC.Config
-	echConfig *ech.Config
+	tlsConfig  *tlsC.Config
+	quicConfig *quic.Config
+	echConfig  *ech.Config
+
+	authWatcher *fswatch.Watcher
+
+	// hopPrefer pins the address family chosen by the first resolution when port hopping,
+	// so re-resolving the server never moves hops between IPv4 and IPv6
+	hopPrefer atomic.TypedValue[C.DNSPrefer]
+
+	lastResolvedIP atomic.TypedValue[netip.Addr]
+
+	streamSlots chan struct{} // one per open stream when max-streams is set
+	keyLog      *hyKeyLogWriter
+}
+
+// hysteriaKeyLogEnv has to be set to a true value for key-log-file to be accepted, so
+// a config from an untrusted source alone can't make the client leak its TLS secrets
+const hysteriaKeyLogEnv = "ALLOW_TLS_KEY_LOG"
+
+// hyKeyLogWriter appends the NSS key log lines of all connections to one file,
+// the handshakes of concurrent connections write through it
+type hyKeyLogWriter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openHyKeyLog(path string) (*hyKeyLogWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &hyKeyLogWriter{file: file}, nil
+}
+
+func (w *hyKeyLogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Write(p)
+}
+
+func (w *hyKeyLogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// hyStreamSlot is a taken slot of max-streams, released when the stream holding it closes
+type hyStreamSlot struct {
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (s *hyStreamSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { <-s.slots })
+}
+
+// acquireStream waits until fewer than max-streams streams are open, nil without a limit
+func (h *Hysteria) acquireStream(ctx context.Context) (*hyStreamSlot, error) {
+	if h.streamSlots == nil {
+		return nil, nil
+	}
+	select {
+	case h.streamSlots <- struct{}{}:
+		return &hyStreamSlot{slots: h.streamSlots}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (h *Hysteria) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
-	tcpConn, err := h.client.DialTCP(metadata.String(), metadata.DstPort, h.genHdc(ctx))
+	return h.dialContext(ctx, h.genHdc(ctx, nil), metadata)
+}
+
+// DialContextWithDialer implements C.ProxyAdapter, the stream doesn't use the shared connection but
+// one shared by the dials with an equal dialer, dialed through it as is, dialer-proxy isn't applied
+// on top of it
+func (h *Hysteria) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	return h.dialContext(ctx, h.genHdc(ctx, dialer), metadata)
+}
+
+func (h *Hysteria) dialContext(ctx context.Context, hdc *hyDialerWithContext, metadata *C.Metadata) (C.Conn, error) {
+	slot, err := h.acquireStream(ctx)
 	if err != nil {
 		return nil, err
 	}
+	hdc.streamClosed = slot.release
+	c, err := h.dialStream(ctx, hdc, metadata)
+	if err != nil {
+		slot.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (h *Hysteria) dialStream(ctx context.Context, hdc utils.PacketDialer, metadata *C.Metadata) (C.Conn, error) {
+	tcpConn, err := hysteriaDialWithRetries(ctx, h.option.DialRetries, func() (net.Conn, error) {
+		return h.client.DialTCP(metadata.String(), metadata.DstPort, hdc)
+	})
+	if err != nil {
+		return nil, newHysteriaDialError(err)
+	}
+	if h.option.ProxyProtocol {
+		if _, err = tcpConn.Write(proxyProtocolV2Header(metadata)); err != nil {
+			_ = tcpConn.Close()
+			return nil, err
+		}
+	}
+	if h.option.WriteCoalesce {
+		tcpConn = newHyCoalesceConn(tcpConn, h.option.WriteCoalesceSize, time.Duration(h.option.WriteCoalesceDelay)*time.Millisecond)
+	}
 
 	return NewConn(tcpConn, h), nil
 }
 
 func (h *Hysteria) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
-	if err := h.ResolveUDP(ctx, metadata); err != nil {
+	return h.listenPacketContext(ctx, h.genHdc(ctx, nil), metadata)
+}
+
+// ListenPacketWithDialer implements C.ProxyAdapter, like DialContextWithDialer the session uses the
+// connection of dialer, dialed through it as is
+func (h *Hysteria) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	return h.listenPacketContext(ctx, h.genHdc(ctx, dialer), metadata)
+}
+
+func (h *Hysteria) listenPacketContext(ctx context.Context, hdc *hyDialerWithContext, metadata *C.Metadata) (C.PacketConn, error) {
+	if !h.SupportUDP() {
+		return nil, errHysteriaUDPDisabled
+	}
+	slot, err := h.acquireStream(ctx)
+	if err != nil {
 		return nil, err
 	}
-	udpConn, err := h.client.DialUDP(h.genHdc(ctx))
+	hdc.streamClosed = slot.release
+	pc, err := h.listenPacket(ctx, hdc, metadata)
 	if err != nil {
+		slot.release()
 		return nil, err
 	}
-	return newPacketConn(&hyPacketConn{udpConn}, h), nil
+	return pc, nil
+}
+
+func (h *Hysteria) listenPacket(ctx context.Context, hdc utils.PacketDialer, metadata *C.Metadata) (C.PacketConn, error) {
+	if err := h.ResolveUDP(ctx, metadata); err != nil {
+		return nil, err
+	}
+	if h.option.UDPOverTCP {
+		return h.listenPacketOverStream(hdc, metadata)
+	}
+	udpConn, err := hysteriaDialWithRetries(ctx, h.option.DialRetries, func() (core.UDPConn, error) {
+		return h.client.DialUDP(hdc)
+	})
+	if err != nil {
+		if h.option.UDPOverStream && errors.Is(err, core.ErrUDPRejected) {
+			return h.listenPacketOverStream(hdc, metadata)
+		}
+		return nil, newHysteriaDialError(err)
+	}
+	return newPacketConn(newHyPacketConn(udpConn, h.option.MaxDatagramSize), h), nil
+}
+
+// MaxDatagramSize returns the largest udp payload a single WriteTo accepts, what the datagram
+// size negotiated on the connection carries unless max-datagram-size lowers it
+func (h *Hysteria) MaxDatagramSize() int {
+	size := h.client.MaxUDPPayloadSize()
+	if h.option.MaxDatagramSize > 0 && h.option.MaxDatagramSize < size {
+		return h.option.MaxDatagramSize
+	}
+	return size
+}
+
+// listenPacketOverStream tunnels udp over a tcp stream (UoT), for servers that reject native udp
+// or, with udp-over-tcp, in place of native udp
+func (h *Hysteria) listenPacketOverStream(hdc utils.PacketDialer, metadata *C.Metadata) (C.PacketConn, error) {
+	uotDestination := uot.RequestDestination(uint8(h.option.UDPOverStreamVersion))
+	tcpConn, err := h.client.DialTCP(uotDestination.Fqdn, uotDestination.Port, hdc)
+	if err != nil {
+		return nil, newHysteriaDialError(err)
+	}
+	destination := M.SocksaddrFromNet(metadata.UDPAddr())
+	var pc net.PacketConn
+	if h.option.UDPOverStreamVersion == uot.LegacyVersion {
+		pc = uot.NewConn(tcpConn, uot.Request{Destination: destination})
+	} else {
+		pc = uot.NewLazyConn(tcpConn, uot.Request{Destination: destination})
+	}
+	if h.option.MaxDatagramSize > 0 {
+		pc = &hyLimitPacketConn{PacketConn: pc, maxSize: h.option.MaxDatagramSize}
+	}
+	return newPacketConn(pc, h), nil
+}
+
+// SupportWithDialer implements C.ProxyAdapter
+func (h *Hysteria) SupportWithDialer() C.NetWork {
+	return C.ALLNet
+}
+
+// SupportUOT implements C.ProxyAdapter
+func (h *Hysteria) SupportUOT() bool {
+	return h.option.UDPOverStream || h.option.UDPOverTCP
+}
+
+// Capabilities adds UDP over TCP to Base.Capabilities when enabled
+func (h *Hysteria) Capabilities() C.Capabilities {
+	caps := h.Base.Capabilities()
+	if h.SupportUOT() {
+		caps |= C.CapUOT
+	}
+	return caps
+}
+
+// Ping returns the round trip time to the server without opening a tunnel, its stream takes
+// a slot of max-streams like any other
+func (h *Hysteria) Ping(ctx context.Context) (time.Duration, error) {
+	slot, err := h.acquireStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer slot.release()
+	rtt, err := h.client.Ping(ctx, h.genHdc(ctx, nil))
+	if err != nil {
+		return 0, newHysteriaDialError(err)
+	}
+	return rtt, nil
+}
+
+// Warmup performs the quic handshake ahead of the first dial, so it doesn't pay for it.
+// It's a no-op if a healthy connection already exists. When ctx is done first, the
+// handshake keeps going in the background and still serves later dials if it succeeds.
+func (h *Hysteria) Warmup(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.client.Connect(h.genHdc(contextutils.WithoutCancel(ctx), nil))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return newHysteriaDialError(err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetRates changes the up and down rates in bytes per second, the live connections
+// pick up the new send rate right away and later connections announce both
+func (h *Hysteria) SetRates(up, down uint64) {
+	h.client.SetRates(up, down)
+}
+
+// ServerInfo returns what the server announced on the latest connection: the protocol version,
+// its hello message and rates, the negotiated alpn, whether it takes datagrams and whether it
+// has turned down udp. It fails until a connection has been established. The connections of
+// DialWithoutObfs and of the WithDialer methods don't count.
+func (h *Hysteria) ServerInfo() (core.ServerInfo, error) {
+	info, ok := h.client.ServerInfo()
+	if !ok {
+		return core.ServerInfo{}, errors.New("not connected to the server yet")
+	}
+	return info, nil
+}
+
+type hyNoObfsKey struct{}
+
+// DialWithoutObfs is DialContext on a connection of its own that skips obfs, to tell whether
+// something on the path breaks the obfuscated traffic. The server must accept it unobfuscated
+func (h *Hysteria) DialWithoutObfs(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	return h.DialContext(context.WithValue(ctx, hyNoObfsKey{}, struct{}{}), metadata)
 }
 
-func (h *Hysteria) genHdc(ctx context.Context) utils.PacketDialer {
+// ActiveStreams returns the number of tcp and udp streams currently open to the server
+func (h *Hysteria) ActiveStreams() int {
+	return h.client.ActiveStreams()
+}
+
+// genHdc builds the packet dialer used when the client (re)connects. A nil cDialer dials with the
+// options of the adapter through dialer-proxy, for the shared connection. Any other cDialer, from
+// the WithDialer methods, is used as is and keys a connection of its own, the shared one was dialed
+// with something else.
+func (h *Hysteria) genHdc(ctx context.Context, cDialer C.Dialer) *hyDialerWithContext {
+	dedicated := cDialer != nil
 	return &hyDialerWithContext{
 		ctx: context.Background(),
 		hyDialer: func(network string, rAddr net.Addr) (net.PacketConn, error) {
 			var err error
-			var cDialer C.Dialer = dialer.NewDialer(h.DialOptions()...)
-			if len(h.option.DialerProxy) > 0 {
-				cDialer, err = proxydialer.NewByName(h.option.DialerProxy, cDialer)
-				if err != nil {
-					return nil, err
+			d := cDialer
+			if !dedicated {
+				d = dialer.NewDialer(h.DialOptions()...)
+				for _, proxyName := range h.option.DialerProxyChain() { // each hop is dialed through the previous one
+					d, err = proxydialer.NewByName(proxyName, d)
+					if err != nil {
+						return nil, err
+					}
 				}
 			}
 			rAddrPort, _ := netip.ParseAddrPort(rAddr.String())
-			return cDialer.ListenPacket(ctx, network, "", rAddrPort)
+			dialCtx, dialCancel := h.Base.dialContext(ctx)
+			defer dialCancel()
+			return d.ListenPacket(dialCtx, network, "", rAddrPort)
 		},
 		remoteAddr: func(addr string) (net.Addr, error) {
-			udpAddr, err := resolveUDPAddr(ctx, "udp", addr, h.prefer)
+			dialCtx, dialCancel := h.Base.dialContext(ctx) // bounds the resolve, bypassing the dns cache for resolve-every-dial
+			defer dialCancel()
+			udpAddr, err := h.resolveServerAddr(dialCtx, addr)
 			if err != nil {
 				return nil, err
 			}
+			h.lastResolvedIP.Store(udpAddr.AddrPort().Addr().Unmap())
 			err = h.echConfig.ClientHandle(ctx, h.tlsConfig)
 			if err != nil {
 				return nil, err
 			}
 			return udpAddr, nil
 		},
+		connected:    func() { markDialConnected(ctx) }, // the quic handshake and auth are done
+		noObfs:       ctx.Value(hyNoObfsKey{}) != nil,
+		dedicatedKey: cDialer,
 	}
 }
 
+func (h *Hysteria) resolveServerAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	if h.option.Ports == "" {
+		return resolveUDPAddr(ctx, "udp", addr, h.prefer)
+	}
+	if prefer, ok := h.hopPrefer.LoadOk(); ok {
+		if udpAddr, err := resolveUDPAddr(ctx, "udp", addr, prefer); err == nil {
+			return udpAddr, nil
+		}
+		// the pinned family is gone, fallback to the configured preference and pin again
+	}
+	udpAddr, err := resolveUDPAddr(ctx, "udp", addr, h.prefer)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.IP.To4() != nil {
+		h.hopPrefer.Store(C.IPv4Only)
+	} else {
+		h.hopPrefer.Store(C.IPv6Only)
+	}
+	return udpAddr, nil
+}
+
+// LastResolvedIP returns the server IP of the latest successful resolution, the one
+// the connection is dialed to, invalid until the first
+func (h *Hysteria) LastResolvedIP() netip.Addr {
+	return h.lastResolvedIP.Load()
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (h *Hysteria) ProxyInfo() C.ProxyInfo {
 	info := h.Base.ProxyInfo()
 	info.DialerProxy = h.option.DialerProxy
+	info.ECH = h.ECHState()
 	return info
 }
 
+// ECHAccepted reports whether the server accepted Encrypted Client Hello on the latest connection,
+// like ServerInfo, false when ech isn't configured, see ECHState to tell the cases apart
+func (h *Hysteria) ECHAccepted() bool {
+	return h.ECHState() == C.ECHAccepted
+}
+
+// ECHState returns the outcome of Encrypted Client Hello on the latest connection
+func (h *Hysteria) ECHState() C.ECHState {
+	if h.echConfig == nil {
+		return C.ECHNotConfigured
+	}
+	accepted, handshaked := h.client.ECHAccepted()
+	switch {
+	case !handshaked:
+		return C.ECHPending
+	case accepted:
+		return C.ECHAccepted
+	default:
+		return C.ECHRejected
+	}
+}
+
 type HysteriaOption struct {
 	BasicOption
-	Name                string     `proxy:"name"`
-	Server              string     `proxy:"server"`
-	Port                int        `proxy:"port,omitempty"`
-	Ports               string     `proxy:"ports,omitempty"`
-	Protocol            string     `proxy:"protocol,omitempty"`
-	ObfsProtocol        string     `proxy:"obfs-protocol,omitempty"` // compatible with Stash
-	Up                  string     `proxy:"up"`
-	UpSpeed             int        `proxy:"up-speed,omitempty"` // compatible with Stash
-	Down                string     `proxy:"down"`
-	DownSpeed           int        `proxy:"down-speed,omitempty"` // compatible with Stash
-	Auth                string     `proxy:"auth,omitempty"`
-	AuthString          string     `proxy:"auth-str,omitempty"`
-	Obfs                string     `proxy:"obfs,omitempty"`
-	SNI                 string     `proxy:"sni,omitempty"`
-	ECHOpts             ECHOptions `proxy:"ech-opts,omitempty"`
-	SkipCertVerify      bool       `proxy:"skip-cert-verify,omitempty"`
-	Fingerprint         string     `proxy:"fingerprint,omitempty"`
-	ALPN                []string   `proxy:"alpn,omitempty"`
-	CustomCA            string     `proxy:"ca,omitempty"`
-	CustomCAString      string     `proxy:"ca-str,omitempty"`
-	ReceiveWindowConn   int        `proxy:"recv-window-conn,omitempty"`
-	ReceiveWindow       int        `proxy:"recv-window,omitempty"`
-	DisableMTUDiscovery bool       `proxy:"disable-mtu-discovery,omitempty"`
-	FastOpen            bool       `proxy:"fast-open,omitempty"`
-	HopInterval         int        `proxy:"hop-interval,omitempty"`
+	Name                  string     `proxy:"name"`
+	Server                string     `proxy:"server"`
+	Port                  int        `proxy:"port,omitempty"`
+	Ports                 string     `proxy:"ports,omitempty"`
+	Protocol              string     `proxy:"protocol,omitempty"`
+	ObfsProtocol          string     `proxy:"obfs-protocol,omitempty"` // compatible with Stash
+	Up                    string     `proxy:"up"`
+	UpSpeed               int        `proxy:"up-speed,omitempty"` // compatible with Stash
+	Down                  string     `proxy:"down"`
+	DownSpeed             int        `proxy:"down-speed,omitempty"` // compatible with Stash
+	UpSpeedFloat          float64    `proxy:"up-mbps,omitempty"`
+	DownSpeedFloat        float64    `proxy:"down-mbps,omitempty"`
+	Auth                  string     `proxy:"auth,omitempty"`
+	AuthString            string     `proxy:"auth-str,omitempty"`
+	AuthFile              string     `proxy:"auth-file,omitempty"`
+	AuthFileBase64        bool       `proxy:"auth-file-base64,omitempty"`
+	Obfs                  string     `proxy:"obfs,omitempty"`
+	SNI                   string     `proxy:"sni,omitempty"`
+	ECHOpts               ECHOptions `proxy:"ech-opts,omitempty"`
+	SkipCertVerify        bool       `proxy:"skip-cert-verify,omitempty"`
+	Fingerprint           string     `proxy:"fingerprint,omitempty"`
+	ALPN                  []string   `proxy:"alpn,omitempty"`
+	CustomCA              string     `proxy:"ca,omitempty"`
+	CustomCAString        string     `proxy:"ca-str,omitempty"`
+	ReceiveWindowConn     int        `proxy:"recv-window-conn,omitempty"`
+	ReceiveWindow         int        `proxy:"recv-window,omitempty"`
+	DisableMTUDiscovery   *bool      `proxy:"disable-mtu-discovery,omitempty"`
+	FastOpen              bool       `proxy:"fast-open,omitempty"`
+	HopInterval           int        `proxy:"hop-interval,omitempty"`
+	WriteCoalesce         bool       `proxy:"write-coalesce,omitempty"`
+	WriteCoalesceSize     int        `proxy:"write-coalesce-size,omitempty"`
+	WriteCoalesceDelay    int        `proxy:"write-coalesce-delay,omitempty"`
+	DisableConnMigration  bool       `proxy:"disable-conn-migration,omitempty"`
+	IgnoreServerBandwidth bool       `proxy:"ignore-server-bandwidth,omitempty"`
+	EnableUDP             *bool      `proxy:"udp,omitempty"`
+	UDPOverStream         bool       `proxy:"udp-over-stream,omitempty"`
+	UDPOverStreamVersion  int        `proxy:"udp-over-stream-version,omitempty"`
+	UDPOverTCP            bool       `proxy:"udp-over-tcp,omitempty"`
+	ProxyProtocol         bool       `proxy:"proxy-protocol,omitempty"`
+	MaxDatagramSize       int        `proxy:"max-datagram-size,omitempty"`
+	PinSHA256             []string   `proxy:"pin-sha256,omitempty"`
+	ConnReuse             *bool      `proxy:"conn-reuse,omitempty"`
+	SNIList               []string   `proxy:"sni-list,omitempty"`
+	DialRetries           int        `proxy:"dial-retries,omitempty"`
+	MaxStreams            int        `proxy:"max-streams,omitempty"`
+	InitCwnd              int        `proxy:"init-cwnd,omitempty"`
+	QUICVersions          []string   `proxy:"quic-versions,omitempty"`
+	KeyLogFile            string     `proxy:"key-log-file,omitempty"`
+	ExpandEnv             bool       `proxy:"expand-env,omitempty"`
+	ExpandEnvStrict       bool       `proxy:"expand-env-strict,omitempty"`
+}
+
+// udpEnabled reports whether udp is relayed, true unless the udp option is explicitly false
+func (c *HysteriaOption) udpEnabled() bool {
+	return c.EnableUDP == nil || *c.EnableUDP
 }
 
+// Speed returns the upload and download bandwidth in bytes per second. For each direction
+// up-mbps wins over up-speed, which wins over up, and down likewise.
 func (c *HysteriaOption) Speed() (uint64, uint64, error) {
-	var up, down uint64
-	up = StringToBps(c.Up)
-	if up == 0 {
-		return 0, 0, fmt.Errorf("invaild upload speed: %s", c.Up)
+	up, err := hysteriaSpeed("upload", c.Up, c.UpSpeed, c.UpSpeedFloat)
+	if err != nil {
+		return 0, 0, err
+	}
+	down, err := hysteriaSpeed("download", c.Down, c.DownSpeed, c.DownSpeedFloat)
+	if err != nil {
+		return 0, 0, err
 	}
+	return up, down, nil
+}
 
-	down = StringToBps(c.Down)
-	if down == 0 {
-		return 0, 0, fmt.Errorf("invaild download speed: %s", c.Down)
+// hysteriaSpeed picks the first set of mbpsFloat, mbps and s and converts it to bytes per second,
+// a fractional Mbps is rounded to the nearest byte
+func hysteriaSpeed(direction string, s string, mbps int, mbpsFloat float64) (uint64, error) {
+	switch {
+	case mbpsFloat != 0:
+		bps := math.Round(mbpsFloat * mbpsToBps)
+		if math.IsNaN(bps) || bps < 1 || bps > math.MaxInt64 {
+			return 0, fmt.Errorf("invaild %s speed: %v Mbps", direction, mbpsFloat)
+		}
+		return uint64(bps), nil
+	case mbps != 0:
+		if mbps < 0 {
+			return 0, fmt.Errorf("invaild %s speed: %d Mbps", direction, mbps)
+		}
+		return uint64(mbps) * mbpsToBps, nil
+	}
+	bps := StringToBps(s)
+	if bps == 0 {
+		return 0, fmt.Errorf("invaild %s speed: %s", direction, s)
 	}
+	return bps, nil
+}
 
-	return up, down, nil
+// expandEnv replaces ${VAR} in auth, auth-str, server and obfs with the environment variable
+// when expand-env or expand-env-strict is set, $$ stands for a literal $
+func (c *HysteriaOption) expandEnv() (err error) {
+	if !c.ExpandEnv && !c.ExpandEnvStrict {
+		return nil
+	}
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"auth", &c.Auth},
+		{"auth-str", &c.AuthString},
+		{"server", &c.Server},
+		{"obfs", &c.Obfs},
+	}
+	for _, field := range fields {
+		if *field.value, err = expandHysteriaEnv(*field.value, c.ExpandEnvStrict); err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+	}
+	return nil
 }
 
+// expandHysteriaEnv expands ${VAR} and $$ in s, an unset variable expands to
+// nothing unless strict, any other $ is kept as is
+func expandHysteriaEnv(s string, strict bool) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			name := s[i+2 : i+2+end]
+			value, ok := os.LookupEnv(name)
+			if !ok && strict {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			b.WriteString(value)
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// Validate runs the checks of NewHysteria on the options alone, without reading
+// files or creating the client
+func (c *HysteriaOption) Validate() error {
+	if c.Ports != "" {
+		if _, err := udp.ParsePorts(c.Ports); err != nil {
+			return fmt.Errorf("invalid ports %s: %w", c.Ports, err)
+		}
+	}
+	if _, _, err := c.Speed(); err != nil {
+		return err
+	}
+	echConfig, err := c.ECHOpts.Parse()
+	if err != nil {
+		return err
+	}
+	if echConfig != nil && len(c.SNIList) > 0 {
+		// ECH already hides the SNI, and its config is resolved for the server name only
+		return errors.New("sni-list can't be used with ech-opts")
+	}
+	if _, err = ca.NewPinSHA256Verifier(c.PinSHA256); err != nil {
+		return err
+	}
+	if c.Auth != "" {
+		if _, err = base64.StdEncoding.DecodeString(c.Auth); err != nil {
+			return fmt.Errorf("invalid auth: %w", err)
+		}
+	}
+	switch c.UDPOverStreamVersion {
+	case 0, uot.Version, uot.LegacyVersion:
+	default:
+		return fmt.Errorf("unknown udp over stream protocol version: %d", c.UDPOverStreamVersion)
+	}
+	if c.DialRetries < 0 {
+		return fmt.Errorf("invalid dial-retries: %d", c.DialRetries)
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("invalid max-streams: %d", c.MaxStreams)
+	}
+	if c.DisableConnMigration && c.Ports == "" {
+		// it keeps the local socket on port hops, without hopping the client never migrates anyway
+		return errors.New("disable-conn-migration only applies to port hopping, set ports")
+	}
+	if c.InitCwnd < 0 || c.InitCwnd > hysteriaMaxInitCwnd {
+		return fmt.Errorf("invalid init-cwnd: %d, at most %d packets", c.InitCwnd, hysteriaMaxInitCwnd)
+	}
+	if _, err = parseQUICVersions(c.QUICVersions); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseQUICVersions maps the quic-versions option to quic versions in the order given,
+// nil keeps quic-go's default. Draft versions are gone from quic-go and rejected.
+func parseQUICVersions(versions []string) ([]quic.Version, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	parsed := make([]quic.Version, 0, len(versions))
+	for _, version := range versions {
+		switch strings.ToLower(strings.TrimSpace(version)) {
+		case "1", "v1":
+			parsed = append(parsed, quic.Version1)
+		case "2", "v2":
+			parsed = append(parsed, quic.Version2)
+		default:
+			return nil, fmt.Errorf("unknown quic version: %s, expected 1 or 2", version)
+		}
+	}
+	return parsed, nil
+}
+
+// hysteriaPlatformDisablePMTUD is the default of disable-mtu-discovery, true on
+// platforms where quic-go can't do Path MTU Discovery. A var so tests can flip it.
+var hysteriaPlatformDisablePMTUD = pmtud_fix.DisablePathMTUDiscovery
+
 func NewHysteria(option HysteriaOption) (*Hysteria, error) {
-	clientTransport := &transport.ClientTransport{}
+	clientTransport := &transport.ClientTransport{DisableMigration: option.DisableConnMigration}
+	if err := option.expandEnv(); err != nil {
+		return nil, fmt.Errorf("hysteria %s expand-env %w", option.Name, err)
+	}
 	addr := net.JoinHostPort(option.Server, strconv.Itoa(option.Port))
+	if err := option.Validate(); err != nil {
+		return nil, fmt.Errorf("hysteria %s %w", addr, err)
+	}
 	ports := option.Ports
 
 	serverName := option.Server
@@ -183,6 +879,20 @@ func NewHysteria(option HysteriaOption) (*Hysteria, error) {
 		return nil, err
 	}
 	tlsClientConfig := tlsC.UConfig(tlsConfig)
+	verifyPin, err := ca.NewPinSHA256Verifier(option.PinSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if verifyPin != nil {
+		// checked after chain verification (or instead of it with skip-cert-verify), so a renewed cert with the same key still passes
+		tlsClientConfig.VerifyConnection = func(state tlsC.ConnectionState) error {
+			return verifyPin(state.PeerCertificates)
+		}
+	}
+	if option.FastOpen {
+		// cache session tickets of this server, so later connections can send 0-RTT data
+		tlsClientConfig.ClientSessionCache = tlsC.NewLRUClientSessionCache(0)
+	}
 
 	quicConfig := &quic.Config{
 		InitialStreamReceiveWindow:     uint64(option.ReceiveWindowConn),
@@ -190,8 +900,11 @@ func NewHysteria(option HysteriaOption) (*Hysteria, error) {
 		InitialConnectionReceiveWindow: uint64(option.ReceiveWindow),
 		MaxConnectionReceiveWindow:     uint64(option.ReceiveWindow),
 		KeepAlivePeriod:                10 * time.Second,
-		DisablePathMTUDiscovery:        option.DisableMTUDiscovery,
-		EnableDatagrams:                true,
+		DisablePathMTUDiscovery:        hysteriaPlatformDisablePMTUD,
+		EnableDatagrams:                option.udpEnabled(),
+	}
+	if quicConfig.Versions, err = parseQUICVersions(option.QUICVersions); err != nil {
+		return nil, err
 	}
 	if option.ObfsProtocol != "" {
 		option.Protocol = option.ObfsProtocol
@@ -199,20 +912,32 @@ func NewHysteria(option HysteriaOption) (*Hysteria, error) {
 	if option.Protocol == "" {
 		option.Protocol = DefaultProtocol
 	}
-	if option.HopInterval == 0 {
-		option.HopInterval = DefaultHopInterval
+	if option.UDPOverStreamVersion == 0 {
+		option.UDPOverStreamVersion = uot.LegacyVersion
 	}
-	hopInterval := time.Duration(int64(option.HopInterval)) * time.Second
-	if option.ReceiveWindow == 0 {
-		quicConfig.InitialStreamReceiveWindow = DefaultStreamReceiveWindow / 10
-		quicConfig.MaxStreamReceiveWindow = DefaultStreamReceiveWindow
+	defaultStreamReceiveWindow, defaultConnectionReceiveWindow, hopInterval := hysteriaDefaults()
+	if option.HopInterval != 0 {
+		hopInterval = time.Duration(int64(option.HopInterval)) * time.Second
+	}
+	if option.WriteCoalesceSize <= 0 {
+		option.WriteCoalesceSize = DefaultWriteCoalesceSize
+	}
+	if option.WriteCoalesceDelay <= 0 {
+		option.WriteCoalesceDelay = DefaultWriteCoalesceDelay
+	}
+	if option.ReceiveWindowConn == 0 {
+		quicConfig.InitialStreamReceiveWindow = defaultStreamReceiveWindow / 10
+		quicConfig.MaxStreamReceiveWindow = defaultStreamReceiveWindow
 	}
 	if option.ReceiveWindow == 0 {
-		quicConfig.InitialConnectionReceiveWindow = DefaultConnectionReceiveWindow / 10
-		quicConfig.MaxConnectionReceiveWindow = DefaultConnectionReceiveWindow
+		quicConfig.InitialConnectionReceiveWindow = defaultConnectionReceiveWindow / 10
+		quicConfig.MaxConnectionReceiveWindow = defaultConnectionReceiveWindow
 	}
-	if !quicConfig.DisablePathMTUDiscovery && pmtud_fix.DisablePathMTUDiscovery {
-		log.Infoln("hysteria: Path MTU Discovery is not yet supported on this platform")
+	if option.DisableMTUDiscovery != nil { // an explicit choice wins over the platform default
+		quicConfig.DisablePathMTUDiscovery = *option.DisableMTUDiscovery
+		if !quicConfig.DisablePathMTUDiscovery && hysteriaPlatformDisablePMTUD {
+			log.Warnln("hysteria: Path MTU Discovery is not yet supported on this platform, enabled by disable-mtu-discovery: false")
+		}
 	}
 
 	var auth = []byte(option.AuthString)
@@ -222,6 +947,17 @@ func NewHysteria(option HysteriaOption) (*Hysteria, error) {
 			return nil, err
 		}
 	}
+	var authFile string
+	if option.AuthFile != "" {
+		authFile = C.Path.Resolve(option.AuthFile)
+		if !C.Path.IsSafePath(authFile) {
+			return nil, C.Path.ErrNotSafePath(authFile)
+		}
+		auth, err = readHysteriaAuthFile(authFile, option.AuthFileBase64)
+		if err != nil {
+			return nil, err
+		}
+	}
 	var obfuscator obfs.Obfuscator
 	if len(option.Obfs) > 0 {
 		obfuscator = obfs.NewXPlusObfuscator([]byte(option.Obfs))
@@ -231,73 +967,224 @@ func NewHysteria(option HysteriaOption) (*Hysteria, error) {
 	if err != nil {
 		return nil, err
 	}
-	if option.UpSpeed != 0 {
-		up = uint64(option.UpSpeed * mbpsToBps)
-	}
-	if option.DownSpeed != 0 {
-		down = uint64(option.DownSpeed * mbpsToBps)
-	}
 	client, err := core.NewClient(
 		addr, ports, option.Protocol, auth, tlsClientConfig, quicConfig, clientTransport, up, down, func(refBPS uint64) congestion.CongestionControl {
-			return hyCongestion.NewBrutalSender(congestion.ByteCount(refBPS))
+			return newHysteriaCongestion(refBPS, option.InitCwnd)
 		}, obfuscator, hopInterval, option.FastOpen,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("hysteria %s create error: %w", addr, err)
 	}
+	client.SetIgnoreServerBandwidth(option.IgnoreServerBandwidth)
+	client.SetConnReuse(option.ConnReuse == nil || *option.ConnReuse)
+	client.SetServerNames(option.SNIList)
 	outbound := &Hysteria{
 		Base: &Base{
 			name:   option.Name,
 			addr:   addr,
 			tp:     C.Hysteria,
-			udp:    true,
+			udp:    option.udpEnabled(),
 			tfo:    option.FastOpen,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
-		option:    &option,
-		client:    client,
-		tlsConfig: tlsClientConfig,
-		echConfig: echConfig,
+		option:     &option,
+		client:     client,
+		tlsConfig:  tlsClientConfig,
+		quicConfig: quicConfig,
+		echConfig:  echConfig,
+	}
+	if option.MaxStreams > 0 {
+		outbound.streamSlots = make(chan struct{}, option.MaxStreams)
+	}
+
+	if authFile != "" {
+		outbound.authWatcher, err = fswatch.NewWatcher(fswatch.Options{
+			Path:     []string{authFile},
+			Direct:   true,
+			Callback: outbound.reloadAuthFile,
+		})
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		if err = outbound.authWatcher.Start(); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	if option.KeyLogFile != "" {
+		if err = outbound.openKeyLog(option.KeyLogFile, tlsClientConfig); err != nil {
+			_ = outbound.Close()
+			return nil, fmt.Errorf("hysteria %s key-log-file: %w", addr, err)
+		}
 	}
 
 	return outbound, nil
 }
 
+// openKeyLog makes the handshakes with tlsConfig log their secrets to path, for decrypting
+// captured traffic, e.g. in Wireshark. It is refused unless hysteriaKeyLogEnv allows it.
+func (h *Hysteria) openKeyLog(path string, tlsConfig *tlsC.Config) error {
+	if allow, _ := strconv.ParseBool(os.Getenv(hysteriaKeyLogEnv)); !allow {
+		return fmt.Errorf("disabled, set the environment variable %s=1 to allow it", hysteriaKeyLogEnv)
+	}
+	path = C.Path.Resolve(path)
+	if !C.Path.IsSafePath(path) {
+		return C.Path.ErrNotSafePath(path)
+	}
+	keyLog, err := openHyKeyLog(path)
+	if err != nil {
+		return err
+	}
+	h.keyLog = keyLog
+	tlsConfig.KeyLogWriter = keyLog
+	log.Warnln("[Hysteria] %s writes its TLS secrets to %s, only use it for debugging", h.Name(), path)
+	return nil
+}
+
+func readHysteriaAuthFile(path string, isBase64 bool) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load auth file error: %w", err)
+	}
+	buf = bytes.TrimSpace(buf)
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("auth file %s is empty", path)
+	}
+	if isBase64 {
+		return base64.StdEncoding.DecodeString(string(buf))
+	}
+	return buf, nil
+}
+
+// reloadAuthFile updates the client's auth, the new one is used on the next connection to the server
+func (h *Hysteria) reloadAuthFile(path string) {
+	auth, err := readHysteriaAuthFile(path, h.option.AuthFileBase64)
+	if err != nil {
+		log.Warnln("[Hysteria] %s reload auth file error: %s", h.Name(), err.Error())
+		return
+	}
+	h.client.SetAuth(auth)
+	log.Infoln("[Hysteria] %s auth file reloaded", h.Name())
+}
+
 // Close implements C.ProxyAdapter
 func (h *Hysteria) Close() error {
+	if h.authWatcher != nil {
+		_ = h.authWatcher.Close()
+	}
+	if h.keyLog != nil {
+		_ = h.keyLog.Close()
+	}
 	if h.client != nil {
 		return h.client.Close()
 	}
 	return nil
 }
 
+// hyPacketConn reads through a single reader goroutine so a read deadline can
+// interrupt ReadFrom, core.UDPConn blocks until a message arrives or it is closed.
+// The reader goroutine exits once the conn is closed
 type hyPacketConn struct {
 	core.UDPConn
+	maxSize int
+
+	readOnce     sync.Once
+	readCh       chan hyReadResult
+	readDeadline deadline.PipeDeadline
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+type hyReadResult struct {
+	data []byte
+	addr string
+	err  error
+}
+
+func newHyPacketConn(udpConn core.UDPConn, maxSize int) *hyPacketConn {
+	return &hyPacketConn{
+		UDPConn:      udpConn,
+		maxSize:      maxSize,
+		readCh:       make(chan hyReadResult),
+		readDeadline: deadline.MakePipeDeadline(),
+		done:         make(chan struct{}),
+	}
+}
+
+func (c *hyPacketConn) readLoop() {
+	for {
+		data, addr, err := c.UDPConn.ReadFrom()
+		select {
+		case c.readCh <- hyReadResult{data: data, addr: addr, err: err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *hyPacketConn) read() ([]byte, net.Addr, error) {
+	c.readOnce.Do(func() { go c.readLoop() })
+	select {
+	case result := <-c.readCh:
+		if result.err != nil {
+			return nil, nil, result.err
+		}
+		return result.data, M.ParseSocksaddr(result.addr).UDPAddr(), nil
+	case <-c.readDeadline.Wait():
+		return nil, nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return nil, nil, net.ErrClosed
+	}
 }
 
 func (c *hyPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	b, addrStr, err := c.UDPConn.ReadFrom()
+	b, addr, err := c.read()
 	if err != nil {
 		return
 	}
 	n = copy(p, b)
-	addr = M.ParseSocksaddr(addrStr).UDPAddr()
 	return
 }
 
 func (c *hyPacketConn) WaitReadFrom() (data []byte, put func(), addr net.Addr, err error) {
-	b, addrStr, err := c.UDPConn.ReadFrom()
-	if err != nil {
-		return
-	}
-	data = b
-	addr = M.ParseSocksaddr(addrStr).UDPAddr()
+	data, addr, err = c.read()
 	return
 }
 
+// SetReadDeadline is not passed down, the read deadline of the underlying
+// stream would end the session instead of a single read
+func (c *hyPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *hyPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return c.UDPConn.SetWriteDeadline(t)
+}
+
+func (c *hyPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.UDPConn.Close()
+}
+
 func (c *hyPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if err = checkHyDatagramSize(p, c.maxSize); err != nil {
+		return
+	}
 	err = c.UDPConn.WriteTo(p, M.SocksaddrFromNet(addr).String())
 	if err != nil {
 		return
@@ -306,10 +1193,137 @@ func (c *hyPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return
 }
 
+// hyLimitPacketConn applies max-datagram-size to the UoT packet conns
+type hyLimitPacketConn struct {
+	net.PacketConn
+	maxSize int
+}
+
+func (c *hyLimitPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if err = checkHyDatagramSize(p, c.maxSize); err != nil {
+		return
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *hyLimitPacketConn) Upstream() any {
+	return c.PacketConn
+}
+
+// checkHyDatagramSize rejects payloads over max-datagram-size, 0 leaves the limit to the connection
+func checkHyDatagramSize(p []byte, maxSize int) error {
+	if maxSize > 0 && len(p) > maxSize {
+		return fmt.Errorf("%w: %d bytes exceeds max datagram size %d", core.ErrDatagramTooLarge, len(p), maxSize)
+	}
+	return nil
+}
+
+// hyCoalesceConn batches small writes into a single stream write, flushing when
+// the buffer reaches size, when delay has elapsed since the first buffered byte,
+// or before Read/CloseWrite/Close. It trades up to delay of extra latency per write
+// for fewer QUIC frames, which helps apps writing char-by-char (e.g. interactive shells).
+type hyCoalesceConn struct {
+	net.Conn
+	size  int
+	delay time.Duration
+
+	access sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+	err    error
+}
+
+func newHyCoalesceConn(conn net.Conn, size int, delay time.Duration) *hyCoalesceConn {
+	return &hyCoalesceConn{
+		Conn:  conn,
+		size:  size,
+		delay: delay,
+		buf:   make([]byte, 0, size),
+	}
+}
+
+func (c *hyCoalesceConn) Write(b []byte) (n int, err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf)+len(b) > c.size {
+		if err = c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(b) >= c.size { // large write, no need to buffer it
+			return c.Conn.Write(b)
+		}
+	}
+	c.buf = append(c.buf, b...)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.flushTimer)
+	} else if len(c.buf) == len(b) { // first bytes after a flush
+		c.timer.Reset(c.delay)
+	}
+	return len(b), nil
+}
+
+func (c *hyCoalesceConn) flushTimer() {
+	c.access.Lock()
+	defer c.access.Unlock()
+	_ = c.flushLocked()
+}
+
+func (c *hyCoalesceConn) flushLocked() error {
+	if len(c.buf) == 0 {
+		return c.err
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	_, err := c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+func (c *hyCoalesceConn) Flush() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.flushLocked()
+}
+
+func (c *hyCoalesceConn) Read(b []byte) (n int, err error) {
+	if err = c.Flush(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *hyCoalesceConn) CloseWrite() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+func (c *hyCoalesceConn) Close() error {
+	_ = c.Flush()
+	return c.Conn.Close()
+}
+
 type hyDialerWithContext struct {
 	hyDialer   func(network string, rAddr net.Addr) (net.PacketConn, error)
 	ctx        context.Context
 	remoteAddr func(host string) (net.Addr, error)
+	connected  func()
+	noObfs     bool
+
+	dedicatedKey any // the upstream dialer of the WithDialer methods
+
+	streamClosed func() // told once the stream of the dial is closed
 }
 
 func (h *hyDialerWithContext) ListenPacket(rAddr net.Addr) (net.PacketConn, error) {
@@ -327,3 +1341,53 @@ func (h *hyDialerWithContext) Context() context.Context {
 func (h *hyDialerWithContext) RemoteAddr(host string) (net.Addr, error) {
 	return h.remoteAddr(host)
 }
+
+// ObfsOverride implements core.ObfsOverride
+func (h *hyDialerWithContext) ObfsOverride() (obfs.Obfuscator, bool) {
+	return nil, h.noObfs
+}
+
+// DedicatedKey implements core.DedicatedConn
+func (h *hyDialerWithContext) DedicatedKey() any {
+	return h.dedicatedKey
+}
+
+// Connected implements core.ConnectObserver
+func (h *hyDialerWithContext) Connected() {
+	if h.connected != nil {
+		h.connected()
+	}
+}
+
+// StreamClosed implements core.StreamObserver
+func (h *hyDialerWithContext) StreamClosed() {
+	if h.streamClosed != nil {
+		h.streamClosed()
+	}
+}
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV2Header builds a PROXY protocol v2 header carrying the client
+// address of metadata, a LOCAL header when either address isn't a known ip
+func proxyProtocolV2Header(metadata *C.Metadata) []byte {
+	src, dst := metadata.SourceAddrPort(), metadata.AddrPort()
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	if !src.Addr().IsValid() || !dst.Addr().IsValid() {
+		return append(header, 0x20, 0x00, 0x00, 0x00) // v2 LOCAL, UNSPEC, no addresses
+	}
+	srcAddr, dstAddr := src.Addr(), dst.Addr()
+	if srcAddr.Is4() && dstAddr.Is4() {
+		header = append(header, 0x21, 0x11, 0x00, 12) // v2 PROXY, TCP over IPv4
+		header = append(header, srcAddr.AsSlice()...)
+		header = append(header, dstAddr.AsSlice()...)
+	} else { // mixed families are carried as IPv4-mapped IPv6
+		srcBytes, dstBytes := srcAddr.As16(), dstAddr.As16()
+		header = append(header, 0x21, 0x21, 0x00, 36) // v2 PROXY, TCP over IPv6
+		header = append(header, srcBytes[:]...)
+		header = append(header, dstBytes[:]...)
+	}
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	header = binary.BigEndian.AppendUint16(header, dst.Port())
+	return header
+}
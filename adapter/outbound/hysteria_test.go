@@ -0,0 +1,2184 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/component/ca"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/ech"
+	"github.com/metacubex/mihomo/component/resolver"
+	tlsC "github.com/metacubex/mihomo/component/tls"
+	"github.com/metacubex/mihomo/component/trie"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/transport/hysteria/core"
+	"github.com/metacubex/mihomo/tunnel"
+
+	"github.com/lunixbochs/struc"
+	"github.com/metacubex/quic-go"
+	"github.com/metacubex/quic-go/congestion"
+	"github.com/metacubex/sing/common/uot"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyHysteriaError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		kind HysteriaDialErrorKind
+	}{
+		{fmt.Errorf("%w: wrong password", core.ErrAuth), HysteriaDialErrorAuth},
+		{context.DeadlineExceeded, HysteriaDialErrorTimeout},
+		{os.ErrDeadlineExceeded, HysteriaDialErrorTimeout},
+		{&quic.IdleTimeoutError{}, HysteriaDialErrorTimeout},
+		{&quic.HandshakeTimeoutError{}, HysteriaDialErrorTimeout},
+		{&quic.TransportError{ErrorCode: 0x100 + 42}, HysteriaDialErrorTLS},
+		{x509.UnknownAuthorityError{}, HysteriaDialErrorTLS},
+		{&quic.TransportError{ErrorCode: quic.ConnectionRefused}, HysteriaDialErrorNetwork},
+		{errors.New("connection refused"), HysteriaDialErrorNetwork},
+	}
+	for _, testCase := range testCases {
+		err := newHysteriaDialError(fmt.Errorf("wrapped: %w", testCase.err))
+		var dialErr *HysteriaDialError
+		require.ErrorAs(t, err, &dialErr)
+		assert.Equal(t, testCase.kind, dialErr.Kind, testCase.err.Error())
+		assert.ErrorIs(t, err, testCase.err)
+	}
+	assert.NoError(t, newHysteriaDialError(nil))
+}
+
+func TestHysteriaDialError(t *testing.T) {
+	h, err := NewHysteria(HysteriaOption{
+		Name:   "test",
+		Server: "127.0.0.1",
+		Port:   10000,
+		Up:     "10",
+		Down:   "10",
+	})
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	metadata := &C.Metadata{Host: "example.com", DstPort: 443}
+	_, err = h.DialContext(context.Background(), metadata)
+	var dialErr *HysteriaDialError
+	require.ErrorAs(t, err, &dialErr)
+	assert.Equal(t, HysteriaDialErrorNetwork, dialErr.Kind)
+	assert.ErrorIs(t, err, core.ErrClosed)
+
+	metadata = &C.Metadata{DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: 53}
+	_, err = h.ListenPacketContext(context.Background(), metadata)
+	require.ErrorAs(t, err, &dialErr)
+	assert.ErrorIs(t, err, core.ErrClosed)
+}
+
+type recordWriteConn struct {
+	net.Conn
+	access sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordWriteConn) Write(b []byte) (int, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *recordWriteConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *recordWriteConn) Writes() [][]byte {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.writes
+}
+
+func TestHyCoalesceConn(t *testing.T) {
+	record := &recordWriteConn{}
+	conn := newHyCoalesceConn(record, 8, time.Hour)
+	for _, b := range []byte("hello") {
+		_, err := conn.Write([]byte{b})
+		require.NoError(t, err)
+	}
+	assert.Empty(t, record.Writes())
+
+	// exceed size, buffered bytes go out as one write
+	_, err := conn.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello")}, record.Writes())
+
+	// read flushes pending bytes
+	_, _ = conn.Read(make([]byte, 1))
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, record.Writes())
+
+	// large writes bypass the buffer
+	_, err = conn.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789"), record.Writes()[2])
+
+	_, err = conn.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	assert.Len(t, record.Writes(), 4)
+}
+
+func TestHyCoalesceConnDelay(t *testing.T) {
+	record := &recordWriteConn{}
+	conn := newHyCoalesceConn(record, 1024, 10*time.Millisecond)
+	for _, b := range []byte("abc") {
+		_, err := conn.Write([]byte{b})
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return len(record.Writes()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []byte("abc"), record.Writes()[0])
+}
+
+func TestHysteriaDisableConnMigration(t *testing.T) {
+	SetDefaultHopInterval(20 * time.Millisecond)
+	t.Cleanup(func() { SetDefaultHopInterval(DefaultHopInterval * time.Second) })
+	metadata := startTestTCPEcho(t)
+	port := startTestHysteriaServer(t)
+
+	for _, disable := range []bool{false, true} {
+		h, err := NewHysteria(HysteriaOption{
+			Name:                 "test",
+			Server:               "127.0.0.1",
+			Ports:                fmt.Sprintf("%d,%d", port, port),
+			Up:                   "10",
+			Down:                 "10",
+			SkipCertVerify:       true,
+			DisableConnMigration: disable,
+		})
+		require.NoError(t, err)
+		stub := &testCountingDialer{Dialer: dialer.NewDialer()}
+		c, err := h.DialContextWithDialer(context.Background(), stub, metadata)
+		require.NoError(t, err)
+		time.Sleep(150 * time.Millisecond) // several hops
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		if disable {
+			assert.Equal(t, int32(1), stub.listens.Load()) // hops kept the socket
+		} else {
+			assert.Greater(t, stub.listens.Load(), int32(1)) // every hop listens anew
+		}
+		_ = c.Close()
+		_ = h.Close()
+	}
+}
+
+func TestHysteriaDisableMTUDiscovery(t *testing.T) {
+	old := hysteriaPlatformDisablePMTUD
+	defer func() { hysteriaPlatformDisablePMTUD = old }()
+
+	f, tr := false, true
+	for _, tt := range []struct {
+		name     string
+		platform bool
+		option   *bool
+		want     bool
+	}{
+		{name: "supported default", platform: false, option: nil, want: false},
+		{name: "unsupported default", platform: true, option: nil, want: true},
+		{name: "explicit disable", platform: false, option: &tr, want: true},
+		{name: "explicit enable", platform: true, option: &f, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hysteriaPlatformDisablePMTUD = tt.platform
+			h, err := NewHysteria(HysteriaOption{
+				Name:                "test",
+				Server:              "127.0.0.1",
+				Port:                10000,
+				Up:                  "10",
+				Down:                "10",
+				DisableMTUDiscovery: tt.option,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h.quicConfig.DisablePathMTUDiscovery)
+			_ = h.Close()
+		})
+	}
+}
+
+func TestHysteriaAuthFile(t *testing.T) {
+	oldHome := C.Path.HomeDir()
+	defer C.SetHomeDir(oldHome)
+	dir := t.TempDir()
+	C.SetHomeDir(dir)
+
+	newHysteria := func(authFile string, isBase64 bool) (*Hysteria, error) {
+		return NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           10000,
+			Up:             "10",
+			Down:           "10",
+			AuthString:     "ignored",
+			AuthFile:       authFile,
+			AuthFileBase64: isBase64,
+		})
+	}
+
+	_, err := newHysteria("missing", false)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), []byte("\n"), 0o644))
+	_, err = newHysteria("empty", false)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b64"), []byte(base64.StdEncoding.EncodeToString([]byte("secret"))+"\n"), 0o644))
+	h, err := newHysteria("b64", true)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), h.client.Auth())
+	_ = h.Close()
+
+	path := filepath.Join(dir, "raw")
+	require.NoError(t, os.WriteFile(path, []byte("token1\n"), 0o644))
+	h, err = newHysteria("raw", false)
+	require.NoError(t, err)
+	defer h.Close()
+	assert.Equal(t, []byte("token1"), h.client.Auth())
+
+	require.NoError(t, os.WriteFile(path, []byte("token2\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return bytes.Equal([]byte("token2"), h.client.Auth())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHysteriaLastResolvedIP(t *testing.T) {
+	oldHosts := resolver.DefaultHosts
+	defer func() { resolver.DefaultHosts = oldHosts }()
+	tree := trie.New[resolver.HostValue]()
+	value, err := resolver.NewHostValueByIPs([]netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert("resolve.hysteria.test", value))
+	resolver.DefaultHosts = resolver.NewHosts(tree)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(targetAddr.Port)}
+
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "resolve.hysteria.test",
+		Port:           startTestHysteriaServer(t),
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	assert.False(t, h.LastResolvedIP().IsValid())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h.DialContext(ctx, metadata)
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), h.LastResolvedIP())
+}
+
+func TestHysteriaResolveEveryDial(t *testing.T) {
+	oldResolver, oldFloor := resolver.ProxyServerHostResolver, resolveEveryDialFloor
+	defer func() { resolver.ProxyServerHostResolver, resolveEveryDialFloor = oldResolver, oldFloor }()
+	resolveEveryDialFloor = 0
+	resolves := func(resolveEveryDial bool) int32 {
+		r := &testCacheResolver{}
+		resolver.ProxyServerHostResolver = r
+		h, err := NewHysteria(HysteriaOption{
+			BasicOption: BasicOption{ResolveEveryDial: resolveEveryDial},
+			Name:        "test",
+			Server:      "cdn.example.com",
+			Port:        443,
+			Up:          "10",
+			Down:        "10",
+		})
+		require.NoError(t, err)
+		defer h.Close()
+		for i := 0; i < 3; i++ {
+			addr, err := h.genHdc(context.Background(), nil).RemoteAddr("cdn.example.com:443")
+			require.NoError(t, err)
+			assert.Equal(t, "1.2.3.4:443", addr.String())
+		}
+		return r.lookups.Load()
+	}
+	assert.Equal(t, int32(1), resolves(false))
+	assert.Equal(t, int32(3), resolves(true))
+}
+
+func TestHysteriaHopStickyFamily(t *testing.T) {
+	oldHosts, oldDisableIPv6 := resolver.DefaultHosts, resolver.DisableIPv6
+	defer func() {
+		resolver.DefaultHosts, resolver.DisableIPv6 = oldHosts, oldDisableIPv6
+	}()
+	resolver.DisableIPv6 = false
+	setHosts := func(ips ...string) {
+		tree := trie.New[resolver.HostValue]()
+		var addrs []netip.Addr
+		for _, ip := range ips {
+			addrs = append(addrs, netip.MustParseAddr(ip))
+		}
+		value, err := resolver.NewHostValueByIPs(addrs)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert("dual.hysteria.test", value))
+		resolver.DefaultHosts = resolver.NewHosts(tree)
+	}
+
+	option := HysteriaOption{
+		Name:   "test",
+		Server: "dual.hysteria.test",
+		Port:   10000,
+		Ports:  "10000-10010",
+		Up:     "10",
+		Down:   "10",
+	}
+	h, err := NewHysteria(option)
+	require.NoError(t, err)
+	defer h.Close()
+	option.Ports = ""
+	noHop, err := NewHysteria(option)
+	require.NoError(t, err)
+	defer noHop.Close()
+
+	ctx := context.Background()
+	setHosts("2001:db8::1")
+	udpAddr, err := h.resolveServerAddr(ctx, h.addr)
+	require.NoError(t, err)
+	assert.Nil(t, udpAddr.IP.To4())
+
+	// now the host is dual-stack, and IPv4 is preferred by default
+	setHosts("192.0.2.1", "2001:db8::1")
+	udpAddr, err = noHop.resolveServerAddr(ctx, noHop.addr)
+	require.NoError(t, err)
+	assert.NotNil(t, udpAddr.IP.To4())
+	for i := 0; i < 3; i++ {
+		udpAddr, err = h.resolveServerAddr(ctx, h.addr)
+		require.NoError(t, err)
+		assert.Equal(t, "2001:db8::1", udpAddr.IP.String())
+	}
+
+	// the pinned family is gone
+	setHosts("192.0.2.1")
+	resolver.DisableIPv6 = true
+	udpAddr, err = h.resolveServerAddr(ctx, h.addr)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", udpAddr.IP.String())
+	prefer, _ := h.hopPrefer.LoadOk()
+	assert.Equal(t, C.IPv4Only, prefer)
+}
+
+func TestHysteriaPackageDefaults(t *testing.T) {
+	SetDefaultStreamReceiveWindow(1 << 20)
+	SetDefaultConnectionReceiveWindow(4 << 20)
+	SetDefaultHopInterval(30 * time.Second)
+	t.Cleanup(func() {
+		SetDefaultStreamReceiveWindow(DefaultStreamReceiveWindow)
+		SetDefaultConnectionReceiveWindow(DefaultConnectionReceiveWindow)
+		SetDefaultHopInterval(DefaultHopInterval * time.Second)
+	})
+
+	option := HysteriaOption{
+		Name:   "test",
+		Server: "127.0.0.1",
+		Port:   10000,
+		Up:     "10",
+		Down:   "10",
+	}
+	h, err := NewHysteria(option)
+	require.NoError(t, err)
+	defer h.Close()
+	assert.EqualValues(t, 1<<20, h.quicConfig.MaxStreamReceiveWindow)
+	assert.EqualValues(t, 4<<20, h.quicConfig.MaxConnectionReceiveWindow)
+	assert.Equal(t, 30*time.Second, h.client.HopInterval())
+
+	option.HopInterval = 5
+	explicit, err := NewHysteria(option)
+	require.NoError(t, err)
+	defer explicit.Close()
+	assert.Equal(t, 5*time.Second, explicit.client.HopInterval())
+}
+
+func TestHysteriaReceiveWindow(t *testing.T) {
+	for _, tt := range []struct {
+		receiveWindowConn int
+		receiveWindow     int
+		stream            uint64
+		connection        uint64
+	}{
+		{0, 0, DefaultStreamReceiveWindow, DefaultConnectionReceiveWindow},
+		{1 << 20, 0, 1 << 20, DefaultConnectionReceiveWindow},
+		{0, 4 << 20, DefaultStreamReceiveWindow, 4 << 20},
+		{1 << 20, 4 << 20, 1 << 20, 4 << 20},
+	} {
+		t.Run(fmt.Sprintf("conn=%d,recv=%d", tt.receiveWindowConn, tt.receiveWindow), func(t *testing.T) {
+			h, err := NewHysteria(HysteriaOption{
+				Name:              "test",
+				Server:            "127.0.0.1",
+				Port:              10000,
+				Up:                "10",
+				Down:              "10",
+				ReceiveWindowConn: tt.receiveWindowConn,
+				ReceiveWindow:     tt.receiveWindow,
+			})
+			require.NoError(t, err)
+			defer h.Close()
+			assert.Equal(t, tt.stream, h.quicConfig.MaxStreamReceiveWindow)
+			assert.Equal(t, tt.connection, h.quicConfig.MaxConnectionReceiveWindow)
+			if tt.receiveWindowConn == 0 {
+				assert.Equal(t, tt.stream/10, h.quicConfig.InitialStreamReceiveWindow)
+			} else {
+				assert.Equal(t, tt.stream, h.quicConfig.InitialStreamReceiveWindow)
+			}
+			if tt.receiveWindow == 0 {
+				assert.Equal(t, tt.connection/10, h.quicConfig.InitialConnectionReceiveWindow)
+			} else {
+				assert.Equal(t, tt.connection, h.quicConfig.InitialConnectionReceiveWindow)
+			}
+		})
+	}
+}
+
+// mirrors of the hysteria wire structs for the test server below
+type testHyRate struct {
+	SendBPS uint64
+	RecvBPS uint64
+}
+
+type testHyClientHello struct {
+	Rate    testHyRate
+	AuthLen uint16 `struc:"sizeof=Auth"`
+	Auth    []byte
+}
+
+type testHyServerHello struct {
+	OK         bool
+	Rate       testHyRate
+	MessageLen uint16 `struc:"sizeof=Message"`
+	Message    string
+}
+
+type testHyClientRequest struct {
+	UDP     bool
+	HostLen uint16 `struc:"sizeof=Host"`
+	Host    string
+	Port    uint16
+}
+
+type testHyServerResponse struct {
+	OK           bool
+	UDPSessionID uint32
+	MessageLen   uint16 `struc:"sizeof=Message"`
+	Message      string
+}
+
+type testHyStreamConn struct {
+	quic.Stream
+	qs quic.Connection
+}
+
+func (c *testHyStreamConn) LocalAddr() net.Addr  { return c.qs.LocalAddr() }
+func (c *testHyStreamConn) RemoteAddr() net.Addr { return c.qs.RemoteAddr() }
+
+// startTestHysteriaServer runs a hysteria server which rejects native udp,
+// relays tcp streams and relays UoT streams to the real udp destination
+// startTestTCPEcho starts a tcp server echoing what it reads and returns the metadata to dial it
+func startTestTCPEcho(t *testing.T) *C.Metadata {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(target.Addr().(*net.TCPAddr).Port)}
+}
+
+func startTestHysteriaServer(t *testing.T) int {
+	port, _ := startTestHysteriaServerWithCert(t)
+	return port
+}
+
+// startTestHysteriaServerWithCert is startTestHysteriaServer also returning the server's leaf certificate
+func startTestHysteriaServerWithCert(t *testing.T) (int, *x509.Certificate) {
+	return startTestHysteriaServerWithTLS(t, nil)
+}
+
+// startTestHysteriaServerWithTLS is startTestHysteriaServerWithCert letting setup adjust the server tls config
+func startTestHysteriaServerWithTLS(t *testing.T, setup func(*tlsC.Config)) (int, *x509.Certificate) {
+	certificate, privateKey, _, err := ca.NewRandomTLSKeyPair(ca.KeyPairTypeP256)
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair([]byte(certificate), []byte(privateKey))
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	tlsConfig := &tlsC.Config{
+		Certificates: []tlsC.Certificate{tlsC.UCertificate(cert)},
+		NextProtos:   []string{DefaultALPN},
+	}
+	if setup != nil {
+		setup(tlsConfig)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, &quic.Config{EnableDatagrams: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	handleStream := func(stream net.Conn) {
+		defer stream.Close()
+		var req testHyClientRequest
+		if err := struc.Unpack(stream, &req); err != nil {
+			return
+		}
+		if req.UDP {
+			_ = struc.Pack(stream, &testHyServerResponse{Message: "udp disabled"})
+			return
+		}
+		if req.Host != uot.MagicAddress && req.Host != uot.LegacyMagicAddress {
+			target, err := net.Dial("tcp", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+			if err != nil {
+				_ = struc.Pack(stream, &testHyServerResponse{Message: err.Error()})
+				return
+			}
+			defer target.Close()
+			if err := struc.Pack(stream, &testHyServerResponse{OK: true}); err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(target, stream) }()
+			_, _ = io.Copy(stream, target)
+			return
+		}
+		if err := struc.Pack(stream, &testHyServerResponse{OK: true}); err != nil {
+			return
+		}
+		var request uot.Request
+		if req.Host == uot.MagicAddress {
+			r, err := uot.ReadRequest(stream)
+			if err != nil {
+				return
+			}
+			request = *r
+		}
+		uotConn := uot.NewConn(stream, request)
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return
+		}
+		defer udpConn.Close()
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, addr, err := udpConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = uotConn.WriteTo(buf[:n], addr)
+			}
+		}()
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := uotConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteTo(buf[:n], addr)
+		}
+	}
+
+	go func() {
+		for {
+			qs, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := qs.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				version := make([]byte, 1)
+				var ch testHyClientHello
+				if _, err = io.ReadFull(stream, version); err != nil {
+					return
+				}
+				if err = struc.Unpack(stream, &ch); err != nil {
+					return
+				}
+				if err = struc.Pack(stream, &testHyServerHello{OK: true, Rate: testHyRate(ch.Rate)}); err != nil {
+					return
+				}
+				for {
+					stream, err := qs.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go handleStream(&testHyStreamConn{Stream: stream, qs: qs})
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.UDPAddr).Port, leaf
+}
+
+func TestHysteriaUDPOverStream(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	metadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(echoAddr.Port)}
+	port := startTestHysteriaServer(t)
+
+	for _, version := range []int{uot.LegacyVersion, uot.Version} {
+		option := HysteriaOption{
+			Name:                 "test",
+			Server:               "127.0.0.1",
+			Port:                 port,
+			Up:                   "10",
+			Down:                 "10",
+			SkipCertVerify:       true,
+			UDPOverStreamVersion: version,
+		}
+		native, err := NewHysteria(option)
+		require.NoError(t, err)
+		assert.False(t, native.SupportUOT())
+		_, err = native.ListenPacketContext(context.Background(), metadata)
+		assert.ErrorIs(t, err, core.ErrUDPRejected)
+		_ = native.Close()
+
+		option.UDPOverStream = true
+		h, err := NewHysteria(option)
+		require.NoError(t, err)
+		assert.True(t, h.SupportUOT())
+		pc, err := h.ListenPacketContext(context.Background(), metadata)
+		require.NoError(t, err)
+		_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, payload := range []string{"hello", "world"} {
+			_, err = pc.WriteTo([]byte(payload), echoAddr)
+			require.NoError(t, err)
+			buf := make([]byte, 64)
+			n, addr, err := pc.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, payload, string(buf[:n]))
+			assert.Equal(t, echoAddr.Port, addr.(*net.UDPAddr).Port)
+		}
+		_ = pc.Close()
+		_ = h.Close()
+	}
+}
+
+func TestHysteriaUDPOverTCP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	metadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(echoAddr.Port)}
+	port := startTestHysteriaServer(t)
+
+	for _, version := range []int{uot.LegacyVersion, uot.Version} {
+		// without udp-over-stream a native attempt would fail on this server,
+		// so a working conn means the datagrams went through UoT framing
+		h, err := NewHysteria(HysteriaOption{
+			Name:                 "test",
+			Server:               "127.0.0.1",
+			Port:                 port,
+			Up:                   "10",
+			Down:                 "10",
+			SkipCertVerify:       true,
+			UDPOverTCP:           true,
+			UDPOverStreamVersion: version,
+		})
+		require.NoError(t, err)
+		assert.True(t, h.SupportUOT())
+		pc, err := h.ListenPacketContext(context.Background(), metadata)
+		require.NoError(t, err)
+		_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = pc.WriteTo([]byte("datagram"), echoAddr)
+		require.NoError(t, err)
+		buf := make([]byte, 64)
+		n, addr, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "datagram", string(buf[:n]))
+		assert.Equal(t, echoAddr.Port, addr.(*net.UDPAddr).Port)
+		_ = pc.Close()
+		_ = h.Close()
+	}
+}
+
+// testCountingDialer records the packet conns hysteria opens through it
+type testCountingDialer struct {
+	C.Dialer
+	listens atomic.Int32
+	written atomic.Int64
+}
+
+func (d *testCountingDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	pc, err := d.Dialer.ListenPacket(ctx, network, address, rAddrPort)
+	if err != nil {
+		return nil, err
+	}
+	d.listens.Add(1)
+	return &testCountingPacketConn{PacketConn: pc, written: &d.written}, nil
+}
+
+type testCountingPacketConn struct {
+	net.PacketConn
+	written *atomic.Int64
+}
+
+func (c *testCountingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestHysteriaWithDialer(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	metadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(echoAddr.Port)}
+	port := startTestHysteriaServer(t)
+
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+		UDPOverStream:  true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	assert.Equal(t, C.ALLNet, h.SupportWithDialer())
+
+	stub := &testCountingDialer{Dialer: dialer.NewDialer()}
+	pc, err := h.ListenPacketWithDialer(context.Background(), stub, metadata)
+	require.NoError(t, err)
+	defer pc.Close()
+	// the rejected native udp session and the UoT stream share the connection of the dialer
+	assert.Equal(t, int32(1), stub.listens.Load())
+
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	before := stub.written.Load()
+	_, err = pc.WriteTo([]byte("hello"), echoAddr)
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Greater(t, stub.written.Load(), before)
+
+	// later dials through the same dialer multiplex over its connection, another dialer gets its own
+	tcpMetadata := startTestTCPEcho(t)
+	conn, err := h.DialContextWithDialer(context.Background(), stub, tcpMetadata)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, int32(1), stub.listens.Load())
+	other := &testCountingDialer{Dialer: dialer.NewDialer()}
+	otherConn, err := h.DialContextWithDialer(context.Background(), other, tcpMetadata)
+	require.NoError(t, err)
+	defer otherConn.Close()
+	assert.Equal(t, int32(1), other.listens.Load())
+	assert.Equal(t, int32(1), stub.listens.Load())
+
+	// closing the adapter closes the connections of the dialers too
+	require.NoError(t, h.Close())
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(buf)
+	assert.Error(t, err)
+}
+
+func TestHysteriaWithDialerAfterSharedConn(t *testing.T) {
+	metadata := startTestTCPEcho(t)
+	port := startTestHysteriaServer(t)
+	hop := useTestHopProxy(t, "hop")
+
+	h, err := NewHysteria(HysteriaOption{
+		BasicOption:    BasicOption{DialerProxy: hop.Name()},
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shared, err := h.DialContext(ctx, metadata)
+	require.NoError(t, err)
+	defer shared.Close()
+	require.Equal(t, int32(1), hop.listens.Load())
+
+	stub := &testCountingDialer{Dialer: dialer.NewDialer()}
+	conn, err := h.DialContextWithDialer(ctx, stub, metadata)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, int32(1), stub.listens.Load(), "the stub dialer must get a connection of its own")
+	assert.Equal(t, int32(1), hop.listens.Load(), "dialer-proxy must not be layered on the caller's dialer")
+
+	before := stub.written.Load()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Greater(t, stub.written.Load(), before)
+}
+
+func TestProxyProtocolV2Header(t *testing.T) {
+	header := proxyProtocolV2Header(&C.Metadata{
+		SrcIP: netip.MustParseAddr("10.0.0.1"), SrcPort: 12345,
+		DstIP: netip.MustParseAddr("::ffff:1.2.3.4"), DstPort: 443,
+	})
+	assert.Equal(t, append(append([]byte(nil), proxyProtocolV2Signature...),
+		0x21, 0x11, 0x00, 12, 10, 0, 0, 1, 1, 2, 3, 4, 0x30, 0x39, 0x01, 0xbb), header)
+
+	header = proxyProtocolV2Header(&C.Metadata{
+		SrcIP: netip.MustParseAddr("10.0.0.1"), SrcPort: 1,
+		DstIP: netip.MustParseAddr("2001:db8::1"), DstPort: 2,
+	})
+	require.Len(t, header, 16+36)
+	assert.Equal(t, []byte{0x21, 0x21, 0x00, 36}, header[12:16])
+	assert.Equal(t, netip.MustParseAddr("::ffff:10.0.0.1").AsSlice(), header[16:32])
+
+	header = proxyProtocolV2Header(&C.Metadata{Host: "example.com", DstPort: 443})
+	assert.Equal(t, append(append([]byte(nil), proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00), header)
+}
+
+func TestHysteriaProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 28+len("hello"))
+		_, _ = io.ReadFull(c, buf)
+		received <- buf
+	}()
+	backendAddr := backend.Addr().(*net.TCPAddr)
+	port := startTestHysteriaServer(t)
+
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+		ProxyProtocol:  true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	metadata := &C.Metadata{
+		NetWork: C.TCP,
+		SrcIP:   netip.MustParseAddr("192.0.2.7"),
+		SrcPort: 40000,
+		DstIP:   netip.MustParseAddr("127.0.0.1"),
+		DstPort: uint16(backendAddr.Port),
+	}
+	c, err := h.DialContext(context.Background(), metadata)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	select {
+	case buf := <-received:
+		assert.Equal(t, proxyProtocolV2Header(metadata), buf[:28])
+		assert.Equal(t, "hello", string(buf[28:]))
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend received nothing")
+	}
+}
+
+type testHyUDPConn struct {
+	core.UDPConn
+	writes    int
+	msgs      chan []byte
+	closeOnce sync.Once
+	reading   atomic.Int32
+}
+
+func (c *testHyUDPConn) WriteTo([]byte, string) error {
+	c.writes++
+	return nil
+}
+
+func (c *testHyUDPConn) ReadFrom() ([]byte, string, error) {
+	c.reading.Add(1)
+	defer c.reading.Add(-1)
+	msg, ok := <-c.msgs
+	if !ok {
+		return nil, "", core.ErrClosed
+	}
+	return msg, "127.0.0.1:53", nil
+}
+
+func (c *testHyUDPConn) Close() error {
+	c.closeOnce.Do(func() { close(c.msgs) })
+	return nil
+}
+
+func TestHysteriaPacketConnReadDeadline(t *testing.T) {
+	udpConn := &testHyUDPConn{msgs: make(chan []byte, 1)}
+	pc := newHyPacketConn(udpConn, 0)
+	buf := make([]byte, 64)
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, _, err := pc.ReadFrom(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the message arriving after the deadline is not lost
+	require.NoError(t, pc.SetReadDeadline(time.Time{}))
+	udpConn.msgs <- []byte("hello")
+	n, addr, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Equal(t, "127.0.0.1:53", addr.String())
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, _, _, err = pc.WaitReadFrom()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// closing ends the reader goroutine, it is left blocked in no read
+	assert.Eventually(t, func() bool {
+		return udpConn.reading.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(buf)
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return udpConn.reading.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), udpConn.reading.Load())
+}
+
+func TestHysteriaMaxDatagramSize(t *testing.T) {
+	h, err := NewHysteria(HysteriaOption{
+		Name:   "test",
+		Server: "127.0.0.1",
+		Port:   10000,
+		Up:     "10",
+		Down:   "10",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, core.MaxUDPPayloadSize, h.MaxDatagramSize())
+	_ = h.Close()
+
+	h, err = NewHysteria(HysteriaOption{
+		Name:            "test",
+		Server:          "127.0.0.1",
+		Port:            10000,
+		Up:              "10",
+		Down:            "10",
+		MaxDatagramSize: 1200,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1200, h.MaxDatagramSize())
+	_ = h.Close()
+
+	udpConn := &testHyUDPConn{}
+	pc := newHyPacketConn(udpConn, 1200)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+	n, err := pc.WriteTo(make([]byte, 1200), addr)
+	require.NoError(t, err)
+	assert.Equal(t, 1200, n)
+
+	n, err = pc.WriteTo(make([]byte, 1201), addr)
+	assert.ErrorIs(t, err, core.ErrDatagramTooLarge)
+	assert.ErrorContains(t, err, "1201 bytes exceeds max datagram size 1200")
+	assert.Zero(t, n)
+	assert.Equal(t, 1, udpConn.writes)
+
+	// the UoT packet conns are bound too
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+	limited := &hyLimitPacketConn{PacketConn: udp, maxSize: 1200}
+	_, err = limited.WriteTo(make([]byte, 1200), udp.LocalAddr())
+	require.NoError(t, err)
+	_, err = limited.WriteTo(make([]byte, 1201), udp.LocalAddr())
+	assert.ErrorIs(t, err, core.ErrDatagramTooLarge)
+}
+
+func TestHysteriaPinSHA256(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(targetAddr.Port)}
+	port, leaf := startTestHysteriaServerWithCert(t)
+
+	dial := func(pins []string) error {
+		h, err := NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			PinSHA256:      pins,
+		})
+		require.NoError(t, err)
+		defer h.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := h.DialContext(ctx, metadata)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	assert.NoError(t, dial(nil))
+	assert.NoError(t, dial([]string{base64.StdEncoding.EncodeToString(make([]byte, 32)), ca.CalculatePinSHA256(leaf)}))
+	err = dial([]string{base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	assert.ErrorContains(t, err, "does not match pin-sha256")
+
+	_, err = NewHysteria(HysteriaOption{
+		Name:      "test",
+		Server:    "127.0.0.1",
+		Port:      port,
+		Up:        "10",
+		Down:      "10",
+		PinSHA256: []string{"not base64"},
+	})
+	assert.Error(t, err)
+}
+
+func TestHysteriaOptionValidate(t *testing.T) {
+	valid := func() HysteriaOption {
+		return HysteriaOption{Name: "test", Server: "127.0.0.1", Port: 10000, Up: "10", Down: "10"}
+	}
+	option := valid()
+	assert.NoError(t, option.Validate())
+	option.Port = 0
+	assert.NoError(t, option.Validate()) // left to the dial, like before Validate existed
+	option.Ports = "10000-10010,20000"
+	assert.NoError(t, option.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(*HysteriaOption)
+		err    string
+	}{
+		{"ports", func(o *HysteriaOption) { o.Ports = "1000-x" }, "invalid ports 1000-x"},
+		{"up", func(o *HysteriaOption) { o.Up = "fast" }, "upload speed"},
+		{"down", func(o *HysteriaOption) { o.Down = "" }, "download speed"},
+		{"ech", func(o *HysteriaOption) { o.ECHOpts = ECHOptions{Enable: true, Config: "not base64"} }, "ech config"},
+		{"sni-list with ech", func(o *HysteriaOption) {
+			o.ECHOpts = ECHOptions{Enable: true}
+			o.SNIList = []string{"a.example.com"}
+		}, "sni-list"},
+		{"pin-sha256", func(o *HysteriaOption) { o.PinSHA256 = []string{"not base64"} }, "pin-sha256"},
+		{"auth", func(o *HysteriaOption) { o.Auth = "not base64!" }, "invalid auth"},
+		{"udp over stream version", func(o *HysteriaOption) { o.UDPOverStreamVersion = 9 }, "udp over stream protocol version: 9"},
+		{"dial-retries", func(o *HysteriaOption) { o.DialRetries = -1 }, "invalid dial-retries: -1"},
+		{"max-streams", func(o *HysteriaOption) { o.MaxStreams = -1 }, "invalid max-streams: -1"},
+		{"disable-conn-migration without ports", func(o *HysteriaOption) { o.DisableConnMigration = true }, "disable-conn-migration only applies to port hopping"},
+		{"up-mbps", func(o *HysteriaOption) { o.UpSpeedFloat = -1.5 }, "upload speed: -1.5 Mbps"},
+		{"down-speed", func(o *HysteriaOption) { o.DownSpeed = -2 }, "download speed: -2 Mbps"},
+		{"quic-versions", func(o *HysteriaOption) { o.QUICVersions = []string{"1", "draft-29"} }, "unknown quic version: draft-29"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			option := valid()
+			tt.modify(&option)
+			assert.ErrorContains(t, option.Validate(), tt.err)
+			_, err := NewHysteria(option) // checked before anything is built
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestHysteriaSNIList(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(targetAddr.Port)}
+
+	var sniMutex sync.Mutex
+	snis := map[string]int{}
+	port, leaf := startTestHysteriaServerWithTLS(t, func(config *tlsC.Config) {
+		certificate := config.Certificates[0]
+		config.GetCertificate = func(hello *tlsC.ClientHelloInfo) (*tlsC.Certificate, error) {
+			sniMutex.Lock()
+			snis[hello.ServerName]++
+			sniMutex.Unlock()
+			return &certificate, nil
+		}
+	})
+
+	sniList := []string{"a.example.com", "b.example.com", "c.example.com"}
+	connReuse := false
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+		PinSHA256:      []string{ca.CalculatePinSHA256(leaf)}, // still checked with a rotated sni
+		ConnReuse:      &connReuse,
+		SNIList:        sniList,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	const dials = 12
+	var wg sync.WaitGroup
+	errs := make(chan error, dials)
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := h.DialContext(ctx, metadata)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = conn.Write([]byte("ping"))
+			if err == nil {
+				_, err = io.ReadFull(conn, make([]byte, 4))
+			}
+			_ = conn.Close()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	sniMutex.Lock()
+	defer sniMutex.Unlock()
+	total := 0
+	for sni, count := range snis {
+		assert.Contains(t, sniList, sni)
+		total += count
+	}
+	assert.Equal(t, dials, total)
+	assert.Greater(t, len(snis), 1) // 3 * (1/3)^12 to pick the same one every time
+
+	_, err = NewHysteria(HysteriaOption{
+		Name:    "test",
+		Server:  "127.0.0.1",
+		Port:    port,
+		Up:      "10",
+		Down:    "10",
+		SNIList: sniList,
+		ECHOpts: ECHOptions{Enable: true},
+	})
+	assert.ErrorContains(t, err, "sni-list")
+}
+
+func TestHysteriaFDUsage(t *testing.T) {
+	metadata := startTestTCPEcho(t)
+	port := startTestHysteriaServer(t)
+
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	usage := dialer.FDUsage()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		conn, err := h.DialContext(ctx, metadata)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	assert.Equal(t, usage+1, dialer.FDUsage(), "streams share the one udp socket")
+}
+
+func TestHysteriaConnReuse(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(targetAddr.Port)}
+	port := startTestHysteriaServer(t)
+	hop := useTestHopProxy(t, "hop")
+
+	const streams = 16
+	for _, reuse := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reuse=%v", reuse), func(t *testing.T) {
+			h, err := NewHysteria(HysteriaOption{
+				Name:           "test",
+				Server:         "127.0.0.1",
+				Port:           port,
+				Up:             "10",
+				Down:           "10",
+				SkipCertVerify: true,
+				ConnReuse:      &reuse,
+				BasicOption:    BasicOption{DialerProxy: hop.Name()},
+			})
+			require.NoError(t, err)
+			defer h.Close()
+
+			hop.listens.Store(0)
+			conns := make([]C.Conn, streams)
+			var wg sync.WaitGroup
+			for i := range conns {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					conn, err := h.DialContext(ctx, metadata)
+					if assert.NoError(t, err) {
+						conns[i] = conn
+					}
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, streams, h.ActiveStreams())
+			if reuse {
+				assert.Equal(t, int32(1), hop.listens.Load())
+			} else {
+				assert.Equal(t, int32(streams), hop.listens.Load())
+			}
+
+			for _, conn := range conns {
+				if conn == nil {
+					continue
+				}
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				_, err := conn.Write([]byte("ping"))
+				require.NoError(t, err)
+				buf := make([]byte, 4)
+				_, err = io.ReadFull(conn, buf)
+				require.NoError(t, err)
+				assert.Equal(t, "ping", string(buf))
+				_ = conn.Close()
+			}
+			assert.Zero(t, h.ActiveStreams())
+		})
+	}
+}
+
+func TestHysteriaWarmup(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(targetAddr.Port)}
+	port := startTestHysteriaServer(t)
+	hop := useTestHopProxy(t, "hop")
+
+	newHysteria := func() *Hysteria {
+		h, err := NewHysteria(HysteriaOption{
+			BasicOption:    BasicOption{DialerProxy: hop.Name()},
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+	timedDial := func(h *Hysteria) time.Duration {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		conn, err := h.DialContext(ctx, metadata)
+		elapsed := time.Since(start)
+		require.NoError(t, err)
+		_ = conn.Close()
+		return elapsed
+	}
+
+	cold := timedDial(newHysteria())
+
+	h := newHysteria()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Warmup(ctx))
+	require.NoError(t, h.Warmup(ctx)) // no-op on a healthy connection
+
+	hop.listens.Store(0)
+	warm := timedDial(h)
+	assert.Zero(t, hop.listens.Load(), "dial after warmup must reuse the connection")
+	assert.Less(t, warm, cold)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, newHysteria().Warmup(canceled), context.Canceled)
+
+	// the handshake outlives a Warmup whose ctx is done first
+	started, release := make(chan struct{}), make(chan struct{})
+	listenErr := make(chan error, 1)
+	hop.onListen = func(ctx context.Context) {
+		close(started)
+		<-release
+		listenErr <- ctx.Err()
+	}
+	h = newHysteria()
+	hop.listens.Store(0)
+	ctx, cancel = context.WithCancel(context.Background())
+	warmupErr := make(chan error, 1)
+	go func() { warmupErr <- h.Warmup(ctx) }()
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-warmupErr, context.Canceled)
+	close(release)
+	assert.NoError(t, <-listenErr)
+	hop.onListen = nil
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Warmup(ctx))
+	assert.Equal(t, int32(1), hop.listens.Load(), "the background handshake must serve later dials")
+}
+
+func TestHysteriaDialTimeout(t *testing.T) {
+	port := startTestHysteriaServer(t)
+	hop := useTestHopProxy(t, "timeout-hop")
+	listenErr := make(chan error, 1)
+	hop.onListen = func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		listenErr <- ctx.Err()
+	}
+	h, err := NewHysteria(HysteriaOption{
+		BasicOption:    BasicOption{DialerProxy: hop.Name(), DialTimeout: 1},
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := h.DialContext(ctx, startTestTCPEcho(t))
+	if err == nil {
+		_ = conn.Close()
+	}
+	assert.ErrorIs(t, <-listenErr, context.DeadlineExceeded, "the server connect must be bounded by dial-timeout")
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestHysteriaECHAccepted(t *testing.T) {
+	echConfig, echKey, err := ech.GenECHConfig("public.example.com")
+	require.NoError(t, err)
+	acceptPort, _ := startTestHysteriaServerWithTLS(t, func(config *tlsC.Config) {
+		require.NoError(t, ech.LoadECHKey(echKey, config, C.Path))
+	})
+	rejectPort := startTestHysteriaServer(t)
+
+	newHysteria := func(port int, echOpts ECHOptions) *Hysteria {
+		h, err := NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			SNI:            "inner.example.com",
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			ECHOpts:        echOpts,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+	warmup := func(h *Hysteria) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return h.Warmup(ctx)
+	}
+
+	h := newHysteria(acceptPort, ECHOptions{})
+	require.NoError(t, warmup(h))
+	assert.False(t, h.ECHAccepted())
+	assert.Equal(t, C.ECHNotConfigured, h.ProxyInfo().ECH)
+
+	h = newHysteria(acceptPort, ECHOptions{Enable: true, Config: echConfig})
+	assert.Equal(t, C.ECHPending, h.ECHState())
+	require.NoError(t, warmup(h))
+	assert.True(t, h.ECHAccepted())
+	assert.Equal(t, C.ECHAccepted, h.ProxyInfo().ECH)
+
+	// a server rejecting ech fails the handshake, there is no connection to report on
+	h = newHysteria(rejectPort, ECHOptions{Enable: true, Config: echConfig})
+	assert.Error(t, warmup(h))
+	assert.False(t, h.ECHAccepted())
+	assert.Equal(t, C.ECHPending, h.ECHState())
+}
+
+// testHopProxy is a dialer-proxy hop relaying packet conns through the dialer it's given
+type testHopProxy struct {
+	C.Proxy
+	base    *Base
+	listens atomic.Int32
+	written atomic.Int64
+
+	onListen func(ctx context.Context) // called with the ctx of each listen, if set
+}
+
+func (p *testHopProxy) Name() string { return p.base.Name() }
+
+func (p *testHopProxy) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	return p.ListenPacketWithDialer(ctx, dialer.NewDialer(), metadata)
+}
+
+func (p *testHopProxy) ListenPacketWithDialer(ctx context.Context, d C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	if p.onListen != nil {
+		p.onListen(ctx)
+	}
+	pc, err := d.ListenPacket(ctx, "udp", "", metadata.AddrPort())
+	if err != nil {
+		return nil, err
+	}
+	p.listens.Add(1)
+	return newPacketConn(&testCountingPacketConn{PacketConn: pc, written: &p.written}, p.base), nil
+}
+
+// useTestHopProxy registers a testHopProxy named name for the test to use as dialer-proxy
+func useTestHopProxy(t *testing.T, name string) *testHopProxy {
+	hop := &testHopProxy{base: NewBase(BaseOption{Name: name, Type: C.Direct, UDP: true})}
+	oldProxies := tunnel.Proxies()
+	tunnel.UpdateProxies(map[string]C.Proxy{name: hop}, nil)
+	t.Cleanup(func() { tunnel.UpdateProxies(oldProxies, nil) })
+	return hop
+}
+
+func TestHysteriaDialerProxyChain(t *testing.T) {
+	port := startTestHysteriaServer(t)
+	hops := make([]*testHopProxy, 3)
+	proxies := map[string]C.Proxy{}
+	var names []string
+	for i := range hops {
+		name := fmt.Sprintf("hop%d", i)
+		hops[i] = &testHopProxy{base: NewBase(BaseOption{Name: name, Type: C.Direct, UDP: true})}
+		proxies[name] = hops[i]
+		names = append(names, name)
+	}
+	oldProxies := tunnel.Proxies()
+	tunnel.UpdateProxies(proxies, nil)
+	defer tunnel.UpdateProxies(oldProxies, nil)
+
+	h, err := NewHysteria(HysteriaOption{
+		BasicOption:    BasicOption{DialerProxy: names[2], DialerProxies: names},
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Warmup(ctx))
+	for _, hop := range hops {
+		assert.Equal(t, int32(1), hop.listens.Load(), hop.Name())
+		assert.Positive(t, hop.written.Load(), hop.Name())
+	}
+	// every packet leaving a hop went through the next one first
+	assert.GreaterOrEqual(t, hops[0].written.Load(), hops[1].written.Load())
+	assert.GreaterOrEqual(t, hops[1].written.Load(), hops[2].written.Load())
+}
+
+// testFlakyDialer fails the first fails packet listens, as a lost handshake would
+type testFlakyDialer struct {
+	C.Dialer
+	fails    int32
+	attempts atomic.Int32
+}
+
+func (d *testFlakyDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	if d.attempts.Add(1) <= d.fails {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("transient failure")}
+	}
+	return d.Dialer.ListenPacket(ctx, network, address, rAddrPort)
+}
+
+func TestHysteriaDialRetries(t *testing.T) {
+	oldDelay := hysteriaDialRetryDelay
+	hysteriaDialRetryDelay = 10 * time.Millisecond
+	defer func() { hysteriaDialRetryDelay = oldDelay }()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(target.Addr().(*net.TCPAddr).Port)}
+	port := startTestHysteriaServer(t)
+
+	newHysteria := func(retries int) *Hysteria {
+		h, err := NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			DialRetries:    retries,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+
+	// the default keeps a single attempt
+	flaky := &testFlakyDialer{Dialer: dialer.NewDialer(), fails: 2}
+	_, err = newHysteria(0).DialContextWithDialer(context.Background(), flaky, metadata)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), flaky.attempts.Load())
+
+	flaky = &testFlakyDialer{Dialer: dialer.NewDialer(), fails: 2}
+	_, err = newHysteria(1).DialContextWithDialer(context.Background(), flaky, metadata)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), flaky.attempts.Load())
+
+	flaky = &testFlakyDialer{Dialer: dialer.NewDialer(), fails: 2}
+	conn, err := newHysteria(2).DialContextWithDialer(context.Background(), flaky, metadata)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, int32(3), flaky.attempts.Load())
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// no retry would finish before the deadline
+	flaky = &testFlakyDialer{Dialer: dialer.NewDialer(), fails: 2}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err = newHysteria(2).DialContextWithDialer(ctx, flaky, metadata)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), flaky.attempts.Load())
+
+	assert.False(t, isRetryableHysteriaError(fmt.Errorf("%w: wrong password", core.ErrAuth)))
+	assert.False(t, isRetryableHysteriaError(fmt.Errorf("%w: blocked", core.ErrRejected)))
+	assert.False(t, isRetryableHysteriaError(fmt.Errorf("%w: disabled", core.ErrUDPRejected)))
+	assert.False(t, isRetryableHysteriaError(x509.UnknownAuthorityError{}))
+	assert.True(t, isRetryableHysteriaError(context.DeadlineExceeded))
+}
+
+func TestHysteriaMaxStreams(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(target.Addr().(*net.TCPAddr).Port)}
+	port := startTestHysteriaServer(t)
+
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+		UDPOverTCP:     true,
+		MaxStreams:     2,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	first, err := h.DialContext(context.Background(), metadata)
+	require.NoError(t, err)
+	udpMetadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: 53}
+	second, err := h.ListenPacketContext(context.Background(), udpMetadata) // udp takes a slot too
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = h.DialContext(ctx, metadata)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer pingCancel()
+	_, err = h.Ping(pingCtx) // a ping stream waits for a slot too
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	type result struct {
+		conn C.Conn
+		err  error
+	}
+	waiting := make(chan result, 1)
+	go func() {
+		conn, err := h.DialContext(context.Background(), metadata)
+		waiting <- result{conn, err}
+	}()
+	select {
+	case <-waiting:
+		t.Fatal("dial did not wait for a free stream")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, second.Close())
+	select {
+	case r := <-waiting:
+		require.NoError(t, r.err)
+		_, err = r.conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(r.conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		_ = r.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial still waiting after a stream closed")
+	}
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close()) // a second close frees nothing more
+
+	// the slot follows the stream, not the conns wrapping it
+	conn, err := h.DialContext(context.Background(), metadata)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Len(t, h.streamSlots, 1)
+	_, err = h.Ping(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, h.streamSlots, 1, "ping gives its slot back")
+	var stream any = conn
+	for upstream, ok := stream.(interface{ Upstream() any }); ok; upstream, ok = stream.(interface{ Upstream() any }) {
+		stream = upstream.Upstream()
+	}
+	require.NoError(t, stream.(net.Conn).Close())
+	assert.Len(t, h.streamSlots, 0)
+
+	// both slots are free again
+	for i := 0; i < 2; i++ {
+		conn, err := h.DialContext(context.Background(), metadata)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	assert.Len(t, h.streamSlots, 2)
+}
+
+func TestHysteriaKeyLogFile(t *testing.T) {
+	oldHome := C.Path.HomeDir()
+	defer C.SetHomeDir(oldHome)
+	dir := t.TempDir()
+	C.SetHomeDir(dir)
+	port := startTestHysteriaServer(t)
+
+	newHysteria := func() (*Hysteria, error) {
+		return NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			KeyLogFile:     "keylog.txt",
+		})
+	}
+
+	// refused without the explicit opt-in
+	t.Setenv(hysteriaKeyLogEnv, "")
+	_, err := newHysteria()
+	assert.ErrorContains(t, err, hysteriaKeyLogEnv)
+	assert.NoFileExists(t, filepath.Join(dir, "keylog.txt"))
+
+	t.Setenv(hysteriaKeyLogEnv, "1")
+	h, err := newHysteria()
+	require.NoError(t, err)
+	defer h.Close()
+	_, err = h.Ping(context.Background())
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "keylog.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ")
+	assert.Contains(t, string(buf), "CLIENT_TRAFFIC_SECRET_0 ")
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		assert.Len(t, strings.Fields(line), 3, line) // label, client random, secret
+	}
+}
+
+func TestHysteriaExpandEnv(t *testing.T) {
+	t.Setenv("HY_TEST_AUTH", "secret")
+	t.Setenv("HY_TEST_HOST", "example.com")
+
+	for _, c := range []struct {
+		in     string
+		strict bool
+		out    string
+		err    bool
+	}{
+		{in: "${HY_TEST_AUTH}", out: "secret"},
+		{in: "pre-${HY_TEST_AUTH}-post", out: "pre-secret-post"},
+		{in: "$${HY_TEST_AUTH}", out: "${HY_TEST_AUTH}"},
+		{in: "a$$b$", out: "a$b$"},
+		{in: "$HY_TEST_AUTH", out: "$HY_TEST_AUTH"},
+		{in: "${HY_TEST_MISSING}", out: ""},
+		{in: "${HY_TEST_MISSING}", strict: true, err: true},
+		{in: "${HY_TEST_AUTH", err: true},
+	} {
+		out, err := expandHysteriaEnv(c.in, c.strict)
+		if c.err {
+			assert.Error(t, err, c.in)
+			continue
+		}
+		require.NoError(t, err, c.in)
+		assert.Equal(t, c.out, out, c.in)
+	}
+
+	option := HysteriaOption{
+		Server:     "${HY_TEST_HOST}",
+		AuthString: "${HY_TEST_AUTH}",
+		Obfs:       "o$$bfs",
+		ExpandEnv:  true,
+	}
+	require.NoError(t, option.expandEnv())
+	assert.Equal(t, "example.com", option.Server)
+	assert.Equal(t, "secret", option.AuthString)
+	assert.Equal(t, "o$bfs", option.Obfs)
+
+	// left untouched without the opt-in
+	option = HysteriaOption{AuthString: "${HY_TEST_AUTH}"}
+	require.NoError(t, option.expandEnv())
+	assert.Equal(t, "${HY_TEST_AUTH}", option.AuthString)
+
+	_, err := NewHysteria(HysteriaOption{
+		Name:            "hy",
+		Server:          "127.0.0.1",
+		Port:            443,
+		Up:              "10",
+		Down:            "10",
+		AuthString:      "${HY_TEST_MISSING}",
+		ExpandEnvStrict: true,
+	})
+	assert.ErrorContains(t, err, "HY_TEST_MISSING")
+}
+
+func TestHysteriaInitCwnd(t *testing.T) {
+	for _, cwnd := range []int{-1, hysteriaMaxInitCwnd + 1} {
+		option := HysteriaOption{Name: "test", Server: "127.0.0.1", Port: 443, Up: "10", Down: "10", InitCwnd: cwnd}
+		assert.ErrorContains(t, option.Validate(), "init-cwnd")
+	}
+
+	oldFactory := newHysteriaCongestion
+	defer func() { newHysteriaCongestion = oldFactory }()
+	var got []int
+	newHysteriaCongestion = func(refBPS uint64, initCwnd int) congestion.CongestionControl {
+		got = append(got, initCwnd)
+		return oldFactory(refBPS, initCwnd)
+	}
+
+	port := startTestHysteriaServer(t)
+	for _, cwnd := range []int{0, 64} {
+		h, err := NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			InitCwnd:       cwnd,
+		})
+		require.NoError(t, err)
+		_, err = h.Ping(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, h.Close())
+	}
+	assert.Equal(t, []int{0, 64}, got)
+}
+
+func TestHysteriaServerInfo(t *testing.T) {
+	port := startTestHysteriaServer(t)
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	_, err = h.ServerInfo()
+	assert.Error(t, err)
+
+	_, err = h.Ping(context.Background())
+	require.NoError(t, err)
+	info, err := h.ServerInfo()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, info.Version)
+	assert.Equal(t, "hysteria", info.ALPN)
+	assert.False(t, info.UDPRejected)
+
+	// the test server turns native udp down
+	metadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: 53}
+	_, err = h.ListenPacketContext(context.Background(), metadata)
+	assert.Error(t, err)
+	info, err = h.ServerInfo()
+	require.NoError(t, err)
+	assert.True(t, info.UDPRejected)
+}
+
+func TestHysteriaDisableUDP(t *testing.T) {
+	port := startTestHysteriaServer(t)
+	newHysteria := func(udp *bool) *Hysteria {
+		h, err := NewHysteria(HysteriaOption{
+			Name:           "test",
+			Server:         "127.0.0.1",
+			Port:           port,
+			Up:             "10",
+			Down:           "10",
+			SkipCertVerify: true,
+			EnableUDP:      udp,
+			UDPOverTCP:     true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+
+	for _, udp := range []*bool{nil, lo.ToPtr(true)} {
+		h := newHysteria(udp)
+		assert.True(t, h.SupportUDP())
+		assert.True(t, h.Capabilities().Has(C.CapUDP))
+	}
+
+	h := newHysteria(lo.ToPtr(false))
+	assert.False(t, h.SupportUDP())
+	assert.False(t, h.Capabilities().Has(C.CapUDP))
+	metadata := &C.Metadata{NetWork: C.UDP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: 53}
+	_, err := h.ListenPacketContext(context.Background(), metadata)
+	assert.ErrorIs(t, err, C.ErrNotSupport)
+	assert.ErrorContains(t, err, "udp disabled")
+
+	// tcp is unaffected
+	_, err = h.Ping(context.Background())
+	require.NoError(t, err)
+}
+
+func TestHysteriaDialContextTimed(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(target.Addr().(*net.TCPAddr).Port)}
+	port := startTestHysteriaServer(t)
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	c, timings, err := DialContextTimed(context.Background(), h, metadata)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Greater(t, timings.Connect, time.Duration(0)) // quic handshake and auth
+	assert.GreaterOrEqual(t, timings.Handshake, timings.Connect)
+
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	after := c.(interface{ DialTimings() DialTimings }).DialTimings()
+	assert.GreaterOrEqual(t, after.FirstByte, after.Handshake)
+
+	// the quic connection is reused, there is no connect phase
+	c2, timings, err := DialContextTimed(context.Background(), h, metadata)
+	require.NoError(t, err)
+	defer c2.Close()
+	assert.Zero(t, timings.Connect)
+	assert.Greater(t, timings.Handshake, time.Duration(0))
+}
+
+func TestHysteriaDialWithoutObfs(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(target.Addr().(*net.TCPAddr).Port)}
+	port := startTestHysteriaServer(t) // speaks no obfs
+	h, err := NewHysteria(HysteriaOption{
+		Name:           "test",
+		Server:         "127.0.0.1",
+		Port:           port,
+		Up:             "10",
+		Down:           "10",
+		SkipCertVerify: true,
+		Obfs:           "secret",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	conn, err := h.DialWithoutObfs(context.Background(), metadata)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// other dials keep obfuscating and the server can't make sense of them,
+	// they fail once the quic handshake times out
+	_, err = h.DialContext(context.Background(), metadata)
+	assert.Error(t, err)
+}
+
+func TestHysteriaSpeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		option   HysteriaOption
+		up, down uint64
+	}{
+		{"string", HysteriaOption{Up: "10", Down: "100 Mbps"}, 10 * mbpsToBps, 100 * mbpsToBps},
+		{"speed over string", HysteriaOption{Up: "10", UpSpeed: 20, Down: "100", DownSpeed: 200}, 20 * mbpsToBps, 200 * mbpsToBps},
+		{"speed without string", HysteriaOption{UpSpeed: 20, DownSpeed: 200}, 20 * mbpsToBps, 200 * mbpsToBps},
+		{"mbps over speed", HysteriaOption{Up: "10", UpSpeed: 20, UpSpeedFloat: 12.5, Down: "100", DownSpeed: 200, DownSpeedFloat: 0.5}, 1562500, 62500},
+		{"per direction", HysteriaOption{UpSpeedFloat: 1.25, Down: "100"}, 156250, 100 * mbpsToBps},
+		{"rounded", HysteriaOption{UpSpeedFloat: 0.0000123, DownSpeedFloat: 0.000004}, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, down, err := tt.option.Speed()
+			require.NoError(t, err)
+			assert.Equal(t, tt.up, up)
+			assert.Equal(t, tt.down, down)
+		})
+	}
+
+	for _, mbps := range []float64{-1, 0.000003, math.NaN(), math.Inf(1)} {
+		option := HysteriaOption{UpSpeedFloat: mbps, Down: "100"}
+		_, _, err := option.Speed()
+		assert.ErrorContains(t, err, "upload speed", "%v Mbps", mbps)
+	}
+}
+
+func TestHysteriaQUICVersions(t *testing.T) {
+	for _, tt := range []struct {
+		versions []string
+		expected []quic.Version
+	}{
+		{nil, nil},
+		{[]string{"1"}, []quic.Version{quic.Version1}},
+		{[]string{"v2", " 1 "}, []quic.Version{quic.Version2, quic.Version1}},
+	} {
+		h, err := NewHysteria(HysteriaOption{
+			Name:         "test",
+			Server:       "127.0.0.1",
+			Port:         10000,
+			Up:           "10",
+			Down:         "10",
+			QUICVersions: tt.versions,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, h.quicConfig.Versions, "%v", tt.versions)
+		h.Close()
+	}
+
+	_, err := NewHysteria(HysteriaOption{Name: "test", Server: "127.0.0.1", Port: 10000, Up: "10", Down: "10", QUICVersions: []string{"3"}})
+	assert.ErrorContains(t, err, "unknown quic version: 3")
+}
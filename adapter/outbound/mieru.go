@@ -72,6 +72,11 @@ func (m *Mieru) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (m *Mieru) Capabilities() C.Capabilities {
+	return m.Base.Capabilities() | C.CapUOT
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (m *Mieru) ProxyInfo() C.ProxyInfo {
 	info := m.Base.ProxyInfo()
@@ -138,6 +143,12 @@ func NewMieru(option MieruOption) (*Mieru, error) {
 			udp:    option.UDP,
 			xudp:   false,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		option: &option,
@@ -167,7 +167,9 @@ func (ss *ShadowSocks) DialContextWithDialer(ctx context.Context, dialer C.Diale
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", ss.addr)
+	dialCtx, dialCancel := ss.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", ss.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", ss.addr, err)
 	}
@@ -249,6 +251,15 @@ func (ss *ShadowSocks) SupportUOT() bool {
 	return ss.option.UDPOverTCP
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities when enabled
+func (ss *ShadowSocks) Capabilities() C.Capabilities {
+	caps := ss.Base.Capabilities()
+	if ss.SupportUOT() {
+		caps |= C.CapUOT
+	}
+	return caps
+}
+
 func NewShadowSocks(option ShadowSocksOption) (*ShadowSocks, error) {
 	addr := net.JoinHostPort(option.Server, strconv.Itoa(option.Port))
 	method, err := shadowsocks.CreateMethod(context.Background(), option.Cipher, shadowsocks.MethodOptions{
@@ -389,6 +400,12 @@ func NewShadowSocks(option ShadowSocksOption) (*ShadowSocks, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		method: method,
@@ -79,7 +79,9 @@ func (ssr *ShadowSocksR) DialContextWithDialer(ctx context.Context, dialer C.Dia
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", ssr.addr)
+	dialCtx, dialCancel := ssr.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", ssr.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", ssr.addr, err)
 	}
@@ -196,6 +198,12 @@ func NewShadowSocksR(option ShadowSocksROption) (*ShadowSocksR, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		option:   &option,
@@ -100,7 +100,9 @@ func (s *Snell) DialContextWithDialer(ctx context.Context, dialer C.Dialer, meta
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", s.addr)
+	dialCtx, dialCancel := s.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", s.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", s.addr, err)
 	}
@@ -130,7 +132,9 @@ func (s *Snell) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, met
 	if err = s.ResolveUDP(ctx, metadata); err != nil {
 		return nil, err
 	}
-	c, err := dialer.DialContext(ctx, "tcp", s.addr)
+	dialCtx, dialCancel := s.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", s.addr)
+	dialCancel()
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +155,11 @@ func (s *Snell) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (s *Snell) Capabilities() C.Capabilities {
+	return s.Base.Capabilities() | C.CapUOT
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (s *Snell) ProxyInfo() C.ProxyInfo {
 	info := s.Base.ProxyInfo()
@@ -199,6 +208,12 @@ func NewSnell(option SnellOption) (*Snell, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		option:     &option,
@@ -0,0 +1,119 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/metacubex/mihomo/common/buf"
+	N "github.com/metacubex/mihomo/common/net"
+	C "github.com/metacubex/mihomo/constant"
+)
+
+// DialTimings are the phases of a dial measured from its start, a phase the adapter
+// doesn't report stays zero
+type DialTimings struct {
+	Connect   time.Duration // the connection to the server is established, zero when an existing one was reused
+	Handshake time.Duration // the proxy handshake is done and the conn is ready to use
+	FirstByte time.Duration // the first byte was read back
+}
+
+type dialTraceKey struct{}
+
+// dialTrace collects the phases adapters report while DialContextTimed dials
+type dialTrace struct {
+	start   time.Time
+	mutex   sync.Mutex
+	timings DialTimings
+}
+
+// markDialConnected records that the connection to the server of a dial traced by
+// DialContextTimed is established, with dialer-proxy the last hop to do so wins
+func markDialConnected(ctx context.Context) {
+	if trace, ok := ctx.Value(dialTraceKey{}).(*dialTrace); ok {
+		trace.mutex.Lock()
+		trace.timings.Connect = time.Since(trace.start)
+		trace.mutex.Unlock()
+	}
+}
+
+func (t *dialTrace) markHandshake() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.timings.Handshake = time.Since(t.start)
+}
+
+func (t *dialTrace) markFirstByte() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timings.FirstByte == 0 {
+		t.timings.FirstByte = time.Since(t.start)
+	}
+}
+
+func (t *dialTrace) Timings() DialTimings {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.timings
+}
+
+// DialContextTimed dials metadata through proxy like DialContext and reports how long the
+// phases of the dial took, for benchmarking. FirstByte is unknown when it returns, the conn's
+// DialTimings method reports it once the first byte has been read.
+func DialContextTimed(ctx context.Context, proxy C.ProxyAdapter, metadata *C.Metadata) (C.Conn, DialTimings, error) {
+	trace := &dialTrace{start: time.Now()}
+	c, err := proxy.DialContext(context.WithValue(ctx, dialTraceKey{}, trace), metadata)
+	if err != nil {
+		return nil, trace.Timings(), err
+	}
+	trace.markHandshake()
+	return &timedConn{Conn: c, trace: trace}, trace.Timings(), nil
+}
+
+// timedConn records when the first byte is read from a conn dialed by DialContextTimed
+type timedConn struct {
+	C.Conn
+	trace *dialTrace
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.trace.markFirstByte()
+	}
+	return n, err
+}
+
+func (c *timedConn) ReadBuffer(buffer *buf.Buffer) error {
+	err := c.Conn.ReadBuffer(buffer)
+	if buffer.Len() > 0 {
+		c.trace.markFirstByte()
+	}
+	return err
+}
+
+func (c *timedConn) UnwrapReader() (io.Reader, []N.CountFunc) {
+	return c.Conn, []N.CountFunc{func(n int64) {
+		if n > 0 {
+			c.trace.markFirstByte()
+		}
+	}}
+}
+
+// DialTimings returns the phases of the dial, including FirstByte once it is known
+func (c *timedConn) DialTimings() DialTimings {
+	return c.trace.Timings()
+}
+
+func (c *timedConn) Upstream() any {
+	return c.Conn
+}
+
+func (c *timedConn) ReaderReplaceable() bool {
+	return false
+}
+
+func (c *timedConn) WriterReplaceable() bool {
+	return true
+}
@@ -0,0 +1,61 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialContextTimed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		time.Sleep(20 * time.Millisecond)
+		_, _ = c.Write([]byte("hello"))
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(port)}
+
+	c, timings, err := DialContextTimed(context.Background(), NewDirect(), metadata)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Greater(t, timings.Connect, time.Duration(0))
+	assert.GreaterOrEqual(t, timings.Handshake, timings.Connect)
+	assert.Zero(t, timings.FirstByte)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	after := c.(interface{ DialTimings() DialTimings }).DialTimings()
+	assert.Equal(t, timings.Connect, after.Connect)
+	assert.Equal(t, timings.Handshake, after.Handshake)
+	assert.GreaterOrEqual(t, after.FirstByte, after.Handshake+10*time.Millisecond)
+}
+
+func TestDialContextTimedError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+	metadata := &C.Metadata{NetWork: C.TCP, DstIP: netip.MustParseAddr("127.0.0.1"), DstPort: uint16(port)}
+
+	_, timings, err := DialContextTimed(context.Background(), NewDirect(), metadata)
+	assert.Error(t, err)
+	assert.Zero(t, timings.Connect)
+	assert.Zero(t, timings.Handshake)
+}
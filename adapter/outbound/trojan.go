@@ -200,7 +200,9 @@ func (t *Trojan) DialContextWithDialer(ctx context.Context, dialer C.Dialer, met
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", t.addr)
+	dialCtx, dialCancel := t.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", t.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", t.addr, err)
 	}
@@ -257,7 +259,9 @@ func (t *Trojan) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, me
 	if err = t.ResolveUDP(ctx, metadata); err != nil {
 		return nil, err
 	}
-	c, err := dialer.DialContext(ctx, "tcp", t.addr)
+	dialCtx, dialCancel := t.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", t.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", t.addr, err)
 	}
@@ -283,6 +287,11 @@ func (t *Trojan) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (t *Trojan) Capabilities() C.Capabilities {
+	return t.Base.Capabilities() | C.CapUOT
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (t *Trojan) ProxyInfo() C.ProxyInfo {
 	info := t.Base.ProxyInfo()
@@ -315,6 +324,12 @@ func NewTrojan(option TrojanOption) (*Trojan, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		option:      &option,
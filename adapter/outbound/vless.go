@@ -259,7 +259,9 @@ func (v *Vless) DialContextWithDialer(ctx context.Context, dialer C.Dialer, meta
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", v.addr)
+	dialCtx, dialCancel := v.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", v.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %s", v.addr, err.Error())
 	}
@@ -313,7 +315,9 @@ func (v *Vless) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, met
 		return nil, err
 	}
 
-	c, err := dialer.DialContext(ctx, "tcp", v.addr)
+	dialCtx, dialCancel := v.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", v.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %s", v.addr, err.Error())
 	}
@@ -365,6 +369,11 @@ func (v *Vless) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (v *Vless) Capabilities() C.Capabilities {
+	return v.Base.Capabilities() | C.CapUOT
+}
+
 // ProxyInfo implements C.ProxyAdapter
 func (v *Vless) ProxyInfo() C.ProxyInfo {
 	info := v.Base.ProxyInfo()
@@ -541,6 +550,12 @@ func NewVless(option VlessOption) (*Vless, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		client: client,
@@ -315,7 +315,9 @@ func (v *Vmess) DialContextWithDialer(ctx context.Context, dialer C.Dialer, meta
 			return nil, err
 		}
 	}
-	c, err := dialer.DialContext(ctx, "tcp", v.addr)
+	dialCtx, dialCancel := v.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", v.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %s", v.addr, err.Error())
 	}
@@ -365,7 +367,9 @@ func (v *Vmess) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, met
 		return nil, err
 	}
 
-	c, err := dialer.DialContext(ctx, "tcp", v.addr)
+	dialCtx, dialCancel := v.dialContext(ctx)
+	c, err := dialer.DialContext(dialCtx, "tcp", v.addr)
+	dialCancel()
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %s", v.addr, err.Error())
 	}
@@ -417,6 +421,11 @@ func (v *Vmess) SupportUOT() bool {
 	return true
 }
 
+// Capabilities adds UDP over TCP to Base.Capabilities
+func (v *Vmess) Capabilities() C.Capabilities {
+	return v.Base.Capabilities() | C.CapUOT
+}
+
 func NewVmess(option VmessOption) (*Vmess, error) {
 	security := strings.ToLower(option.Cipher)
 	var options []vmess.ClientOption
@@ -453,6 +462,12 @@ func NewVmess(option VmessOption) (*Vmess, error) {
 			mpTcp:  option.MPTCP,
 			iface:  option.Interface,
 			rmark:  option.RoutingMark,
+			bport:  option.BindPort,
+			fdelay: option.FallbackDelay,
+			dtime:  option.DialTimeout,
+			uidle:  option.UDPIdleTimeout,
+			rdial:  option.ResolveEveryDial,
+			sopts:  option.SockOpts,
 			prefer: C.NewDNSPrefer(option.IPVersion),
 		},
 		client: client,
@@ -15,10 +15,23 @@ func ParseProxy(mapping map[string]any) (C.Proxy, error) {
 		return nil, fmt.Errorf("missing type")
 	}
 
-	var (
-		proxy outbound.ProxyAdapter
-		err   error
-	)
+	mapping, dialerProxies, err := outbound.SplitDialerProxyChain(mapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(dialerProxies) > 1 && proxyType != "hysteria" {
+		return nil, fmt.Errorf("a dialer-proxy chain is not supported by %s", proxyType)
+	}
+
+	basicOption := &outbound.BasicOption{}
+	if err := decoder.Decode(mapping, basicOption); err != nil {
+		return nil, err
+	}
+	if err := basicOption.ValidateSockOpts(); err != nil {
+		return nil, err
+	}
+
+	var proxy outbound.ProxyAdapter
 	switch proxyType {
 	case "ss":
 		ssOption := &outbound.ShadowSocksOption{}
@@ -88,6 +101,7 @@ func ParseProxy(mapping map[string]any) (C.Proxy, error) {
 		if err != nil {
 			break
 		}
+		hyOption.DialerProxies = dialerProxies
 		proxy, err = outbound.NewHysteria(*hyOption)
 	case "hysteria2":
 		hyOption := &outbound.Hysteria2Option{}
@@ -174,6 +188,14 @@ func ParseProxy(mapping map[string]any) (C.Proxy, error) {
 		}
 	}
 
+	if basicOption.RateLimit != "" {
+		bytesPerSecond := outbound.StringToBps(basicOption.RateLimit)
+		if bytesPerSecond == 0 {
+			return nil, fmt.Errorf("invalid rate-limit: %s", basicOption.RateLimit)
+		}
+		proxy = outbound.NewRateLimitedProxyAdapter(proxy, bytesPerSecond)
+	}
+
 	proxy = outbound.NewAutoCloseProxyAdapter(proxy)
 	return NewProxy(proxy), nil
 }
@@ -59,6 +59,7 @@ type proxyProviderSchema struct {
 	Type          string           `provider:"type"`
 	Path          string           `provider:"path,omitempty"`
 	URL           string           `provider:"url,omitempty"`
+	Mirrors       []string         `provider:"mirrors,omitempty"`
 	Proxy         string           `provider:"proxy,omitempty"`
 	Interval      int              `provider:"interval,omitempty"`
 	Filter        string           `provider:"filter,omitempty"`
@@ -66,6 +67,8 @@ type proxyProviderSchema struct {
 	ExcludeType   string           `provider:"exclude-type,omitempty"`
 	DialerProxy   string           `provider:"dialer-proxy,omitempty"`
 	SizeLimit     int64            `provider:"size-limit,omitempty"`
+	MemoryOnly    bool             `provider:"memory-only,omitempty"`
+	CacheDir      string           `provider:"cache-dir,omitempty"`
 	Payload       []map[string]any `provider:"payload,omitempty"`
 
 	HealthCheck healthCheckSchema   `provider:"health-check,omitempty"`
@@ -117,7 +120,18 @@ func ParseProxyProvider(name string, mapping map[string]any) (types.ProxyProvide
 				return nil, C.Path.ErrNotSafePath(path)
 			}
 		}
-		vehicle = resource.NewHTTPVehicle(schema.URL, path, schema.Proxy, schema.Header, resource.DefaultHttpTimeout, schema.SizeLimit)
+		httpVehicle := resource.NewHTTPVehicle(schema.URL, path, schema.Proxy, schema.Header, resource.DefaultHttpTimeout, schema.SizeLimit)
+		httpVehicle.SetDecompress(true)
+		httpVehicle.SetMirrors(schema.Mirrors)
+		httpVehicle.SetMemoryOnly(schema.MemoryOnly)
+		if schema.CacheDir != "" {
+			cacheDir := C.Path.Resolve(schema.CacheDir)
+			if !C.Path.IsSafePath(cacheDir) {
+				return nil, C.Path.ErrNotSafePath(cacheDir)
+			}
+			httpVehicle.SetCacheDir(cacheDir)
+		}
+		vehicle = httpVehicle
 	case "inline":
 		return NewInlineProvider(name, schema.Payload, parser, hc)
 	default:
@@ -134,8 +134,13 @@ func (pp *proxySetProvider) Name() string {
 	return pp.Fetcher.Name()
 }
 
+// Touch implements ProxyProvider, it is the health check touch and not Fetcher.Touch
+func (pp *proxySetProvider) Touch() {
+	pp.baseProvider.Touch()
+}
+
 func (pp *proxySetProvider) Update() error {
-	_, _, err := pp.Fetcher.Update()
+	_, _, err := pp.Fetcher.Refresh()
 	return err
 }
 
@@ -195,7 +200,7 @@ func NewProxySetProvider(name string, interval time.Duration, payload []map[stri
 		hc.setProxies(proxies)
 	}
 
-	fetcher := resource.NewFetcher[[]C.Proxy](name, interval, vehicle, parser, pd.setProxies)
+	fetcher := resource.NewFetcher[[]C.Proxy](name, interval, vehicle, parser, pd.setProxies, resource.WithResourceType[[]C.Proxy](types.Proxy.String()))
 	pd.Fetcher = fetcher
 	if httpVehicle, ok := vehicle.(*resource.HTTPVehicle); ok {
 		httpVehicle.SetInRead(func(resp *http.Response) {
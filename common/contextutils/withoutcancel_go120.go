@@ -0,0 +1,11 @@
+//go:build !go1.21
+
+package contextutils
+
+import (
+	"context"
+)
+
+func WithoutCancel(parent context.Context) context.Context {
+	return withoutCancel(parent)
+}
@@ -0,0 +1,29 @@
+package contextutils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithoutCancel(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Hour)
+	ctx := withoutCancel(parent)
+	cancel()
+	if parent.Err() == nil {
+		t.Fatalf("parent not canceled")
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("ctx.Err() = %v, want nil", err)
+	}
+	if ctx.Done() != nil {
+		t.Fatalf("ctx.Done() != nil")
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatalf("ctx has a deadline")
+	}
+	if v := ctx.Value(key{}); v != "value" {
+		t.Fatalf("ctx.Value(key) = %v, want value", v)
+	}
+}
@@ -41,6 +41,8 @@ func NeedHandshake(conn any) bool {
 
 type CountFunc = network.CountFunc
 
+var NewCounterConn = bufio.NewCounterConn
+
 var Pipe = deadline.Pipe
 
 // Relay copies between left and right bidirectionally.
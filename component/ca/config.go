@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
 )
 
 var globalCertPool *x509.CertPool
@@ -85,6 +88,9 @@ func GetCertPool(customCA string, customCAString string) (*x509.CertPool, error)
 		if !C.Path.IsSafePath(path) {
 			return nil, C.Path.ErrNotSafePath(path)
 		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return loadCertDir(path)
+		}
 		certificate, err = os.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("load ca error: %w", err)
@@ -103,6 +109,40 @@ func GetCertPool(customCA string, customCAString string) (*x509.CertPool, error)
 	}
 }
 
+// loadCertDir pools every .pem/.crt file in dir, skipping files that hold no certificate
+func loadCertDir(dir string) (*x509.CertPool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("load ca error: %w", err)
+	}
+	certPool := x509.NewCertPool()
+	loaded := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".pem", ".crt":
+		default:
+			log.Debugln("[CA] skip %s: not a .pem/.crt file", entry.Name())
+			continue
+		}
+		certificate, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("load ca error: %w", err)
+		}
+		if !certPool.AppendCertsFromPEM(certificate) {
+			log.Debugln("[CA] skip %s: no certificate found", entry.Name())
+			continue
+		}
+		loaded++
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", dir)
+	}
+	return certPool, nil
+}
+
 // GetTLSConfig specified fingerprint, customCA and customCAString
 func GetTLSConfig(tlsConfig *tls.Config, fingerprint string, customCA string, customCAString string) (_ *tls.Config, err error) {
 	if tlsConfig == nil {
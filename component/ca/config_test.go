@@ -0,0 +1,75 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	C "github.com/metacubex/mihomo/constant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCACert(t *testing.T, name string) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestGetCertPoolDir(t *testing.T) {
+	oldHome := C.Path.HomeDir()
+	defer C.SetHomeDir(oldHome)
+	home := t.TempDir()
+	C.SetHomeDir(home)
+
+	dir := filepath.Join(home, "certs")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested.pem"), 0o755))
+
+	pemCert, pemData := newTestCACert(t, "pem")
+	crtCert, crtData := newTestCACert(t, "crt")
+	txtCert, txtData := newTestCACert(t, "txt")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.pem"), pemData, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.CRT"), crtData, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c.txt"), txtData, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "junk.pem"), []byte("not a certificate"), 0o644))
+
+	pool, err := GetCertPool("certs", "")
+	require.NoError(t, err)
+
+	verify := func(cert *x509.Certificate) error {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: pool})
+		return err
+	}
+	assert.NoError(t, verify(pemCert))
+	assert.NoError(t, verify(crtCert))
+	assert.Error(t, verify(txtCert))
+
+	empty := filepath.Join(home, "empty")
+	require.NoError(t, os.Mkdir(empty, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(empty, "junk.crt"), []byte("junk"), 0o644))
+	_, err = GetCertPool("empty", "")
+	assert.Error(t, err)
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -37,6 +39,44 @@ func NewFingerprintVerifier(fingerprint string) (func(rawCerts [][]byte, verifie
 	}, nil
 }
 
+// NewPinSHA256Verifier returns a function that verifies whether the leaf certificate's public key (SPKI) matches one of the given base64 SHA-256 pins.
+// An empty pin list returns a nil verifier, which means no check.
+func NewPinSHA256Verifier(pins []string) (func(peerCertificates []*x509.Certificate) error, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	pinBytes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		pinByte, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+		if err != nil {
+			return nil, fmt.Errorf("pin-sha256 %s decode error: %w", pin, err)
+		}
+		if len(pinByte) != sha256.Size {
+			return nil, fmt.Errorf("pin-sha256 %s length error, need base64 sha256 hash", pin)
+		}
+		pinBytes = append(pinBytes, pinByte)
+	}
+
+	return func(peerCertificates []*x509.Certificate) error {
+		if len(peerCertificates) == 0 {
+			return errors.New("no peer certificate to check pin-sha256 against")
+		}
+		hash := sha256.Sum256(peerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pinByte := range pinBytes {
+			if bytes.Equal(pinByte, hash[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("server public key pin %s does not match pin-sha256", base64.StdEncoding.EncodeToString(hash[:]))
+	}, nil
+}
+
+// CalculatePinSHA256 computes the base64 SHA-256 pin of the given certificate's public key (SPKI).
+func CalculatePinSHA256(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
 // CalculateFingerprint computes the SHA-256 fingerprint of the given DER-encoded certificate and returns it as a hex string.
 func CalculateFingerprint(certDER []byte) string {
 	hash := sha256.Sum256(certDER)
@@ -100,3 +100,29 @@ func fallbackParseNetwork(network string, addr netip.Addr) string {
 	}
 	return network
 }
+
+// bindPortToDialer binds port with the address reused, so concurrent connections can
+// share it as long as their destinations differ, the kernel tells them apart by peer.
+// The unconnected sockets of ListenPacket can't be told apart, so they bind it without
+// reuse, only one of them holds the port at a time and the others fail with ErrorBindPortInUse
+func bindPortToDialer(port int, dialer *net.Dialer, network string) {
+	if strings.HasPrefix(network, "tcp") {
+		dialer.LocalAddr = &net.TCPAddr{Port: port}
+	} else if strings.HasPrefix(network, "udp") {
+		dialer.LocalAddr = &net.UDPAddr{Port: port}
+	} else {
+		return
+	}
+	addrReuseToDialer(dialer)
+}
+
+func bindPortToAddress(port int, address string) string {
+	host, localPort, err := net.SplitHostPort(address)
+	if err != nil {
+		host, localPort = address, "0"
+	}
+	if localPort != "0" && localPort != "" {
+		return address // the caller asked for a port already
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,76 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindPortConcurrentDial(t *testing.T) {
+	// pick a free local port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	servers := make([]net.Listener, 2)
+	for i := range servers {
+		servers[i], err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer servers[i].Close()
+	}
+
+	var wg sync.WaitGroup
+	conns := make([]net.Conn, len(servers))
+	errs := make([]error, len(servers))
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			conns[i], errs[i] = DialContext(context.Background(), "tcp", address, WithBindPort(port))
+		}(i, server.Addr().String())
+	}
+	wg.Wait()
+	for i := range servers {
+		require.NoError(t, errs[i])
+		defer conns[i].Close()
+		assert.Equal(t, port, conns[i].LocalAddr().(*net.TCPAddr).Port)
+	}
+}
+
+func TestBindPortConcurrentListenPacket(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	require.NoError(t, l.Close())
+
+	// unconnected udp sockets on one port would steal each other's replies, so only one
+	// session holds it and the other is told why
+	var wg sync.WaitGroup
+	pcs := make([]net.PacketConn, 2)
+	errs := make([]error, len(pcs))
+	for i := range pcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pcs[i], errs[i] = ListenPacket(context.Background(), "udp", "127.0.0.1:0", netip.MustParseAddrPort("127.0.0.1:53"), WithBindPort(port))
+		}(i)
+	}
+	wg.Wait()
+	held := 0
+	for i := range pcs {
+		if errs[i] != nil {
+			assert.ErrorIs(t, errs[i], ErrorBindPortInUse)
+			continue
+		}
+		defer pcs[i].Close()
+		assert.Equal(t, port, pcs[i].LocalAddr().(*net.UDPAddr).Port)
+		held++
+	}
+	assert.Equal(t, 1, held)
+}
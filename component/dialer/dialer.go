@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/metacubex/mihomo/component/keepalive"
@@ -65,6 +66,12 @@ func ListenPacket(ctx context.Context, network, address string, rAddrPort netip.
 	if opt.addrReuse {
 		addrReuseToListenConfig(lc)
 	}
+	if opt.bindPort != 0 {
+		address = bindPortToAddress(opt.bindPort, address)
+	}
+	if opt.sockOpts != nil {
+		bindSockOptsToListenConfig(*opt.sockOpts, lc)
+	}
 	if DefaultSocketHook != nil { // ignore interfaceName, routingMark when DefaultSocketHook not null (in CMFA)
 		socketHookToListenConfig(lc)
 	} else {
@@ -99,7 +106,17 @@ func ListenPacket(ctx context.Context, network, address string, rAddrPort netip.
 		}
 	}
 
-	return lc.ListenPacket(ctx, network, address)
+	if err := checkFDLimit(); err != nil {
+		return nil, err
+	}
+	pc, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		if opt.bindPort != 0 && errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("%w: %d", ErrorBindPortInUse, opt.bindPort)
+		}
+		return nil, err
+	}
+	return trackPacketConn(pc), nil
 }
 
 func SetTcpConcurrent(concurrent bool) {
@@ -136,12 +153,21 @@ func dialContext(ctx context.Context, network string, destination netip.Addr, po
 	default:
 		return netDialer.DialContext(ctx, network, address)
 	}
+	if err := checkFDLimit(); err != nil {
+		return nil, err
+	}
 
 	dialer := netDialer.(*net.Dialer)
 	keepalive.SetNetDialer(dialer)
 	if opt.mpTcp {
 		setMultiPathTCP(dialer)
 	}
+	if opt.bindPort != 0 {
+		bindPortToDialer(opt.bindPort, dialer, network)
+	}
+	if opt.sockOpts != nil {
+		bindSockOptsToDialer(*opt.sockOpts, dialer)
+	}
 
 	if DefaultSocketHook != nil { // ignore interfaceName, routingMark and tfo when DefaultSocketHook not null (in CMFA)
 		socketHookToToDialer(dialer)
@@ -170,11 +196,19 @@ func dialContext(ctx context.Context, network string, destination netip.Addr, po
 			bindMarkToDialer(opt.routingMark, dialer, network, destination)
 		}
 		if opt.tfo && !DisableTFO {
-			return dialTFO(ctx, *dialer, network, address)
+			conn, err := dialTFO(ctx, *dialer, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return trackConn(conn), nil
 		}
 	}
 
-	return dialer.DialContext(ctx, network, address)
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return trackConn(conn), nil
 }
 
 func serialSingleStackDialContext(ctx context.Context, network string, ips []netip.Addr, port string, opt option) (net.Conn, error) {
@@ -203,7 +237,11 @@ func dualStackDialContext(ctx context.Context, dialFn dialFunc, network string,
 	}
 
 	preferIPVersion := opt.prefer
-	fallbackTicker := time.NewTicker(fallbackTimeout)
+	fallbackDelay := fallbackTimeout
+	if opt.fallbackDelay > 0 {
+		fallbackDelay = opt.fallbackDelay
+	}
+	fallbackTicker := time.NewTicker(fallbackDelay)
 	defer fallbackTicker.Stop()
 
 	results := make(chan dialResult)
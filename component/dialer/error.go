@@ -7,4 +7,5 @@ import (
 var (
 	ErrorNoIpAddress           = errors.New("no ip address")
 	ErrorInvalidedNetworkStack = errors.New("invalided network stack")
+	ErrorBindPortInUse         = errors.New("bind-port is held by another udp session")
 )
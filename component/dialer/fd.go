@@ -0,0 +1,191 @@
+package dialer
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/metacubex/mihomo/common/atomic"
+	"github.com/metacubex/mihomo/common/net/packet"
+)
+
+var ErrFDLimit = errors.New("outbound file descriptor limit reached")
+
+var (
+	fdUsage = atomic.NewInt64(0)
+	fdLimit = atomic.NewInt64(0)
+)
+
+// FDUsage returns the number of sockets currently opened by the dialer
+func FDUsage() int64 {
+	return fdUsage.Load()
+}
+
+// FDLimit returns the soft cap of outbound sockets, 0 means unlimited
+func FDLimit() int64 {
+	return fdLimit.Load()
+}
+
+// SetFDLimit sets a soft cap of outbound sockets, new dials will fail with ErrFDLimit
+// once FDUsage reaches it, so we can give up before hitting the OS hard limit
+func SetFDLimit(limit int64) {
+	if limit < 0 {
+		limit = 0
+	}
+	fdLimit.Store(limit)
+}
+
+func checkFDLimit() error {
+	if limit := fdLimit.Load(); limit > 0 && fdUsage.Load() >= limit {
+		return ErrFDLimit
+	}
+	return nil
+}
+
+// fdRef counts one socket in FDUsage until release is called, release is idempotent
+type fdRef struct {
+	once sync.Once
+}
+
+func newFDRef() *fdRef {
+	fdUsage.Add(1)
+	return &fdRef{}
+}
+
+func (r *fdRef) release() {
+	r.once.Do(func() {
+		fdUsage.Add(-1)
+	})
+}
+
+type fdTCPConn struct {
+	*net.TCPConn // keep ReadFrom, CloseWrite and friends available
+	ref          *fdRef
+}
+
+func (c *fdTCPConn) Close() error {
+	c.ref.release()
+	return c.TCPConn.Close()
+}
+
+func (c *fdTCPConn) Upstream() any {
+	return c.TCPConn
+}
+
+func (c *fdTCPConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *fdTCPConn) WriterReplaceable() bool {
+	return true
+}
+
+type fdConn struct {
+	net.Conn
+	ref *fdRef
+}
+
+func (c *fdConn) Close() error {
+	c.ref.release()
+	return c.Conn.Close()
+}
+
+func (c *fdConn) Upstream() any {
+	return c.Conn
+}
+
+func (c *fdConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *fdConn) WriterReplaceable() bool {
+	return true
+}
+
+type fdUDPConn struct {
+	*net.UDPConn // keep quic-go's OOB optimizations available
+	enhance      packet.EnhancePacketConn
+	ref          *fdRef
+}
+
+// WaitReadFrom keeps the raw socket path of packet.NewEnhancePacketConn, which only takes a
+// buffer from the pool once a packet has arrived
+func (c *fdUDPConn) WaitReadFrom() (data []byte, put func(), addr net.Addr, err error) {
+	return c.enhance.WaitReadFrom()
+}
+
+func (c *fdUDPConn) Close() error {
+	c.ref.release()
+	return c.UDPConn.Close()
+}
+
+func (c *fdUDPConn) Upstream() any {
+	return c.UDPConn
+}
+
+func (c *fdUDPConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *fdUDPConn) WriterReplaceable() bool {
+	return true
+}
+
+type fdPacketConn struct {
+	net.PacketConn
+	ref *fdRef
+}
+
+func (c *fdPacketConn) Close() error {
+	c.ref.release()
+	return c.PacketConn.Close()
+}
+
+func (c *fdPacketConn) Upstream() any {
+	return c.PacketConn
+}
+
+func (c *fdPacketConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *fdPacketConn) WriterReplaceable() bool {
+	return true
+}
+
+// trackConn counts a socket the dialer just opened, the count is also released when the conn
+// is garbage collected without being closed, like the fd itself. The finalizer is set on the
+// *net.TCPConn, which holds the fd, so a consumer unwrapping it keeps the count. Other conns
+// can't take a finalizer safely, theirs is on the wrapper.
+func trackConn(c net.Conn) net.Conn {
+	ref := newFDRef()
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		runtime.SetFinalizer(tcpConn, func(any) { ref.release() })
+		return &fdTCPConn{TCPConn: tcpConn, ref: ref}
+	}
+	wrapper := &fdConn{Conn: c, ref: ref}
+	runtime.SetFinalizer(wrapper, func(any) { ref.release() })
+	return wrapper
+}
+
+// trackPacketConn is like trackConn for packet conns
+func trackPacketConn(pc net.PacketConn) net.PacketConn {
+	ref := newFDRef()
+	if udpConn, ok := pc.(*net.UDPConn); ok {
+		runtime.SetFinalizer(udpConn, func(any) { ref.release() })
+		return &fdUDPConn{UDPConn: udpConn, enhance: packet.NewEnhancePacketConn(udpConn), ref: ref}
+	}
+	wrapper := &fdPacketConn{PacketConn: pc, ref: ref}
+	runtime.SetFinalizer(wrapper, func(any) { ref.release() })
+	return wrapper
+}
+
+// IsSystemPacketConn reports whether pc is an OS udp socket opened by the dialer
+func IsSystemPacketConn(pc net.PacketConn) bool {
+	switch pc.(type) {
+	case *net.UDPConn, *fdUDPConn:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/common/net/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFDLimit(t *testing.T) {
+	defer SetFDLimit(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	rAddrPort := netip.MustParseAddrPort("127.0.0.1:53")
+	usage := FDUsage()
+
+	conn, err := DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	assert.IsType(t, &fdTCPConn{}, conn)
+	assert.Equal(t, usage+1, FDUsage())
+
+	pc, err := ListenPacket(context.Background(), "udp", "", rAddrPort)
+	require.NoError(t, err)
+	assert.True(t, IsSystemPacketConn(pc))
+	assert.Equal(t, usage+2, FDUsage())
+
+	SetFDLimit(usage + 2)
+	_, err = DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorIs(t, err, ErrFDLimit)
+	_, err = ListenPacket(context.Background(), "udp", "", rAddrPort)
+	assert.ErrorIs(t, err, ErrFDLimit)
+
+	require.NoError(t, conn.Close())
+	_ = conn.Close() // double close must not release twice
+	assert.Equal(t, usage+1, FDUsage())
+	conn, err = DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, pc.Close())
+	assert.Equal(t, usage, FDUsage())
+}
+
+func TestFDLeakedConn(t *testing.T) {
+	usage := FDUsage()
+	func() {
+		_, err := ListenPacket(context.Background(), "udp", "", netip.MustParseAddrPort("127.0.0.1:53"))
+		require.NoError(t, err)
+	}()
+	assert.Equal(t, usage+1, FDUsage())
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return FDUsage() == usage
+	}, time.Second, 10*time.Millisecond, "a conn dropped without Close must be released once collected")
+}
+
+func TestFDPacketConnFastPath(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	pc, err := ListenPacket(context.Background(), "udp", "", netip.MustParseAddrPort("127.0.0.1:53"))
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// the conn is enhanced as is, not by the generic path taking a buffer before every read
+	epc := packet.NewEnhancePacketConn(pc)
+	assert.Same(t, pc.(*fdUDPConn), epc.(*fdUDPConn))
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	_, err = server.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	require.NoError(t, err)
+	data, put, addr, err := epc.WaitReadFrom()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, server.LocalAddr().(*net.UDPAddr).Port, addr.(*net.UDPAddr).Port)
+	put()
+}
+
+func TestFDUnwrappedConn(t *testing.T) {
+	usage := FDUsage()
+	pc, err := ListenPacket(context.Background(), "udp", "", netip.MustParseAddrPort("127.0.0.1:53"))
+	require.NoError(t, err)
+	udpConn := pc.(interface{ Upstream() any }).Upstream().(*net.UDPConn)
+	pc = nil
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, usage+1, FDUsage(), "the count lives as long as the fd, not the wrapper")
+	require.NoError(t, udpConn.Close())
+	udpConn = nil
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return FDUsage() == usage
+	}, time.Second, 10*time.Millisecond)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"time"
 
 	"github.com/metacubex/mihomo/common/atomic"
 	"github.com/metacubex/mihomo/component/resolver"
@@ -29,6 +30,9 @@ type option struct {
 	fallbackBind  bool
 	addrReuse     bool
 	routingMark   int
+	bindPort      int
+	fallbackDelay time.Duration
+	sockOpts      *[]SockOpt
 	network       int
 	prefer        int
 	tfo           bool
@@ -63,12 +67,35 @@ func WithRoutingMark(mark int) Option {
 	}
 }
 
+func WithBindPort(port int) Option {
+	return func(opt *option) {
+		opt.bindPort = port
+	}
+}
+
+func WithFallbackDelay(delay time.Duration) Option {
+	return func(opt *option) {
+		opt.fallbackDelay = delay
+	}
+}
+
 func WithResolver(r resolver.Resolver) Option {
 	return func(opt *option) {
 		opt.resolver = r
 	}
 }
 
+func WithSockOpt(sockOpts ...SockOpt) Option {
+	return func(opt *option) {
+		var merged []SockOpt
+		if opt.sockOpts != nil {
+			merged = append(merged, *opt.sockOpts...)
+		}
+		merged = append(merged, sockOpts...)
+		opt.sockOpts = &merged
+	}
+}
+
 func WithPreferIPv4() Option {
 	return func(opt *option) {
 		opt.prefer = 4
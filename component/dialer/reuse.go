@@ -8,6 +8,12 @@ import (
 	"github.com/metacubex/mihomo/common/sockopt"
 )
 
+func addrReuseToDialer(d *net.Dialer) {
+	addControlToDialer(d, func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		return sockopt.RawConnReuseaddr(c)
+	})
+}
+
 func addrReuseToListenConfig(lc *net.ListenConfig) {
 	addControlToListenConfig(lc, func(ctx context.Context, network, address string, c syscall.RawConn) error {
 		return sockopt.RawConnReuseaddr(c)
@@ -0,0 +1,74 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SockOpt is an integer socket option applied to outbound sockets before connect
+type SockOpt struct {
+	Level int
+	Name  int
+	Value int
+}
+
+// ParseSockOpt parses a spec like "SO_SNDBUF=1048576"
+func ParseSockOpt(spec string) (SockOpt, error) {
+	name, value, found := strings.Cut(spec, "=")
+	if !found {
+		return SockOpt{}, fmt.Errorf("invalid socket option %q: missing value", spec)
+	}
+	name = strings.ToUpper(strings.TrimSpace(name))
+	opt, ok := sockOptNames[name]
+	if !ok {
+		return SockOpt{}, fmt.Errorf("invalid socket option %q: unsupported name %s", spec, name)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return SockOpt{}, fmt.Errorf("invalid socket option %q: %w", spec, err)
+	}
+	opt.Value = v
+	return opt, nil
+}
+
+// ParseSockOpts parses every spec, failing on the first invalid one
+func ParseSockOpts(specs []string) ([]SockOpt, error) {
+	sockOpts := make([]SockOpt, 0, len(specs))
+	for _, spec := range specs {
+		sockOpt, err := ParseSockOpt(spec)
+		if err != nil {
+			return nil, err
+		}
+		sockOpts = append(sockOpts, sockOpt)
+	}
+	return sockOpts, nil
+}
+
+func bindSockOptsToDialer(sockOpts []SockOpt, dialer *net.Dialer) {
+	addControlToDialer(dialer, bindSockOptsToControl(sockOpts))
+}
+
+func bindSockOptsToListenConfig(sockOpts []SockOpt, lc *net.ListenConfig) {
+	addControlToListenConfig(lc, bindSockOptsToControl(sockOpts))
+}
+
+func bindSockOptsToControl(sockOpts []SockOpt) controlFn {
+	return func(ctx context.Context, network, address string, c syscall.RawConn) (err error) {
+		var innerErr error
+		err = c.Control(func(fd uintptr) {
+			for _, sockOpt := range sockOpts {
+				if innerErr = setSockOpt(fd, sockOpt); innerErr != nil {
+					return
+				}
+			}
+		})
+		if innerErr != nil {
+			err = innerErr
+		}
+		return
+	}
+}
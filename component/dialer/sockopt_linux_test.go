@@ -0,0 +1,56 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getSockOptInt(t *testing.T, c syscall.Conn, level, name int) int {
+	rawConn, err := c.SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var innerErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		value, innerErr = syscall.GetsockoptInt(int(fd), level, name)
+	}))
+	require.NoError(t, innerErr)
+	return value
+}
+
+func TestSockOptDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	sockOpt, err := ParseSockOpt("SO_RCVBUF=65536")
+	require.NoError(t, err)
+
+	c, err := DialContext(context.Background(), "tcp", ln.Addr().String(), WithSockOpt(sockOpt))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the kernel doubles the requested size to leave room for bookkeeping
+	assert.Equal(t, 2*65536, getSockOptInt(t, c.(syscall.Conn), syscall.SOL_SOCKET, syscall.SO_RCVBUF))
+}
+
+func TestSockOptListenPacket(t *testing.T) {
+	sockOpt, err := ParseSockOpt("SO_SNDBUF=65536")
+	require.NoError(t, err)
+
+	pc, err := ListenPacket(context.Background(), "udp", "127.0.0.1:0", netip.MustParseAddrPort("127.0.0.1:53"), WithSockOpt(sockOpt))
+	require.NoError(t, err)
+	defer pc.Close()
+
+	assert.Equal(t, 2*65536, getSockOptInt(t, pc.(syscall.Conn), syscall.SOL_SOCKET, syscall.SO_SNDBUF))
+}
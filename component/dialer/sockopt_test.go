@@ -0,0 +1,43 @@
+package dialer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSockOpt(t *testing.T) {
+	sockOpt, err := ParseSockOpt("SO_SNDBUF=1048576")
+	require.NoError(t, err)
+	assert.Equal(t, sockOptNames["SO_SNDBUF"].Level, sockOpt.Level)
+	assert.Equal(t, sockOptNames["SO_SNDBUF"].Name, sockOpt.Name)
+	assert.Equal(t, 1048576, sockOpt.Value)
+
+	sockOpt, err = ParseSockOpt(" tcp_nodelay = 1 ")
+	require.NoError(t, err)
+	assert.Equal(t, sockOptNames["TCP_NODELAY"].Name, sockOpt.Name)
+	assert.Equal(t, 1, sockOpt.Value)
+
+	for _, spec := range []string{"", "SO_SNDBUF", "SO_SNDBUF=", "SO_SNDBUF=big", "SO_UNKNOWN=1"} {
+		_, err = ParseSockOpt(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseSockOpts(t *testing.T) {
+	sockOpts, err := ParseSockOpts([]string{"SO_SNDBUF=1024", "SO_RCVBUF=2048"})
+	require.NoError(t, err)
+	assert.Len(t, sockOpts, 2)
+
+	_, err = ParseSockOpts([]string{"SO_SNDBUF=1024", "bogus"})
+	assert.Error(t, err)
+}
+
+func TestWithSockOpt(t *testing.T) {
+	assert.True(t, IsZeroOptions(nil))
+
+	opt := applyOptions(WithSockOpt(SockOpt{Value: 1}), WithSockOpt(SockOpt{Value: 2}))
+	require.NotNil(t, opt.sockOpts)
+	assert.Equal(t, []SockOpt{{Value: 1}, {Value: 2}}, *opt.sockOpts)
+}
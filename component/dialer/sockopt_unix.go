@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package dialer
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+var sockOptNames = map[string]SockOpt{
+	"SO_SNDBUF":    {Level: unix.SOL_SOCKET, Name: unix.SO_SNDBUF},
+	"SO_RCVBUF":    {Level: unix.SOL_SOCKET, Name: unix.SO_RCVBUF},
+	"SO_KEEPALIVE": {Level: unix.SOL_SOCKET, Name: unix.SO_KEEPALIVE},
+	"TCP_NODELAY":  {Level: unix.IPPROTO_TCP, Name: unix.TCP_NODELAY},
+}
+
+func setSockOpt(fd uintptr, sockOpt SockOpt) error {
+	return unix.SetsockoptInt(int(fd), sockOpt.Level, sockOpt.Name, sockOpt.Value)
+}
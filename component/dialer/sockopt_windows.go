@@ -0,0 +1,16 @@
+package dialer
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+var sockOptNames = map[string]SockOpt{
+	"SO_SNDBUF":    {Level: windows.SOL_SOCKET, Name: windows.SO_SNDBUF},
+	"SO_RCVBUF":    {Level: windows.SOL_SOCKET, Name: windows.SO_RCVBUF},
+	"SO_KEEPALIVE": {Level: windows.SOL_SOCKET, Name: windows.SO_KEEPALIVE},
+	"TCP_NODELAY":  {Level: windows.IPPROTO_TCP, Name: windows.TCP_NODELAY},
+}
+
+func setSockOpt(fd uintptr, sockOpt SockOpt) error {
+	return windows.SetsockoptInt(windows.Handle(fd), sockOpt.Level, sockOpt.Name, sockOpt.Value)
+}
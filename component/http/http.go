@@ -13,6 +13,7 @@ import (
 
 	"github.com/metacubex/mihomo/component/ca"
 	"github.com/metacubex/mihomo/component/dialer"
+	C "github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/listener/inner"
 )
 
@@ -33,6 +34,22 @@ func HttpRequest(ctx context.Context, url, method string, header map[string][]st
 }
 
 func HttpRequestWithProxy(ctx context.Context, url, method string, header map[string][]string, body io.Reader, specialProxy string) (*http.Response, error) {
+	return httpRequest(ctx, url, method, header, body, func(ctx context.Context, network, address string) (net.Conn, error) {
+		if conn, err := inner.HandleTcp(inner.GetTunnel(), address, specialProxy); err == nil {
+			return conn, nil
+		} else {
+			return dialer.DialContext(ctx, network, address)
+		}
+	})
+}
+
+// HttpRequestWithDialer is HttpRequest with every connection dialed by d, there is no
+// fallback to a direct connection when d fails
+func HttpRequestWithDialer(ctx context.Context, url, method string, header map[string][]string, body io.Reader, d C.Dialer) (*http.Response, error) {
+	return httpRequest(ctx, url, method, header, body, d.DialContext)
+}
+
+func httpRequest(ctx context.Context, url, method string, header map[string][]string, body io.Reader, dialContext func(ctx context.Context, network, address string) (net.Conn, error)) (*http.Response, error) {
 	method = strings.ToUpper(method)
 	urlRes, err := URL.Parse(url)
 	if err != nil {
@@ -54,6 +71,12 @@ func HttpRequestWithProxy(ctx context.Context, url, method string, header map[st
 		return nil, err
 	}
 
+	// net/http ignores Host in req.Header, the override has to go to req.Host
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
 	if user := urlRes.User; user != nil {
 		password, _ := user.Password()
 		req.SetBasicAuth(user.Username(), password)
@@ -68,14 +91,8 @@ func HttpRequestWithProxy(ctx context.Context, url, method string, header map[st
 		IdleConnTimeout:       30 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-			if conn, err := inner.HandleTcp(inner.GetTunnel(), address, specialProxy); err == nil {
-				return conn, nil
-			} else {
-				return dialer.DialContext(ctx, network, address)
-			}
-		},
-		TLSClientConfig: ca.GetGlobalTLSConfig(&tls.Config{}),
+		DialContext:           dialContext,
+		TLSClientConfig:       ca.GetGlobalTLSConfig(&tls.Config{}),
 	}
 
 	client := http.Client{Transport: transport}
@@ -32,6 +32,33 @@ func NewByName(proxyName string, dialer C.Dialer) (C.Dialer, error) {
 	return nil, fmt.Errorf("proxyName[%s] not found", proxyName)
 }
 
+type lazyDialer struct {
+	proxyName string
+	dialer    C.Dialer
+}
+
+// NewLazyByName is NewByName looking the proxy up on every dial, for dialers created
+// before the proxies are loaded. Dials fail while proxyName is not found.
+func NewLazyByName(proxyName string, dialer C.Dialer) C.Dialer {
+	return lazyDialer{proxyName: proxyName, dialer: dialer}
+}
+
+func (l lazyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, err := NewByName(l.proxyName, l.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+func (l lazyDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	d, err := NewByName(l.proxyName, l.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return d.ListenPacket(ctx, network, address, rAddrPort)
+}
+
 func (p proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	currentMeta := &C.Metadata{Type: C.INNER}
 	if err := currentMeta.SetRemoteAddress(address); err != nil {
@@ -0,0 +1,19 @@
+package resolver
+
+import "context"
+
+type contextKey string
+
+var ctxKeyBypassCache = contextKey("bypass cache")
+
+// WithBypassCache returns a ctx whose lookups skip reading the dns cache, the
+// fresh answer is still cached for everyone else
+func WithBypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyBypassCache, true)
+}
+
+// BypassCache reports whether lookups with ctx should skip reading the dns cache
+func BypassCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(ctxKeyBypassCache).(bool)
+	return bypass
+}
@@ -2,7 +2,12 @@ package resource
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,25 +17,245 @@ import (
 	"github.com/metacubex/mihomo/log"
 
 	"github.com/metacubex/fswatch"
+	"github.com/metacubex/randv2"
 	"github.com/samber/lo"
 )
 
 type Parser[V any] func([]byte) (V, error)
 
+// ParserCtx is a Parser which is passed the fetcher's context, cancelled on Close
+type ParserCtx[V any] func(ctx context.Context, buf []byte) (V, error)
+
+func (p Parser[V]) withContext() ParserCtx[V] {
+	if p == nil {
+		return nil
+	}
+	return func(_ context.Context, buf []byte) (V, error) {
+		return p(buf)
+	}
+}
+
+type FetcherOption[V any] func(f *Fetcher[V])
+
+// WithFallbackParser sets a parser to try when the primary one fails,
+// the parser that succeeds is tried first next time
+func WithFallbackParser[V any](parser Parser[V]) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.fallbackParser = parser.withContext()
+	}
+}
+
+// WithParserCtx replaces the parser passed to NewFetcher with one that can
+// abort when the fetcher is closed
+func WithParserCtx[V any](parser ParserCtx[V]) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.parser = parser
+	}
+}
+
+// WithExpectedHash sets the hex SHA-256 checksum the content must match before
+// it is parsed, an empty hash disables the check
+func WithExpectedHash[V any](hash string) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.expectedHash = strings.ToLower(strings.TrimSpace(hash))
+	}
+}
+
+// WithTransform sets a stage run on the content between read and parse, e.g. to
+// strip an envelope. The hash and the file on disk are of the raw content
+func WithTransform[V any](transform func([]byte) ([]byte, error)) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.transform = transform
+	}
+}
+
+// WithResourceType tags the log lines of the fetcher with what it fetches, e.g. Rule
+func WithResourceType[V any](resourceType string) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.resourceType = resourceType
+	}
+}
+
+// WithMinBackoff overrides the 10s floor of the retry backoff after a failed
+// update, it is still clamped to the update interval
+func WithMinBackoff[V any](d time.Duration) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		if d <= 0 {
+			return
+		}
+		if d > f.interval {
+			d = f.interval
+		}
+		f.backoff.Min = d
+	}
+}
+
+// WithRetryCeiling caps the retry backoff after a failed update independently of
+// the update interval, so a provider updated daily still retries reasonably often
+func WithRetryCeiling[V any](d time.Duration) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		if d > 0 {
+			f.retryCeiling = d
+		}
+	}
+}
+
+// WithBackoffJitter randomizes the retry backoff and the first pull, so
+// providers sharing an interval don't retry in lockstep
+func WithBackoffJitter[V any](jitter bool) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.backoff.Jitter = jitter
+	}
+}
+
+// WithOnStale sets a callback fired from the pull loop once the content has not
+// been updated for factor times the interval, once per stale episode
+func WithOnStale[V any](factor float64, onStale func()) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.staleFactor = factor
+		f.onStale = onStale
+	}
+}
+
+// WithOnError sets a callback receiving the errors of the updates run by the pull
+// loop, file watch reloads and Refresh, in addition to logging them. It is called
+// on a goroutine of its own so a slow callback never delays the pull loop, which
+// also means calls may arrive out of order.
+func WithOnError[V any](onError func(error)) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.onError = onError
+	}
+}
+
+// Bounds applied to a provider suggested interval when WithIntervalHint is given none
+const (
+	DefaultIntervalHintMin = time.Minute
+	DefaultIntervalHintMax = 7 * 24 * time.Hour
+)
+
+// WithIntervalHint lets the parsed contents suggest the update interval, e.g. from an
+// "# interval: 3600" comment in the payload. After every successful parse a suggestion
+// clamped to [minInterval, maxInterval] replaces the interval as SetInterval would, 0 bounds fall back
+// to DefaultIntervalHintMin and DefaultIntervalHintMax.
+func WithIntervalHint[V any](hint func(V) (time.Duration, bool), minInterval, maxInterval time.Duration) FetcherOption[V] {
+	if minInterval <= 0 {
+		minInterval = DefaultIntervalHintMin
+	}
+	if maxInterval <= 0 {
+		maxInterval = DefaultIntervalHintMax
+	}
+	return func(f *Fetcher[V]) {
+		f.intervalHint = hint
+		f.intervalHintMin = minInterval
+		f.intervalHintMax = maxInterval
+	}
+}
+
+// WithAllowEmpty lets a download of zero bytes through to the parser. By default it is
+// taken for a flaky server and fails with ErrEmptyContent, keeping the previous contents
+func WithAllowEmpty[V any](allow bool) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.allowEmpty = allow
+	}
+}
+
+// WithFailOpen makes Initial succeed with empty contents when neither the local file nor
+// the remote could be loaded, leaving it to the pull loop to retry. By default Initial
+// fails closed and returns the error so the provider doesn't start.
+func WithFailOpen[V any](failOpen bool) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.failOpen = failOpen
+	}
+}
+
+// WithAdaptiveInterval polls rarely changing content less often: after unchanged updates in a
+// row found nothing new the interval is multiplied by factor, up to maxInterval, and it drops back
+// to the configured interval as soon as an update brings a change
+func WithAdaptiveInterval[V any](unchanged int, factor float64, maxInterval time.Duration) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		if unchanged <= 0 || factor <= 1 {
+			return
+		}
+		f.adaptiveAfter = unchanged
+		f.adaptiveFactor = factor
+		f.adaptiveMax = maxInterval
+	}
+}
+
+// UpdateMeta describes what changed in an update
+type UpdateMeta struct {
+	OldHash   utils.HashType
+	NewHash   utils.HashType
+	SizeDelta int // new size minus old size, in bytes
+	UpdatedAt time.Time
+}
+
+// WithDetailedUpdate sets a callback receiving the previous contents along with
+// the new ones, the previous contents are only retained when it is set
+func WithDetailedUpdate[V any](onUpdateDetailed func(old, new V, meta UpdateMeta)) FetcherOption[V] {
+	return func(f *Fetcher[V]) {
+		f.onUpdateDetailed = onUpdateDetailed
+	}
+}
+
 type Fetcher[V any] struct {
-	ctx          context.Context
-	ctxCancel    context.CancelFunc
-	resourceType string
-	name         string
-	vehicle      types.Vehicle
-	updatedAt    time.Time
-	hash         utils.HashType
-	parser       Parser[V]
-	interval     time.Duration
-	onUpdate     func(V)
-	watcher      *fswatch.Watcher
-	loadBufMutex sync.Mutex
-	backoff      slowdown.Backoff
+	ctx            context.Context
+	ctxCancel      context.CancelFunc
+	resourceType   string
+	name           string
+	vehicle        types.Vehicle
+	updatedAt      time.Time
+	hash           utils.HashType
+	parser         ParserCtx[V]
+	fallbackParser ParserCtx[V]
+	expectedHash   string
+	allowEmpty     bool
+	failOpen       bool
+	transform      func([]byte) ([]byte, error)
+	interval       time.Duration // guarded by loadBufMutex
+	onUpdate       func(V)
+	watcher        *fswatch.Watcher
+	loadBufMutex   sync.Mutex
+	updateMutex    sync.Mutex // serializes Refresh with the pull loop
+	reloadAccess   sync.Mutex
+	reloadTimer    *time.Timer
+	reloadDelay    time.Duration // debounces file watch events
+	staleFactor    float64
+	onStale        func()
+	onError        func(error)
+	staleFired     bool      // only accessed by the pull loop
+	retryAt        time.Time // guarded by loadBufMutex, set from a RetryAfterError
+	started        bool      // guarded by loadBufMutex, startPullLoop was called
+	pulling        bool      // guarded by loadBufMutex, pullLoop is running
+	intervalCh     chan struct{}
+	backoff        slowdown.Backoff
+	retryCeiling   time.Duration
+
+	onUpdateDetailed func(old, new V, meta UpdateMeta)
+	contents         V   // only retained for onUpdateDetailed
+	size             int // guarded by loadBufMutex
+
+	raw []byte // guarded by loadBufMutex, kept for Reload when the vehicle has no local file
+
+	intervalHint                     func(V) (time.Duration, bool)
+	intervalHintMin, intervalHintMax time.Duration
+
+	adaptiveAfter  int
+	adaptiveFactor float64
+	adaptiveMax    time.Duration
+	unchanged      int           // guarded by loadBufMutex, unchanged updates in a row
+	baseInterval   time.Duration // guarded by loadBufMutex, the interval before it was stretched, 0 if it isn't
+
+	group *FetcherGroup // set by FetcherGroup.Register before the fetcher starts
+
+	subscribeAccess sync.Mutex
+	subscribers     map[<-chan V]chan V
+	unsubscribed    bool // Close has closed every subscriber
+
+	// guarded by loadBufMutex
+	failureCount int
+	lastError    error
+	lastSuccess  time.Time
 }
 
 func (f *Fetcher[V]) Name() string {
@@ -45,24 +270,207 @@ func (f *Fetcher[V]) VehicleType() types.VehicleType {
 	return f.vehicle.Type()
 }
 
+// logPrefix is the common prefix of the fetcher log lines, tagged with the
+// resource and vehicle type, e.g. "[Provider] [Rule/HTTP] name"
+func (f *Fetcher[V]) logPrefix() string {
+	if f.resourceType == "" {
+		return fmt.Sprintf("[Provider] [%s] %s", f.VehicleType(), f.name)
+	}
+	return fmt.Sprintf("[Provider] [%s/%s] %s", f.resourceType, f.VehicleType(), f.name)
+}
+
 func (f *Fetcher[V]) UpdatedAt() time.Time {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
 	return f.updatedAt
 }
 
+// FailureCount returns the number of consecutive failed updates
+func (f *Fetcher[V]) FailureCount() int {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	return f.failureCount
+}
+
+// LastError returns the error of the last update, nil once an update succeeds
+func (f *Fetcher[V]) LastError() error {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	return f.lastError
+}
+
+// LastSuccess returns the time of the last successful update, zero if never
+func (f *Fetcher[V]) LastSuccess() time.Time {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	return f.lastSuccess
+}
+
+// ContentHash returns the hex hash of the loaded content, empty if nothing loaded
+func (f *Fetcher[V]) ContentHash() string {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	if !f.hash.IsValid() {
+		return ""
+	}
+	return f.hash.String()
+}
+
+// ContentSize returns the size in bytes of the loaded content
+func (f *Fetcher[V]) ContentSize() int {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	return f.size
+}
+
+// recordFailure must be called with loadBufMutex held
+func (f *Fetcher[V]) recordFailure(err error) {
+	f.failureCount++
+	f.lastError = err
+}
+
+// recordSuccess must be called with loadBufMutex held
+func (f *Fetcher[V]) recordSuccess(now time.Time) {
+	f.failureCount = 0
+	f.lastError = nil
+	f.lastSuccess = now
+}
+
+// Interval returns the current update interval
+func (f *Fetcher[V]) Interval() time.Duration {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	return f.interval
+}
+
+// SetInterval changes the update interval at runtime, the running pull loop is
+// rescheduled from the last update. 0 stops periodic pulls, file watching is
+// unaffected
+func (f *Fetcher[V]) SetInterval(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	f.unchanged, f.baseInterval = 0, 0
+	f.setIntervalLocked(d)
+}
+
+// setIntervalLocked is SetInterval with loadBufMutex held
+func (f *Fetcher[V]) setIntervalLocked(d time.Duration) {
+	f.interval = d
+	if d > 0 {
+		f.backoff.Max = d
+		if f.backoff.Min > d {
+			f.backoff.Min = d
+		}
+	}
+	if f.pulling {
+		select {
+		case f.intervalCh <- struct{}{}:
+		default: // a change is already pending, the loop reads the latest interval
+		}
+	} else if f.started && d > 0 && f.vehicle.Type() != types.File && f.ctx.Err() == nil {
+		f.pulling = true
+		go f.pullLoop(false)
+	}
+}
+
+// untilNextPull returns the time left until interval has passed since the last update
+func (f *Fetcher[V]) untilNextPull() time.Duration {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	next := f.interval - time.Since(f.updatedAt)
+	if next > f.interval {
+		next = f.interval
+	}
+	return next
+}
+
+// IsStale reports whether the content has not been updated for factor times the
+// interval, never when there is no interval
+func (f *Fetcher[V]) IsStale(factor float64) bool {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	if f.interval <= 0 {
+		return false
+	}
+	return time.Since(f.updatedAt) > time.Duration(factor*float64(f.interval))
+}
+
+// Touch marks the content as current without downloading it, for when it was checked
+// by other means: updatedAt and the mtime of the local file are set to now, so the
+// content is no longer stale, a restart does not force a refresh and the running pull
+// loop waits a full interval again. The hash and the content are left as they are.
+func (f *Fetcher[V]) Touch() {
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+	now := time.Now()
+	if path := f.vehicle.Path(); path != "" {
+		_ = os.Chtimes(path, now, now)
+	}
+	f.updatedAt = now
+	if f.pulling {
+		select {
+		case f.intervalCh <- struct{}{}:
+		default: // a reschedule is already pending, the loop reads the latest updatedAt
+		}
+	}
+}
+
+func (f *Fetcher[V]) checkStale() {
+	if f.onStale == nil {
+		return
+	}
+	if !f.IsStale(f.staleFactor) {
+		f.staleFired = false
+		return
+	}
+	if !f.staleFired {
+		f.staleFired = true
+		log.Warnln("%s not updated since %s", f.logPrefix(), f.UpdatedAt())
+		f.onStale()
+	}
+}
+
+// localPath returns the local file to load first, the vehicle's seed path while
+// the cache at Path has no copy yet
+func (f *Fetcher[V]) localPath() string {
+	path := f.vehicle.Path()
+	if seedVehicle, ok := f.vehicle.(interface{ SeedPath() string }); ok && path != "" {
+		if _, err := os.Stat(path); err != nil {
+			if seed := seedVehicle.SeedPath(); seed != "" {
+				return seed
+			}
+		}
+	}
+	return path
+}
+
 func (f *Fetcher[V]) Initial() (V, error) {
-	if stat, fErr := os.Stat(f.vehicle.Path()); fErr == nil {
-		// local file exists, use it first
-		buf, err := os.ReadFile(f.vehicle.Path())
-		modTime := stat.ModTime()
-		contents, _, err := f.loadBuf(buf, utils.MakeHash(buf), false)
-		f.updatedAt = modTime // reset updatedAt to file's modTime
-
-		if err == nil {
-			err = f.startPullLoop(time.Since(modTime) > f.interval)
-			if err != nil {
-				return lo.Empty[V](), err
+	// an empty path means a memory only vehicle, go straight to remote
+	if path := f.localPath(); path != "" {
+		if stat, fErr := os.Stat(path); fErr == nil {
+			// local file exists, use it first
+			buf, err := os.ReadFile(path)
+			hash := utils.MakeHash(buf)
+			if f.vehicle.Type() == types.File { // the vehicle may hash its watched files too
+				if _, watchedHash, rErr := f.vehicle.Read(f.ctx, f.hash); rErr == nil {
+					hash = watchedHash
+				}
+			}
+			modTime := stat.ModTime()
+			// content read from the seed path is copied into the cache
+			contents, _, err := f.loadBuf(buf, hash, path != f.vehicle.Path())
+			f.updatedAt = modTime // reset updatedAt to file's modTime
+
+			if err == nil {
+				err = f.startPullLoop(time.Since(modTime) > f.Interval())
+				if err != nil {
+					return lo.Empty[V](), err
+				}
+				return contents, nil
 			}
-			return contents, nil
 		}
 	}
 
@@ -76,6 +484,10 @@ func (f *Fetcher[V]) Initial() (V, error) {
 	}
 
 	if updateErr != nil {
+		if f.failOpen {
+			log.Warnln("%s initial load failed, starting empty: %s", f.logPrefix(), updateErr)
+			return lo.Empty[V](), nil
+		}
 		return lo.Empty[V](), updateErr
 	}
 
@@ -83,14 +495,44 @@ func (f *Fetcher[V]) Initial() (V, error) {
 }
 
 func (f *Fetcher[V]) Update() (V, bool, error) {
-	buf, hash, err := f.vehicle.Read(f.ctx, f.hash)
+	f.loadBufMutex.Lock()
+	oldHash := f.hash
+	f.loadBufMutex.Unlock()
+	buf, hash, err := f.read(oldHash)
 	if err != nil {
+		if f.ctx.Err() != nil {
+			// closed mid read, not a failure of the source
+			return lo.Empty[V](), false, f.ctx.Err()
+		}
+		f.loadBufMutex.Lock()
+		f.recordFailure(err)
+		var retryAfterErr *RetryAfterError
+		if errors.As(err, &retryAfterErr) {
+			f.retryAt = time.Now().Add(retryAfterErr.RetryAfter)
+		}
+		f.loadBufMutex.Unlock()
 		f.backoff.AddAttempt() // add a failed attempt to backoff
 		return lo.Empty[V](), false, err
 	}
 	return f.loadBuf(buf, hash, f.vehicle.Type() != types.File)
 }
 
+// read reads the vehicle, in turn with the other fetchers of the group downloading from the same host
+func (f *Fetcher[V]) read(oldHash utils.HashType) ([]byte, utils.HashType, error) {
+	if f.vehicle.Type() != types.File {
+		release, err := f.group.acquire(f.ctx, f.vehicle.Url())
+		if err != nil {
+			return nil, utils.HashType{}, err
+		}
+		defer release()
+	}
+	return f.vehicle.Read(f.ctx, oldHash)
+}
+
+func (f *Fetcher[V]) setGroup(g *FetcherGroup) {
+	f.group = g
+}
+
 func (f *Fetcher[V]) SideUpdate(buf []byte) (V, bool, error) {
 	return f.loadBuf(buf, utils.MakeHash(buf), true)
 }
@@ -100,12 +542,16 @@ func (f *Fetcher[V]) loadBuf(buf []byte, hash utils.HashType, updateFile bool) (
 	defer f.loadBufMutex.Unlock()
 
 	now := time.Now()
+	// f.hash is only committed once buf parsed (and was written), so content whose parse
+	// failed never matches here and the same content is parsed again on the next load
 	if f.hash.Equal(hash) {
-		if updateFile {
-			_ = os.Chtimes(f.vehicle.Path(), now, now)
+		if path := f.vehicle.Path(); updateFile && path != "" {
+			_ = os.Chtimes(path, now, now)
 		}
 		f.updatedAt = now
 		f.backoff.Reset() // no error, reset backoff
+		f.recordSuccess(now)
+		f.stretchInterval()
 		return lo.Empty[V](), true, nil
 	}
 
@@ -113,8 +559,35 @@ func (f *Fetcher[V]) loadBuf(buf []byte, hash utils.HashType, updateFile bool) (
 		return lo.Empty[V](), true, nil
 	}
 
-	contents, err := f.parser(buf)
+	if len(buf) == 0 && !f.allowEmpty && f.vehicle.Type() != types.File {
+		f.recordFailure(ErrEmptyContent)
+		f.backoff.AddAttempt() // add a failed attempt to backoff
+		return lo.Empty[V](), false, ErrEmptyContent
+	}
+
+	if err := f.verify(buf); err != nil {
+		f.recordFailure(err)
+		f.backoff.AddAttempt() // add a failed attempt to backoff
+		return lo.Empty[V](), false, err
+	}
+
+	parsed := buf
+	if f.transform != nil {
+		var err error
+		if parsed, err = f.transform(buf); err != nil {
+			err = fmt.Errorf("transform: %w", err)
+			f.recordFailure(err)
+			f.backoff.AddAttempt() // add a failed attempt to backoff
+			return lo.Empty[V](), false, err
+		}
+	}
+
+	contents, err := f.parse(parsed)
 	if err != nil {
+		if f.ctx.Err() != nil { // a ParserCtx aborted by Close
+			return lo.Empty[V](), false, f.ctx.Err()
+		}
+		f.recordFailure(err)
 		f.backoff.AddAttempt() // add a failed attempt to backoff
 		return lo.Empty[V](), false, err
 	}
@@ -122,41 +595,246 @@ func (f *Fetcher[V]) loadBuf(buf []byte, hash utils.HashType, updateFile bool) (
 
 	if updateFile {
 		if err = f.vehicle.Write(buf); err != nil {
+			f.recordFailure(err)
 			return lo.Empty[V](), false, err
 		}
 	}
+	oldHash, oldSize := f.hash, f.size
 	f.updatedAt = now
 	f.hash = hash
+	f.size = len(buf)
+	if f.vehicle.Path() == "" {
+		f.raw = buf
+	}
+	f.recordSuccess(now)
+	f.resetStretchedInterval()
+	f.applyIntervalHint(contents)
 
 	if f.onUpdate != nil {
 		f.onUpdate(contents)
 	}
+	f.publish(contents)
+	if f.onUpdateDetailed != nil {
+		old := f.contents
+		f.contents = contents
+		f.onUpdateDetailed(old, contents, UpdateMeta{
+			OldHash:   oldHash,
+			NewHash:   hash,
+			SizeDelta: len(buf) - oldSize,
+			UpdatedAt: now,
+		})
+	}
 
 	return contents, false, nil
 }
 
+// stretchInterval counts an unchanged update and stretches the interval once there were enough
+// in a row, see WithAdaptiveInterval. loadBufMutex must be held
+func (f *Fetcher[V]) stretchInterval() {
+	if f.adaptiveAfter == 0 || f.interval <= 0 {
+		return
+	}
+	f.unchanged++
+	if f.unchanged < f.adaptiveAfter {
+		return
+	}
+	f.unchanged = 0
+	d := time.Duration(float64(f.interval) * f.adaptiveFactor)
+	if f.adaptiveMax > 0 && d > f.adaptiveMax {
+		d = f.adaptiveMax
+	}
+	if d <= f.interval {
+		return
+	}
+	if f.baseInterval == 0 {
+		f.baseInterval = f.interval
+	}
+	log.Debugln("%s unchanged for %d updates, interval stretched to %s", f.logPrefix(), f.adaptiveAfter, d)
+	f.setIntervalLocked(d)
+}
+
+// resetStretchedInterval restores the interval stretched by stretchInterval after a change,
+// loadBufMutex must be held
+func (f *Fetcher[V]) resetStretchedInterval() {
+	f.unchanged = 0
+	if f.baseInterval == 0 {
+		return
+	}
+	log.Debugln("%s changed, interval back to %s", f.logPrefix(), f.baseInterval)
+	f.setIntervalLocked(f.baseInterval)
+	f.baseInterval = 0
+}
+
+// applyIntervalHint adopts the interval suggested by contents, loadBufMutex must be held
+func (f *Fetcher[V]) applyIntervalHint(contents V) {
+	if f.intervalHint == nil {
+		return
+	}
+	d, ok := f.intervalHint(contents)
+	if !ok {
+		return
+	}
+	if d < f.intervalHintMin {
+		d = f.intervalHintMin
+	} else if d > f.intervalHintMax {
+		d = f.intervalHintMax
+	}
+	if d == f.interval {
+		return
+	}
+	log.Infoln("%s adopts the suggested interval %s", f.logPrefix(), d)
+	f.setIntervalLocked(d)
+}
+
+// Reload runs the parser again over the loaded content without fetching it, e.g. after the
+// parser changed its behavior. The content is read from the local file, or from memory for a
+// vehicle without one, and onUpdate receives the result. The hash is left as it is so the next
+// update still sees unchanged content as unchanged, a failed reload keeps the previous contents
+// and doesn't count as a failed update.
+func (f *Fetcher[V]) Reload() (V, error) {
+	f.updateMutex.Lock()
+	defer f.updateMutex.Unlock()
+	f.loadBufMutex.Lock()
+	defer f.loadBufMutex.Unlock()
+
+	if !f.hash.IsValid() {
+		return lo.Empty[V](), errors.New("nothing loaded yet")
+	}
+	buf := f.raw
+	if path := f.vehicle.Path(); path != "" {
+		var err error
+		if buf, err = os.ReadFile(path); err != nil {
+			return lo.Empty[V](), err
+		}
+	}
+	if f.transform != nil {
+		var err error
+		if buf, err = f.transform(buf); err != nil {
+			return lo.Empty[V](), fmt.Errorf("transform: %w", err)
+		}
+	}
+	contents, err := f.parse(buf)
+	if err != nil {
+		return lo.Empty[V](), err
+	}
+	f.applyIntervalHint(contents)
+
+	if f.onUpdate != nil {
+		f.onUpdate(contents)
+	}
+	f.publish(contents)
+	if f.onUpdateDetailed != nil {
+		old := f.contents
+		f.contents = contents
+		f.onUpdateDetailed(old, contents, UpdateMeta{
+			OldHash:   f.hash,
+			NewHash:   f.hash,
+			UpdatedAt: f.updatedAt,
+		})
+	}
+	log.Infoln("%s reloaded", f.logPrefix())
+	return contents, nil
+}
+
+func (f *Fetcher[V]) verify(buf []byte) error {
+	if f.expectedHash == "" {
+		return nil
+	}
+	sum := sha256.Sum256(buf)
+	if actual := hex.EncodeToString(sum[:]); actual != f.expectedHash {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", f.expectedHash, actual)
+	}
+	return nil
+}
+
+func (f *Fetcher[V]) parse(buf []byte) (V, error) {
+	contents, err := f.parser(f.ctx, buf)
+	if err == nil || f.fallbackParser == nil {
+		return contents, err
+	}
+	contents, fallbackErr := f.fallbackParser(f.ctx, buf)
+	if fallbackErr != nil {
+		return lo.Empty[V](), errors.Join(err, fallbackErr)
+	}
+	f.parser, f.fallbackParser = f.fallbackParser, f.parser // remember the parser that works
+	return contents, nil
+}
+
+// Subscribe returns a channel receiving the contents of every later update and Reload, in
+// addition to onUpdate. It holds the latest contents only: a subscriber that falls behind
+// misses the older ones instead of stalling the update. The channel is closed by Unsubscribe
+// or Close.
+func (f *Fetcher[V]) Subscribe() <-chan V {
+	f.subscribeAccess.Lock()
+	defer f.subscribeAccess.Unlock()
+	ch := make(chan V, 1)
+	if f.unsubscribed {
+		close(ch)
+		return ch
+	}
+	if f.subscribers == nil {
+		f.subscribers = make(map[<-chan V]chan V)
+	}
+	f.subscribers[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops updates to a channel returned by Subscribe and closes it
+func (f *Fetcher[V]) Unsubscribe(ch <-chan V) {
+	f.subscribeAccess.Lock()
+	defer f.subscribeAccess.Unlock()
+	if subscriber, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		close(subscriber)
+	}
+}
+
+// publish hands contents to the subscribers, replacing what they haven't received yet
+func (f *Fetcher[V]) publish(contents V) {
+	f.subscribeAccess.Lock()
+	defer f.subscribeAccess.Unlock()
+	for _, subscriber := range f.subscribers {
+		select {
+		case <-subscriber: // drop the oldest
+		default:
+		}
+		subscriber <- contents // only publish sends, so there is room now
+	}
+}
+
 func (f *Fetcher[V]) Close() error {
 	f.ctxCancel()
+	f.subscribeAccess.Lock()
+	for ch, subscriber := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(subscriber)
+	}
+	f.unsubscribed = true
+	f.subscribeAccess.Unlock()
 	if f.watcher != nil {
 		_ = f.watcher.Close()
 	}
+	f.reloadAccess.Lock()
+	if f.reloadTimer != nil {
+		f.reloadTimer.Stop()
+		f.reloadTimer = nil
+	}
+	f.reloadAccess.Unlock()
 	return nil
 }
 
 func (f *Fetcher[V]) pullLoop(forceUpdate bool) {
-	initialInterval := f.interval - time.Since(f.updatedAt)
-	if initialInterval > f.interval {
-		initialInterval = f.interval
-	}
+	initialInterval := f.untilNextPull()
 
 	if forceUpdate {
-		log.Warnln("[Provider] %s not updated for a long time, force refresh", f.Name())
+		log.Warnln("%s not updated for a long time, force refresh", f.logPrefix())
 		f.updateWithLog()
+		f.checkStale()
 	}
-	if attempt := f.backoff.Attempt(); attempt > 0 { // f.Update() was failed, decrease the interval from backoff to achieve fast retry
-		if duration := f.backoff.ForAttempt(attempt); duration < initialInterval {
-			initialInterval = duration
-		}
+	initialInterval = f.retryInterval(initialInterval)
+
+	if f.backoff.Jitter {
+		initialInterval += f.pullJitter()
 	}
 
 	timer := time.NewTimer(initialInterval)
@@ -165,24 +843,71 @@ func (f *Fetcher[V]) pullLoop(forceUpdate bool) {
 		select {
 		case <-timer.C:
 			f.updateWithLog()
-			interval := f.interval
-			if attempt := f.backoff.Attempt(); attempt > 0 { // f.Update() was failed, decrease the interval from backoff to achieve fast retry
-				if duration := f.backoff.ForAttempt(attempt); duration < interval {
-					interval = duration
+			f.checkStale()
+			timer.Reset(f.retryInterval(f.Interval()))
+		case <-f.intervalCh:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
 				}
 			}
-			timer.Reset(interval)
+			f.loadBufMutex.Lock()
+			if f.interval <= 0 {
+				f.pulling = false
+				f.loadBufMutex.Unlock()
+				return
+			}
+			f.loadBufMutex.Unlock()
+			timer.Reset(f.retryInterval(f.untilNextPull()))
 		case <-f.ctx.Done():
 			return
 		}
 	}
 }
 
+// retryInterval decreases interval to the backoff after a failed update to achieve
+// fast retry, capped at the retry ceiling, but never below the Retry-After the server asked for
+func (f *Fetcher[V]) retryInterval(interval time.Duration) time.Duration {
+	f.loadBufMutex.Lock()
+	if attempt := f.backoff.Attempt(); attempt > 0 {
+		duration := f.backoff.ForAttempt(attempt)
+		if f.retryCeiling > 0 && duration > f.retryCeiling {
+			duration = f.retryCeiling
+		}
+		if duration < interval {
+			interval = duration
+		}
+	}
+	retryAt := f.retryAt
+	f.loadBufMutex.Unlock()
+	if wait := time.Until(retryAt); wait > interval {
+		interval = wait
+	}
+	return interval
+}
+
+// pullJitter returns a random delay of up to a tenth of the interval, capped at a minute
+func (f *Fetcher[V]) pullJitter() time.Duration {
+	maxJitter := f.Interval() / 10
+	if maxJitter > time.Minute {
+		maxJitter = time.Minute
+	}
+	if maxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(randv2.Int64N(int64(maxJitter)))
+}
+
 func (f *Fetcher[V]) startPullLoop(forceUpdate bool) (err error) {
 	// pull contents automatically
 	if f.vehicle.Type() == types.File {
+		paths := []string{f.vehicle.Path()}
+		if watchVehicle, ok := f.vehicle.(interface{ WatchPaths() []string }); ok {
+			paths = watchVehicle.WatchPaths()
+		}
 		f.watcher, err = fswatch.NewWatcher(fswatch.Options{
-			Path:     []string{f.vehicle.Path()},
+			Path:     paths,
 			Direct:   true,
 			Callback: f.updateCallback,
 		})
@@ -193,46 +918,90 @@ func (f *Fetcher[V]) startPullLoop(forceUpdate bool) (err error) {
 		if err != nil {
 			return err
 		}
-	} else if f.interval > 0 {
-		go f.pullLoop(forceUpdate)
+	} else {
+		f.loadBufMutex.Lock()
+		f.started = true
+		if f.interval > 0 {
+			f.pulling = true
+			go f.pullLoop(forceUpdate)
+		}
+		f.loadBufMutex.Unlock()
 	}
 	return
 }
 
+// updateCallback coalesces events from the watched files arriving within
+// reloadDelay of each other into a single reload
 func (f *Fetcher[V]) updateCallback(path string) {
-	f.updateWithLog()
+	f.reloadAccess.Lock()
+	defer f.reloadAccess.Unlock()
+	if f.ctx.Err() != nil {
+		return
+	}
+	if f.reloadTimer != nil && f.reloadTimer.Stop() {
+		f.reloadTimer.Reset(f.reloadDelay)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(f.reloadDelay, func() {
+		f.reloadAccess.Lock()
+		if f.reloadTimer == timer {
+			f.reloadTimer = nil
+		}
+		f.reloadAccess.Unlock()
+		f.updateWithLog()
+	})
+	f.reloadTimer = timer
 }
 
 func (f *Fetcher[V]) updateWithLog() {
-	_, same, err := f.Update()
+	_, _, _ = f.Refresh()
+}
+
+// Refresh updates immediately and logs like the pull loop does, it is safe to
+// call concurrently with the pull loop and respects the same backoff
+func (f *Fetcher[V]) Refresh() (V, bool, error) {
+	f.updateMutex.Lock()
+	defer f.updateMutex.Unlock()
+
+	contents, same, err := f.Update()
 	if err != nil {
-		log.Errorln("[Provider] %s pull error: %s", f.Name(), err.Error())
-		return
+		if f.ctx.Err() != nil {
+			log.Debugln("%s update cancelled by close", f.logPrefix())
+			return contents, same, err
+		}
+		log.Errorln("%s pull error: %s", f.logPrefix(), err.Error())
+		if f.onError != nil {
+			go f.onError(err)
+		}
+		return contents, same, err
 	}
 
 	if same {
-		log.Debugln("[Provider] %s's content doesn't change", f.Name())
-		return
+		log.Debugln("%s's content doesn't change", f.logPrefix())
+		return contents, same, nil
 	}
 
-	log.Infoln("[Provider] %s's content update", f.Name())
-	return
+	log.Infoln("%s's content update", f.logPrefix())
+	return contents, same, nil
 }
 
-func NewFetcher[V any](name string, interval time.Duration, vehicle types.Vehicle, parser Parser[V], onUpdate func(V)) *Fetcher[V] {
+func NewFetcher[V any](name string, interval time.Duration, vehicle types.Vehicle, parser Parser[V], onUpdate func(V), options ...FetcherOption[V]) *Fetcher[V] {
 	ctx, cancel := context.WithCancel(context.Background())
 	minBackoff := 10 * time.Second
 	if interval < minBackoff {
 		minBackoff = interval
 	}
-	return &Fetcher[V]{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		name:      name,
-		vehicle:   vehicle,
-		parser:    parser,
-		onUpdate:  onUpdate,
-		interval:  interval,
+	f := &Fetcher[V]{
+		ctx:         ctx,
+		ctxCancel:   cancel,
+		name:        name,
+		vehicle:     vehicle,
+		parser:      parser.withContext(),
+		onUpdate:    onUpdate,
+		interval:    interval,
+		intervalCh:  make(chan struct{}, 1),
+		reloadDelay: fswatch.DefaultWaitTimeout,
 		backoff: slowdown.Backoff{
 			Factor: 2,
 			Jitter: false,
@@ -240,4 +1009,8 @@ func NewFetcher[V any](name string, interval time.Duration, vehicle types.Vehicl
 			Max:    interval,
 		},
 	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
 }
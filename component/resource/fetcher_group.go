@@ -0,0 +1,64 @@
+package resource
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// FetcherGroup limits how many of its fetchers download from the same host at once,
+// so starting or refreshing many providers served by one backend doesn't stampede it.
+// Reads of local files are not limited.
+type FetcherGroup struct {
+	maxPerHost int
+	mutex      sync.Mutex
+	hosts      map[string]chan struct{}
+}
+
+// NewFetcherGroup returns a group letting at most maxPerHost downloads per host run
+// concurrently, maxPerHost <= 0 means no limit
+func NewFetcherGroup(maxPerHost int) *FetcherGroup {
+	return &FetcherGroup{
+		maxPerHost: maxPerHost,
+		hosts:      make(map[string]chan struct{}),
+	}
+}
+
+type groupMember interface {
+	setGroup(g *FetcherGroup)
+}
+
+// Register adds fetchers to the group, their Initial and Update downloads then wait for
+// a slot of their host. It must be called before the fetchers are started.
+func (g *FetcherGroup) Register(fetchers ...groupMember) {
+	for _, f := range fetchers {
+		f.setGroup(g)
+	}
+}
+
+// acquire waits for a download slot of the host of rawURL and returns its release,
+// it fails only once ctx is done
+func (g *FetcherGroup) acquire(ctx context.Context, rawURL string) (func(), error) {
+	noop := func() {}
+	if g == nil || g.maxPerHost <= 0 {
+		return noop, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return noop, nil
+	}
+	g.mutex.Lock()
+	slots, ok := g.hosts[u.Host]
+	if !ok {
+		slots = make(chan struct{}, g.maxPerHost)
+		g.hosts[u.Host] = slots
+	}
+	g.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
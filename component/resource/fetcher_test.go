@@ -0,0 +1,1722 @@
+package resource
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/common/utils"
+	C "github.com/metacubex/mihomo/constant"
+	types "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/log"
+
+	"github.com/metacubex/fswatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockVehicle struct {
+	mutex sync.Mutex
+	buf   []byte
+	err   error
+	path  string
+	wrote [][]byte
+	reads int
+}
+
+func (m *mockVehicle) Read(ctx context.Context, oldHash utils.HashType) ([]byte, utils.HashType, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reads++
+	if m.err != nil {
+		return nil, utils.HashType{}, m.err
+	}
+	return m.buf, utils.MakeHash(m.buf), nil
+}
+
+func (m *mockVehicle) Write(buf []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.wrote = append(m.wrote, buf)
+	return nil
+}
+
+func (m *mockVehicle) Set(buf []byte, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.buf, m.err = buf, err
+}
+
+func (m *mockVehicle) Reads() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.reads
+}
+
+func (m *mockVehicle) Path() string            { return m.path }
+func (m *mockVehicle) Url() string             { return "mock://" + m.path }
+func (m *mockVehicle) Proxy() string           { return "" }
+func (m *mockVehicle) Type() types.VehicleType { return types.HTTP }
+
+var errNotYAML = errors.New("not yaml")
+var errNotText = errors.New("not text")
+
+func yamlParser(buf []byte) (string, error) {
+	if !strings.HasPrefix(string(buf), "payload:") {
+		return "", errNotYAML
+	}
+	return "yaml", nil
+}
+
+func textParser(buf []byte) (string, error) {
+	if strings.HasPrefix(string(buf), "payload:") {
+		return "", errNotText
+	}
+	return "text", nil
+}
+
+func TestFetcherFallbackParser(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	parsed := 0
+	countedYAML := func(buf []byte) (string, error) {
+		parsed++
+		return yamlParser(buf)
+	}
+	f := NewFetcher("test", time.Hour, vehicle, countedYAML, nil, WithFallbackParser(textParser))
+	defer f.Close()
+
+	// primary success
+	contents, _, err := f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, "yaml", contents)
+	assert.Equal(t, 1, parsed)
+
+	// fallback success, and it becomes the primary one
+	vehicle.Set([]byte("DOMAIN,a"), nil)
+	contents, _, err = f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, "text", contents)
+	assert.Equal(t, 2, parsed)
+
+	vehicle.Set([]byte("DOMAIN,b"), nil)
+	contents, _, err = f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, "text", contents)
+	assert.Equal(t, 2, parsed)
+
+	// both fail
+	broken := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithFallbackParser(yamlParser))
+	defer broken.Close()
+	_, _, err = broken.Update()
+	assert.ErrorIs(t, err, errNotYAML)
+	assert.EqualValues(t, 1, broken.backoff.Attempt())
+}
+
+func TestFetcherReparseAfterFailure(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:")}
+	var fixed atomic.Bool
+	var parses atomic.Int32
+	parser := func(buf []byte) (string, error) {
+		parses.Add(1)
+		if !fixed.Load() {
+			return "", errNotYAML
+		}
+		return yamlParser(buf)
+	}
+	var updates atomic.Int32
+	f := NewFetcher("test", 0, vehicle, parser, func(string) { updates.Add(1) })
+	defer f.Close()
+
+	_, _, err := f.Update()
+	assert.ErrorIs(t, err, errNotYAML)
+	assert.Equal(t, int32(0), updates.Load())
+
+	// identical content, the parser is retried rather than the content deemed unchanged
+	fixed.Store(true)
+	contents, same, err := f.Update()
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Equal(t, "yaml", contents)
+	assert.Equal(t, int32(2), parses.Load())
+	assert.Equal(t, int32(1), updates.Load())
+
+	// once parsed, identical content short-circuits
+	_, same, err = f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Equal(t, int32(2), parses.Load())
+}
+
+func TestFetcherConditionalGet(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var mutex sync.Mutex
+	body := "payload:\n- a"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		tag := `"` + utils.MakeHash([]byte(body)).String() + `"`
+		if r.Header.Get("If-None-Match") == tag && r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	vehicle := NewHTTPVehicle(server.URL, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+	parsed := 0
+	countedYAML := func(buf []byte) (string, error) {
+		parsed++
+		return yamlParser(buf)
+	}
+	f := NewFetcher("test", time.Hour, vehicle, countedYAML, nil)
+	defer f.Close()
+
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Equal(t, 1, parsed)
+
+	// 304, treated as unchanged without re-parse
+	f.backoff.AddAttempt()
+	updatedAt := f.UpdatedAt()
+	_, same, err = f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Equal(t, 1, parsed)
+	assert.EqualValues(t, 0, f.backoff.Attempt())
+	assert.True(t, f.UpdatedAt().After(updatedAt))
+
+	// 200 with a new body
+	mutex.Lock()
+	body = "payload:\n- b"
+	mutex.Unlock()
+	_, same, err = f.Update()
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Equal(t, 2, parsed)
+	assert.Equal(t, 3, requests)
+}
+
+func TestHTTPVehicleDecompress(t *testing.T) {
+	plain := []byte("payload:\n- a")
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		_, _ = w.Write(plain)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", plain},
+		{"identity", plain},
+		{"gzip", compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				_, _ = w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			vehicle := NewHTTPVehicle(server.URL, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+			if tt.encoding == "deflate" { // net/http already decodes the gzip it asked for
+				buf, _, err := vehicle.Read(context.Background(), utils.HashType{})
+				require.NoError(t, err)
+				assert.Equal(t, tt.body, buf) // untouched without the flag
+			}
+
+			vehicle.SetDecompress(true)
+			buf, hash, err := vehicle.Read(context.Background(), utils.HashType{})
+			require.NoError(t, err)
+			assert.Equal(t, plain, buf)
+			assert.Equal(t, utils.MakeHash(plain), hash) // matches the local file path
+		})
+	}
+}
+
+func TestHTTPVehicleHeader(t *testing.T) {
+	var got http.Header
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		host = r.Host
+		_, _ = w.Write([]byte("payload:"))
+	}))
+	defer server.Close()
+
+	header := http.Header{
+		"User-Agent":    {"custom/1.0"},
+		"Authorization": {"token 1231231"},
+		"X-Api-Key":     {"secret"},
+		"Host":          {"sub.example.com"},
+	}
+	vehicle := NewHTTPVehicle(server.URL, filepath.Join(t.TempDir(), "proxies.yaml"), "", header, DefaultHttpTimeout, 0)
+	_, _, err := vehicle.Read(context.Background(), utils.HashType{})
+	require.NoError(t, err)
+	assert.Equal(t, "custom/1.0", got.Get("User-Agent"))
+	assert.Equal(t, "token 1231231", got.Get("Authorization"))
+	assert.Equal(t, "secret", got.Get("X-Api-Key"))
+	assert.Equal(t, "sub.example.com", host)
+	assert.Equal(t, "sub.example.com", header.Get("Host")) // the configured header is left alone
+
+	redacted := redactHeader(header)
+	assert.Equal(t, "custom/1.0", redacted.Get("User-Agent"))
+	assert.Equal(t, "sub.example.com", redacted.Get("Host"))
+	assert.Equal(t, "<redacted>", redacted.Get("Authorization"))
+	assert.Equal(t, "<redacted>", redacted.Get("X-Api-Key"))
+	assert.NotContains(t, fmt.Sprint(redacted), "1231231")
+	assert.Equal(t, "token 1231231", header.Get("Authorization"))
+}
+
+// stubDialer dials directly, recording the addresses, or fails with err
+type stubDialer struct {
+	err   error
+	mutex sync.Mutex
+	dials []string
+}
+
+func (d *stubDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dials = append(d.dials, address)
+	d.mutex.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (d *stubDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	return nil, d.err
+}
+
+func (d *stubDialer) Dials() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
+func TestHTTPVehicleDialer(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte("payload:"))
+	}))
+	defer server.Close()
+
+	stub := &stubDialer{}
+	vehicle := NewHTTPVehicle(server.URL, "", "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetDialer(stub)
+	buf, _, err := vehicle.Read(context.Background(), utils.HashType{})
+	require.NoError(t, err)
+	assert.Equal(t, "payload:", string(buf))
+	assert.Equal(t, []string{server.Listener.Addr().String()}, stub.Dials())
+
+	// an unavailable proxy fails the read rather than falling back to a direct connection
+	failing := &stubDialer{err: errors.New("proxy ss1 unavailable")}
+	vehicle.SetDialer(failing)
+	_, _, err = vehicle.Read(context.Background(), utils.HashType{})
+	assert.ErrorContains(t, err, "proxy ss1 unavailable")
+	assert.Len(t, failing.Dials(), 1)
+	assert.EqualValues(t, 1, hits.Load())
+}
+
+func TestHTTPVehicleMaxBodySize(t *testing.T) {
+	const limit = 1024
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		body := []byte("payload:" + strings.Repeat("a", size-len("payload:")))
+		if r.URL.Query().Get("chunked") != "" { // no Content-Length, the limit is hit while reading
+			_, _ = w.Write(body[:1])
+			w.(http.Flusher).Flush()
+			body = body[1:]
+		}
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	for _, chunked := range []string{"", "1"} {
+		read := func(size int) ([]byte, error) {
+			url := fmt.Sprintf("%s/?size=%d&chunked=%s", server.URL, size, chunked)
+			vehicle := NewHTTPVehicle(url, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, limit)
+			buf, _, err := vehicle.Read(context.Background(), utils.HashType{})
+			return buf, err
+		}
+		buf, err := read(limit)
+		require.NoError(t, err)
+		assert.Len(t, buf, limit)
+
+		buf, err = read(limit + 1)
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+		assert.ErrorContains(t, err, "limit of 1024 bytes")
+		assert.Nil(t, buf)
+	}
+
+	// an oversized body fails the update and backs off
+	vehicle := NewHTTPVehicle(fmt.Sprintf("%s/?size=%d", server.URL, limit+1), filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, limit)
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	_, _, err := f.Update()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, float64(1), f.backoff.Attempt())
+}
+
+func TestFetcherExpectedHash(t *testing.T) {
+	content := []byte("payload:\n- a")
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+
+	t.Run("match", func(t *testing.T) {
+		vehicle := &mockVehicle{buf: content}
+		f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithExpectedHash[string](strings.ToUpper(expected)))
+		defer f.Close()
+		contents, _, err := f.Update()
+		require.NoError(t, err)
+		assert.Equal(t, "yaml", contents)
+		assert.Len(t, vehicle.wrote, 1)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		vehicle := &mockVehicle{buf: []byte("payload:\n- tampered")}
+		parsed := 0
+		countedYAML := func(buf []byte) (string, error) {
+			parsed++
+			return yamlParser(buf)
+		}
+		f := NewFetcher("test", time.Hour, vehicle, countedYAML, nil, WithExpectedHash[string](expected))
+		defer f.Close()
+		_, _, err := f.Update()
+		assert.ErrorContains(t, err, "checksum mismatch")
+		assert.Equal(t, 0, parsed)
+		assert.Empty(t, vehicle.wrote)
+		assert.EqualValues(t, 1, f.backoff.Attempt())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		vehicle := &mockVehicle{buf: []byte("payload:\n- anything")}
+		f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithExpectedHash[string](""))
+		defer f.Close()
+		_, _, err := f.Update()
+		require.NoError(t, err)
+		assert.Len(t, vehicle.wrote, 1)
+	})
+}
+
+func TestSafeWritePartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "provider.yaml")
+	require.NoError(t, safeWrite(path, []byte("payload:\n- original")))
+
+	errDiskFull := errors.New("disk full")
+	defer func(write func(*os.File, []byte) error) { writeTempFile = write }(writeTempFile)
+	writeTempFile = func(f *os.File, buf []byte) error {
+		_, _ = f.Write(buf[:len(buf)/2])
+		return errDiskFull
+	}
+
+	vehicle := NewFileVehicle(path)
+	assert.ErrorIs(t, vehicle.Write([]byte("payload:\n- replacement")), errDiskFull)
+
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- original", string(buf))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1) // the temp file is cleaned up
+}
+
+func TestSafeWriteReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "provider.yaml")
+	require.NoError(t, safeWrite(path, []byte("a")))
+	require.NoError(t, safeWrite(path, []byte("b")))
+
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(buf))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFetcherMirrors(t *testing.T) {
+	var badHits, goodHits atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+	body := []byte("payload:\n- a")
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits.Add(1)
+		_, _ = w.Write(body)
+	}))
+	defer good.Close()
+
+	vehicle := NewHTTPVehicle(bad.URL, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetMirrors([]string{good.URL})
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+
+	contents, _, err := f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, "yaml", contents)
+	assert.Equal(t, utils.MakeHash(body), f.hash)
+	assert.EqualValues(t, 0, f.backoff.Attempt())
+	assert.EqualValues(t, 1, badHits.Load())
+	assert.EqualValues(t, 1, goodHits.Load())
+
+	// the good mirror is preferred next time
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.EqualValues(t, 1, badHits.Load())
+	assert.EqualValues(t, 2, goodHits.Load())
+
+	// only one backoff attempt when every mirror fails
+	good.Close()
+	_, _, err = f.Update()
+	assert.ErrorContains(t, err, bad.URL)
+	assert.EqualValues(t, 1, f.backoff.Attempt())
+	assert.EqualValues(t, 2, badHits.Load())
+}
+
+func TestFetcherMetrics(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	vehicle := &mockVehicle{err: errFetch}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	assert.Zero(t, f.FailureCount())
+	assert.NoError(t, f.LastError())
+	assert.True(t, f.LastSuccess().IsZero())
+
+	_, _, err := f.Update()
+	assert.ErrorIs(t, err, errFetch)
+	vehicle.Set([]byte("DOMAIN,a"), nil) // parse failure
+	_, _, err = f.Update()
+	assert.ErrorIs(t, err, errNotYAML)
+	assert.Equal(t, 2, f.FailureCount())
+	assert.ErrorIs(t, f.LastError(), errNotYAML)
+	assert.True(t, f.LastSuccess().IsZero())
+
+	vehicle.Set([]byte("payload:\n- a"), nil)
+	_, _, err = f.Update()
+	require.NoError(t, err)
+	assert.Zero(t, f.FailureCount())
+	assert.NoError(t, f.LastError())
+	success := f.LastSuccess()
+	assert.False(t, success.IsZero())
+
+	// an unchanged update is a success too
+	vehicle.Set(nil, errFetch)
+	_, _, err = f.Update()
+	assert.Error(t, err)
+	assert.Equal(t, 1, f.FailureCount())
+	vehicle.Set([]byte("payload:\n- a"), nil)
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Zero(t, f.FailureCount())
+	assert.NoError(t, f.LastError())
+	assert.False(t, f.LastSuccess().Before(success))
+}
+
+func TestFetcherMinBackoff(t *testing.T) {
+	vehicle := &mockVehicle{}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	assert.Equal(t, 10*time.Second, f.backoff.ForAttempt(0))
+	assert.Equal(t, 20*time.Second, f.backoff.ForAttempt(1))
+
+	f = NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithMinBackoff[string](time.Second))
+	defer f.Close()
+	assert.Equal(t, time.Second, f.backoff.ForAttempt(0))
+	assert.Equal(t, 2*time.Second, f.backoff.ForAttempt(1))
+	assert.Equal(t, time.Hour, f.backoff.ForAttempt(20)) // Max clamps to interval
+
+	f = NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithMinBackoff[string](time.Minute))
+	defer f.Close()
+	assert.Equal(t, time.Minute, f.backoff.ForAttempt(0))
+	assert.Equal(t, 4*time.Minute, f.backoff.ForAttempt(2))
+	assert.Equal(t, time.Hour, f.backoff.ForAttempt(20))
+
+	// a floor above the interval is clamped to it
+	f = NewFetcher("test", time.Minute, vehicle, yamlParser, nil, WithMinBackoff[string](time.Hour))
+	defer f.Close()
+	assert.Equal(t, time.Minute, f.backoff.ForAttempt(0))
+	assert.Equal(t, time.Minute, f.backoff.ForAttempt(5))
+
+	// unset keeps the default
+	f = NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithMinBackoff[string](0))
+	defer f.Close()
+	assert.Equal(t, 10*time.Second, f.backoff.ForAttempt(0))
+}
+
+func TestFetcherRetryCeiling(t *testing.T) {
+	vehicle := &mockVehicle{}
+	f := NewFetcher("test", 24*time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	g := NewFetcher("test", 24*time.Hour, vehicle, yamlParser, nil, WithRetryCeiling[string](30*time.Minute))
+	defer g.Close()
+
+	// no failure, the interval is untouched
+	assert.Equal(t, 24*time.Hour, f.retryInterval(f.interval))
+	assert.Equal(t, 24*time.Hour, g.retryInterval(g.interval))
+
+	for i := 0; i < 12; i++ {
+		f.backoff.AddAttempt()
+		g.backoff.AddAttempt()
+	}
+	assert.Greater(t, f.retryInterval(f.interval), 10*time.Hour)
+	assert.Equal(t, 30*time.Minute, g.retryInterval(g.interval))
+
+	// early attempts stay below the ceiling
+	g.backoff.Reset()
+	g.backoff.AddAttempt()
+	assert.Equal(t, 20*time.Second, g.retryInterval(g.interval))
+}
+
+func TestFetcherTransform(t *testing.T) {
+	errNoEnvelope := errors.New("no envelope")
+	unwrap := func(buf []byte) ([]byte, error) {
+		var envelope struct {
+			Data string `json:"data"`
+		}
+		if err := json.Unmarshal(buf, &envelope); err != nil || envelope.Data == "" {
+			return nil, errNoEnvelope
+		}
+		return []byte(envelope.Data), nil
+	}
+	raw := []byte(`{"data":"payload:\n- a"}`)
+	vehicle := &mockVehicle{buf: raw}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithTransform[string](unwrap))
+	defer f.Close()
+
+	contents, same, err := f.Update()
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Equal(t, "yaml", contents)
+	assert.Equal(t, utils.MakeHash(raw), f.hash) // hashed before the transform
+	assert.Equal(t, [][]byte{raw}, vehicle.wrote)
+
+	_, same, err = f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+
+	// a failing transform counts as a failed attempt and keeps the old content
+	vehicle.Set([]byte(`{"other":1}`), nil)
+	_, _, err = f.Update()
+	assert.ErrorIs(t, err, errNoEnvelope)
+	assert.Equal(t, 1, f.FailureCount())
+	assert.Equal(t, float64(1), f.backoff.Attempt())
+	assert.Equal(t, utils.MakeHash(raw), f.hash)
+}
+
+func TestFetcherContentHashSize(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	assert.Empty(t, f.ContentHash())
+	assert.Equal(t, 0, f.ContentSize())
+
+	_, _, err := f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, utils.MakeHash(vehicle.buf).String(), f.ContentHash())
+	assert.Equal(t, len(vehicle.buf), f.ContentSize())
+
+	// unchanged content keeps both
+	hash := f.ContentHash()
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Equal(t, hash, f.ContentHash())
+	assert.Equal(t, len(vehicle.buf), f.ContentSize())
+
+	// a failed load keeps both too
+	vehicle.Set([]byte("invalid"), nil)
+	_, _, err = f.Update()
+	assert.Error(t, err)
+	assert.Equal(t, hash, f.ContentHash())
+
+	next := []byte("payload:\n- a\n- b")
+	vehicle.Set(next, nil)
+	_, _, err = f.Update()
+	require.NoError(t, err)
+	assert.Equal(t, utils.MakeHash(next).String(), f.ContentHash())
+	assert.Equal(t, len(next), f.ContentSize())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = f.Update()
+			_ = f.ContentHash()
+			_ = f.ContentSize()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFetcherLogTags(t *testing.T) {
+	sub := log.Subscribe()
+	defer log.UnSubscribe(sub)
+	nextLog := func() string {
+		select {
+		case event := <-sub:
+			return event.Payload
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	vehicle := &mockVehicle{err: errors.New("boom")}
+	f := NewFetcher("geo", time.Hour, vehicle, yamlParser, nil, WithResourceType[string]("GeoIP"))
+	defer f.Close()
+	f.updateWithLog()
+	assert.Equal(t, "[Provider] [GeoIP/HTTP] geo pull error: boom", nextLog())
+
+	vehicle.Set([]byte("payload:"), nil)
+	f.updateWithLog()
+	assert.Equal(t, "[Provider] [GeoIP/HTTP] geo's content update", nextLog())
+
+	// untagged fetchers still carry the vehicle type
+	g := NewFetcher("rule", time.Hour, vehicle, yamlParser, nil)
+	defer g.Close()
+	g.updateWithLog()
+	assert.Equal(t, "[Provider] [HTTP] rule's content update", nextLog())
+}
+
+func TestFetcherOnError(t *testing.T) {
+	errs := make(chan error, 1)
+	vehicle := &mockVehicle{err: errors.New("boom")}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithOnError[string](func(err error) {
+		errs <- err
+	}))
+	defer f.Close()
+
+	_, _, err := f.Refresh()
+	require.Error(t, err)
+	select {
+	case got := <-errs:
+		assert.Equal(t, err, got)
+	case <-time.After(time.Second):
+		t.Fatal("onError not called")
+	}
+
+	// a successful update is not reported
+	vehicle.Set([]byte("payload:"), nil)
+	_, _, err = f.Refresh()
+	require.NoError(t, err)
+	select {
+	case got := <-errs:
+		t.Fatalf("unexpected onError call: %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type blockingVehicle struct {
+	mockVehicle
+	reading chan struct{}
+}
+
+func (v *blockingVehicle) Read(ctx context.Context, oldHash utils.HashType) ([]byte, utils.HashType, error) {
+	close(v.reading)
+	<-ctx.Done()
+	return nil, utils.HashType{}, ctx.Err()
+}
+
+func TestFetcherCloseDuringUpdate(t *testing.T) {
+	sub := log.Subscribe()
+	defer log.UnSubscribe(sub)
+
+	vehicle := &blockingVehicle{reading: make(chan struct{})}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := f.Refresh()
+		done <- err
+	}()
+	<-vehicle.reading
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	assert.Equal(t, float64(0), f.backoff.Attempt())
+	assert.Equal(t, 0, f.FailureCount())
+	assert.NoError(t, f.LastError())
+	for {
+		select {
+		case event := <-sub:
+			assert.NotEqual(t, log.ERROR, event.LogLevel, event.Payload)
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+}
+
+func TestFetcherBackoffJitter(t *testing.T) {
+	vehicle := &mockVehicle{}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	assert.False(t, f.backoff.Jitter)
+	assert.Equal(t, f.backoff.ForAttempt(3), f.backoff.ForAttempt(3))
+
+	f = NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithBackoffJitter[string](true))
+	defer f.Close()
+	intervals := make(map[time.Duration]struct{})
+	for i := 0; i < 16; i++ {
+		interval := f.backoff.ForAttempt(3)
+		assert.GreaterOrEqual(t, interval, 10*time.Second)
+		assert.LessOrEqual(t, interval, 80*time.Second)
+		intervals[interval] = struct{}{}
+	}
+	assert.Greater(t, len(intervals), 1)
+
+	jitters := make(map[time.Duration]struct{})
+	for i := 0; i < 16; i++ {
+		jitter := f.pullJitter()
+		assert.GreaterOrEqual(t, jitter, time.Duration(0))
+		assert.Less(t, jitter, time.Minute)
+		jitters[jitter] = struct{}{}
+	}
+	assert.Greater(t, len(jitters), 1)
+}
+
+func TestFetcherMemoryOnly(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte("payload:\n- remote"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rule.yaml")
+	// a stale local file must be ignored
+	require.NoError(t, os.WriteFile(path, []byte("payload:\n- local"), 0o644))
+	localBuf, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	vehicle := NewHTTPVehicle(server.URL, path, "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetMemoryOnly(true)
+	assert.Empty(t, vehicle.Path())
+
+	// interval 0 keeps the pull loop from racing the updates below
+	var loaded [][]byte
+	parser := func(buf []byte) ([]byte, error) { return buf, nil }
+	f := NewFetcher("test", 0, vehicle, parser, func(buf []byte) { loaded = append(loaded, buf) })
+	defer f.Close()
+
+	contents, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- remote", string(contents))
+	assert.EqualValues(t, 1, hits.Load())
+
+	// unchanged update, no Chtimes on the empty path
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Len(t, loaded, 1)
+
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, localBuf, buf)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// nothing is created when there was no local file
+	newPath := filepath.Join(dir, "sub", "new.yaml")
+	vehicle = NewHTTPVehicle(server.URL, newPath, "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetMemoryOnly(true)
+	f = NewFetcher("test", 0, vehicle, parser, nil)
+	defer f.Close()
+	_, err = f.Initial()
+	require.NoError(t, err)
+	assert.NoFileExists(t, newPath)
+	assert.NoDirExists(t, filepath.Dir(newPath))
+}
+
+func TestFetcherCacheDir(t *testing.T) {
+	var body atomic.Value
+	body.Store("payload:\n- remote")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	configDir, cacheDir := t.TempDir(), t.TempDir()
+	path := filepath.Join(configDir, "rule.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("payload:\n- seed"), 0o444))
+
+	vehicle := NewHTTPVehicle(server.URL, path, "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetCacheDir(cacheDir)
+	cachePath := vehicle.Path()
+	assert.Equal(t, cacheDir, filepath.Dir(cachePath))
+	assert.Equal(t, path, vehicle.SeedPath())
+
+	parser := func(buf []byte) (string, error) { return string(buf), nil }
+	f := NewFetcher("test", 0, vehicle, parser, nil)
+	defer f.Close()
+
+	// nothing cached yet, the seed is read and copied into the cache
+	contents, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- seed", contents)
+	buf, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- seed", string(buf))
+
+	// updates land in the cache, the seed is left alone
+	_, _, err = f.Update()
+	require.NoError(t, err)
+	buf, err = os.ReadFile(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- remote", string(buf))
+	buf, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- seed", string(buf))
+
+	// the cached copy is preferred over the seed, and loaded without a fetch
+	body.Store("payload:\n- newer")
+	vehicle = NewHTTPVehicle(server.URL, path, "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetCacheDir(cacheDir)
+	f = NewFetcher("test", 0, vehicle, parser, nil)
+	defer f.Close()
+	contents, err = f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- remote", contents)
+}
+
+func TestHTTPVehicleCacheName(t *testing.T) {
+	oldHome := C.Path.HomeDir()
+	defer C.SetHomeDir(oldHome)
+	home, cacheDir := t.TempDir(), t.TempDir()
+	C.SetHomeDir(home)
+
+	cachePath := func(path string) string {
+		vehicle := NewHTTPVehicle("http://example.com", path, "", nil, DefaultHttpTimeout, 0)
+		vehicle.SetCacheDir(cacheDir)
+		return vehicle.Path()
+	}
+	// the same file name under different dirs doesn't share a cache file
+	a := cachePath(filepath.Join(home, "a", "rule.yaml"))
+	b := cachePath(filepath.Join(home, "b", "rule.yaml"))
+	assert.Equal(t, filepath.Join(cacheDir, "a", "rule.yaml"), a)
+	assert.Equal(t, filepath.Join(cacheDir, "b", "rule.yaml"), b)
+
+	// outside the home dir the path is hashed
+	outside := t.TempDir()
+	c := cachePath(filepath.Join(outside, "a", "rule.yaml"))
+	d := cachePath(filepath.Join(outside, "b", "rule.yaml"))
+	assert.Equal(t, cacheDir, filepath.Dir(c))
+	assert.NotEqual(t, c, d)
+	assert.Equal(t, c, cachePath(filepath.Join(outside, "a", "rule.yaml")), "stable across restarts")
+
+	// both providers keep their own content
+	vehicle := NewHTTPVehicle("http://example.com", filepath.Join(home, "a", "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetCacheDir(cacheDir)
+	require.NoError(t, vehicle.Write([]byte("a")))
+	vehicle = NewHTTPVehicle("http://example.com", filepath.Join(home, "b", "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+	vehicle.SetCacheDir(cacheDir)
+	require.NoError(t, vehicle.Write([]byte("b")))
+	buf, err := os.ReadFile(a)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(buf))
+}
+
+func TestFetcherDetailedUpdate(t *testing.T) {
+	type update struct {
+		old, new []string
+		meta     UpdateMeta
+	}
+	var updates []update
+	var plain [][]string
+	parser := func(buf []byte) ([]string, error) { return strings.Split(string(buf), "\n"), nil }
+	vehicle := &mockVehicle{buf: []byte("a\nb")}
+	f := NewFetcher("test", time.Hour, vehicle, parser, func(v []string) { plain = append(plain, v) },
+		WithDetailedUpdate(func(old, new []string, meta UpdateMeta) {
+			updates = append(updates, update{old, new, meta})
+		}))
+	defer f.Close()
+
+	_, _, err := f.Update()
+	require.NoError(t, err)
+	vehicle.Set([]byte("a\nc\nd"), nil)
+	_, _, err = f.Update()
+	require.NoError(t, err)
+	updatedAt := f.UpdatedAt()
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+
+	assert.Len(t, plain, 2) // onUpdate keeps working
+	require.Len(t, updates, 2)
+
+	assert.Nil(t, updates[0].old)
+	assert.Equal(t, []string{"a", "b"}, updates[0].new)
+	assert.False(t, updates[0].meta.OldHash.IsValid())
+	assert.Equal(t, utils.MakeHash([]byte("a\nb")), updates[0].meta.NewHash)
+	assert.Equal(t, 3, updates[0].meta.SizeDelta)
+
+	assert.Equal(t, []string{"a", "b"}, updates[1].old)
+	assert.Equal(t, []string{"a", "c", "d"}, updates[1].new)
+	assert.Equal(t, updates[0].meta.NewHash, updates[1].meta.OldHash)
+	assert.Equal(t, utils.MakeHash([]byte("a\nc\nd")), updates[1].meta.NewHash)
+	assert.Equal(t, 2, updates[1].meta.SizeDelta)
+	assert.Equal(t, updatedAt, updates[1].meta.UpdatedAt)
+
+	// not retained when unused
+	other := NewFetcher("test", time.Hour, vehicle, parser, nil)
+	defer other.Close()
+	_, _, err = other.Update()
+	require.NoError(t, err)
+	assert.Nil(t, other.contents)
+}
+
+func TestFetcherRefresh(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- 0")}
+	var updates atomic.Int32
+	f := NewFetcher("test", 5*time.Millisecond, vehicle, yamlParser, func(string) { updates.Add(1) })
+	defer f.Close()
+
+	_, err := f.Initial() // starts the pull loop
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vehicle.Set([]byte("payload:\n- "+strings.Repeat("a", i)), nil)
+			_, _, err := f.Refresh()
+			assert.NoError(t, err)
+			time.Sleep(time.Millisecond)
+		}(i)
+	}
+	wg.Wait()
+
+	final := []byte("payload:\n- final")
+	vehicle.Set(final, nil)
+	contents, same, err := f.Refresh()
+	require.NoError(t, err)
+	if !same { // the pull loop may have got there first
+		assert.Equal(t, "yaml", contents)
+	}
+	f.loadBufMutex.Lock()
+	assert.Equal(t, utils.MakeHash(final), f.hash)
+	f.loadBufMutex.Unlock()
+	assert.Zero(t, f.FailureCount())
+	assert.GreaterOrEqual(t, updates.Load(), int32(2))
+
+	vehicle.Set(nil, errors.New("offline"))
+	_, _, err = f.Refresh()
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, f.backoff.Attempt(), float64(1))
+}
+
+func TestFetcherWatchPaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "provider.yaml")
+	include := filepath.Join(dir, "include.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("payload:\n- a"), 0o644))
+	require.NoError(t, os.WriteFile(include, []byte("- b"), 0o644))
+
+	vehicle := NewFileVehicle(path)
+	vehicle.SetWatchPaths([]string{include})
+	assert.Equal(t, []string{path, include}, vehicle.WatchPaths())
+
+	var reloads atomic.Int32
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, func(string) { reloads.Add(1) })
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, reloads.Load())
+	reloads.Store(0)
+
+	burst := func(writes ...func()) {
+		for _, write := range writes {
+			write()
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(4 * fswatch.DefaultWaitTimeout)
+	}
+	write := func(path, content string) func() {
+		return func() { require.NoError(t, os.WriteFile(path, []byte(content), 0o644)) }
+	}
+
+	burst(write(include, "- c"), write(include, "- d"), write(include, "- e"))
+	assert.EqualValues(t, 1, reloads.Load())
+
+	burst(write(path, "payload:\n- f"), write(path, "payload:\n- g"))
+	assert.EqualValues(t, 2, reloads.Load())
+
+	burst(write(path, "payload:\n- h"), write(include, "- i"))
+	assert.EqualValues(t, 3, reloads.Load())
+}
+
+func TestFetcherParserCtx(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	started := make(chan struct{})
+	slowParser := func(ctx context.Context, buf []byte) (string, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(5 * time.Second):
+			return "yaml", nil
+		}
+	}
+	f := NewFetcher[string]("test", time.Hour, vehicle, nil, nil, WithParserCtx(slowParser))
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := f.Update()
+		done <- err
+	}()
+	<-started
+	require.NoError(t, f.Close())
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("parser did not see the cancellation")
+	}
+
+	// the plain parser path keeps working
+	plain := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer plain.Close()
+	contents, _, err := plain.Update()
+	require.NoError(t, err)
+	assert.Equal(t, "yaml", contents)
+}
+
+func TestFetcherStale(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	var fired atomic.Int32
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithOnStale[string](2, func() { fired.Add(1) }))
+	defer f.Close()
+	setUpdatedAt := func(updatedAt time.Time) {
+		f.loadBufMutex.Lock()
+		f.updatedAt = updatedAt
+		f.loadBufMutex.Unlock()
+	}
+
+	_, _, err := f.Update()
+	require.NoError(t, err)
+	assert.False(t, f.IsStale(2))
+
+	setUpdatedAt(time.Now().Add(-90 * time.Minute))
+	assert.True(t, f.IsStale(1))
+	assert.False(t, f.IsStale(2))
+	f.checkStale()
+	assert.EqualValues(t, 0, fired.Load())
+
+	// fires once per stale episode
+	setUpdatedAt(time.Now().Add(-3 * time.Hour))
+	for i := 0; i < 3; i++ {
+		f.checkStale()
+	}
+	assert.EqualValues(t, 1, fired.Load())
+
+	// a successful update ends the episode
+	vehicle.Set([]byte("payload:\n- b"), nil)
+	_, _, err = f.Update()
+	require.NoError(t, err)
+	f.checkStale()
+	setUpdatedAt(time.Now().Add(-3 * time.Hour))
+	f.checkStale()
+	f.checkStale()
+	assert.EqualValues(t, 2, fired.Load())
+
+	// never stale without an interval
+	noInterval := NewFetcher("test", 0, vehicle, yamlParser, nil)
+	defer noInterval.Close()
+	assert.False(t, noInterval.IsStale(1))
+}
+
+func TestFetcherTouch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("payload:\n- a"), 0o644))
+	vehicle := &mockVehicle{path: path}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+	hash, size, reads := f.ContentHash(), f.ContentSize(), vehicle.Reads()
+	require.NotEmpty(t, hash)
+
+	old := time.Now().Add(-3 * time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+	f.loadBufMutex.Lock()
+	f.updatedAt = old
+	f.loadBufMutex.Unlock()
+	require.True(t, f.IsStale(2))
+
+	f.Touch()
+	assert.False(t, f.IsStale(1))
+	assert.WithinDuration(t, time.Now(), f.UpdatedAt(), time.Second)
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), stat.ModTime(), time.Second)
+
+	// nothing was downloaded or replaced
+	assert.Equal(t, reads, vehicle.Reads())
+	assert.Equal(t, hash, f.ContentHash())
+	assert.Equal(t, size, f.ContentSize())
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- a", string(buf))
+}
+
+func TestFetcherRetryAfter(t *testing.T) {
+	var retryAfter atomic.Value
+	retryAfter.Store("120")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter.Load().(string))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	vehicle := NewHTTPVehicle(server.URL, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+	f := NewFetcher("test", time.Minute, vehicle, yamlParser, nil)
+	defer f.Close()
+	assert.Equal(t, time.Minute, f.retryInterval(f.interval))
+
+	_, _, err := f.Update()
+	var retryAfterErr *RetryAfterError
+	require.ErrorAs(t, err, &retryAfterErr)
+	assert.Equal(t, 2*time.Minute, retryAfterErr.RetryAfter)
+	// the backoff alone would retry after 10s
+	interval := f.retryInterval(f.interval)
+	assert.Greater(t, interval, 119*time.Second)
+	assert.LessOrEqual(t, interval, 2*time.Minute)
+
+	retryAfter.Store(time.Now().Add(5 * time.Minute).UTC().Format(http.TimeFormat))
+	_, _, err = f.Update()
+	require.ErrorAs(t, err, &retryAfterErr)
+	assert.Greater(t, f.retryInterval(f.interval), 4*time.Minute)
+
+	// without the header it is a plain error
+	retryAfter.Store("")
+	_, _, err = f.Update()
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &retryAfterErr))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	d, ok := parseRetryAfter("30")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	d, ok = parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Zero(t, d)
+
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestHTTPVehicleContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		strict      bool
+		ok          bool
+	}{
+		{"match", "text/yaml; charset=utf-8", false, true},
+		{"wildcard", "text/plain", false, true},
+		{"mismatch", "text/html; charset=utf-8", false, false},
+		{"missing", "", false, true},
+		{"missing strict", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType == "" {
+					w.Header()["Content-Type"] = nil // no sniffing
+				} else {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				_, _ = w.Write([]byte("payload:\n- a"))
+			}))
+			defer server.Close()
+
+			vehicle := NewHTTPVehicle(server.URL, filepath.Join(t.TempDir(), "rule.yaml"), "", nil, DefaultHttpTimeout, 0)
+			contentTypes := []string{"application/yaml", "TEXT/YAML"}
+			if tt.name == "wildcard" {
+				contentTypes = []string{"text/*"}
+			}
+			vehicle.SetContentTypes(contentTypes, tt.strict)
+			f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+			defer f.Close()
+
+			_, _, err := f.Update()
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "content type")
+				assert.EqualValues(t, 1, f.backoff.Attempt())
+			}
+		})
+	}
+}
+
+func TestFetcherSetInterval(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil)
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, 1, vehicle.Reads())
+
+	// the running loop picks up the shorter interval
+	f.SetInterval(20 * time.Millisecond)
+	assert.Equal(t, 20*time.Millisecond, f.Interval())
+	assert.Eventually(t, func() bool { return vehicle.Reads() >= 3 }, time.Second, 5*time.Millisecond)
+
+	// 0 stops periodic pulls
+	f.SetInterval(0)
+	time.Sleep(50 * time.Millisecond)
+	reads := vehicle.Reads()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, reads, vehicle.Reads())
+
+	// and a new interval starts them again
+	f.SetInterval(20 * time.Millisecond)
+	assert.Eventually(t, func() bool { return vehicle.Reads() >= reads+2 }, time.Second, 5*time.Millisecond)
+
+	// a longer interval delays the next tick
+	f.SetInterval(time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	reads = vehicle.Reads()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, reads, vehicle.Reads())
+}
+
+func TestFetcherIntervalHint(t *testing.T) {
+	rawParser := func(buf []byte) (string, error) { return string(buf), nil }
+	hint := func(contents string) (time.Duration, bool) {
+		for _, line := range strings.Split(contents, "\n") {
+			if value, ok := strings.CutPrefix(line, "# interval: "); ok {
+				d, err := time.ParseDuration(value)
+				return d, err == nil
+			}
+		}
+		return 0, false
+	}
+
+	vehicle := &mockVehicle{buf: []byte("# interval: 20ms\npayload:")}
+	f := NewFetcher("test", time.Hour, vehicle, rawParser, nil, WithIntervalHint(hint, 10*time.Millisecond, time.Hour))
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Millisecond, f.Interval())
+	// the pull loop runs at the suggested interval rather than the configured hour
+	assert.Eventually(t, func() bool { return vehicle.Reads() >= 3 }, time.Second, 5*time.Millisecond)
+
+	// suggestions are clamped, and a payload without one keeps the current interval
+	vehicle.Set([]byte("# interval: 1ms\npayload:"), nil)
+	assert.Eventually(t, func() bool { return f.Interval() == 10*time.Millisecond }, time.Second, 5*time.Millisecond)
+	vehicle.Set([]byte("# interval: 48h\npayload:"), nil)
+	assert.Eventually(t, func() bool { return f.Interval() == time.Hour }, time.Second, 5*time.Millisecond)
+	reads := vehicle.Reads()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, reads, vehicle.Reads())
+
+	g := NewFetcher("test", time.Hour, &mockVehicle{buf: []byte("payload:")}, rawParser, nil, WithIntervalHint(hint, 0, 0))
+	defer g.Close()
+	_, err = g.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, g.Interval())
+}
+
+// hostVehicle is a slow remote vehicle recording how many reads of its host overlap
+type hostVehicle struct {
+	mockVehicle
+	host   string
+	active map[string]*atomic.Int32
+	peak   map[string]*atomic.Int32
+}
+
+func (v *hostVehicle) Url() string { return "https://" + v.host + "/" + v.path }
+
+func (v *hostVehicle) Read(ctx context.Context, oldHash utils.HashType) ([]byte, utils.HashType, error) {
+	n := v.active[v.host].Add(1)
+	defer v.active[v.host].Add(-1)
+	for {
+		peak := v.peak[v.host].Load()
+		if n <= peak || v.peak[v.host].CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return v.mockVehicle.Read(ctx, oldHash)
+}
+
+func TestFetcherGroup(t *testing.T) {
+	const maxPerHost = 2
+	hosts := []string{"a.example.com", "b.example.com"}
+	active := map[string]*atomic.Int32{}
+	peak := map[string]*atomic.Int32{}
+	for _, host := range hosts {
+		active[host], peak[host] = &atomic.Int32{}, &atomic.Int32{}
+	}
+
+	group := NewFetcherGroup(maxPerHost)
+	var fetchers []*Fetcher[string]
+	for i := 0; i < 12; i++ {
+		vehicle := &hostVehicle{
+			mockVehicle: mockVehicle{buf: []byte("payload:")},
+			host:        hosts[i%len(hosts)],
+			active:      active,
+			peak:        peak,
+		}
+		f := NewFetcher(fmt.Sprintf("p%d", i), time.Hour, vehicle, yamlParser, nil)
+		defer f.Close()
+		group.Register(f)
+		fetchers = append(fetchers, f)
+	}
+
+	var wg sync.WaitGroup
+	for _, f := range fetchers {
+		wg.Add(1)
+		go func(f *Fetcher[string]) {
+			defer wg.Done()
+			_, err := f.Initial()
+			assert.NoError(t, err)
+		}(f)
+	}
+	wg.Wait()
+	for _, host := range hosts {
+		assert.LessOrEqual(t, peak[host].Load(), int32(maxPerHost), host)
+		assert.Equal(t, int32(maxPerHost), peak[host].Load(), "hosts are limited separately, not serialized")
+	}
+
+	// a waiting fetcher gives up once closed
+	blocker := &hostVehicle{mockVehicle: mockVehicle{buf: []byte("payload:")}, host: "c.example.com", active: active, peak: peak}
+	active["c.example.com"], peak["c.example.com"] = &atomic.Int32{}, &atomic.Int32{}
+	single := NewFetcherGroup(1)
+	release, err := single.acquire(context.Background(), blocker.Url())
+	require.NoError(t, err)
+	defer release()
+	f := NewFetcher("waiting", time.Hour, blocker, yamlParser, nil)
+	single.Register(f)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := f.Update()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	f.Close()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("Update still waiting after Close")
+	}
+	assert.Equal(t, 0, blocker.Reads())
+}
+
+func TestFetcherReload(t *testing.T) {
+	var upper atomic.Bool
+	parser := func(buf []byte) (string, error) {
+		if upper.Load() {
+			return strings.ToUpper(string(buf)), nil
+		}
+		return string(buf), nil
+	}
+
+	path := filepath.Join(t.TempDir(), "provider.yaml")
+	vehicle := &mockVehicle{path: path}
+	var updates []string
+	f := NewFetcher("test", 0, vehicle, parser, func(s string) { updates = append(updates, s) })
+	defer f.Close()
+
+	_, err := f.Reload()
+	assert.Error(t, err) // nothing loaded yet
+
+	require.NoError(t, os.WriteFile(path, []byte("payload:\n- a"), 0o644))
+	contents, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- a", contents)
+	hash, reads := f.ContentHash(), vehicle.Reads()
+
+	upper.Store(true)
+	contents, err = f.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, "PAYLOAD:\n- A", contents)
+	assert.Equal(t, []string{"payload:\n- a", "PAYLOAD:\n- A"}, updates)
+	assert.Equal(t, reads, vehicle.Reads()) // nothing fetched
+	assert.Equal(t, hash, f.ContentHash())
+
+	// the same remote content is still seen as unchanged
+	vehicle.Set([]byte("payload:\n- a"), nil)
+	_, same, err := f.Update()
+	require.NoError(t, err)
+	assert.True(t, same)
+	assert.Len(t, updates, 2)
+
+	// a vehicle without a local file reloads the content kept in memory
+	memVehicle := &mockVehicle{buf: []byte("payload:\n- b")}
+	upper.Store(false)
+	f = NewFetcher("test", 0, memVehicle, parser, nil)
+	defer f.Close()
+	_, err = f.Initial()
+	require.NoError(t, err)
+	upper.Store(true)
+	contents, err = f.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, "PAYLOAD:\n- B", contents)
+	assert.Equal(t, 1, memVehicle.Reads())
+}
+
+func TestFetcherSubscribe(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("0")}
+	var onUpdate atomic.Int32
+	parser := func(buf []byte) (string, error) { return string(buf), nil }
+	f := NewFetcher("test", 0, vehicle, parser, func(string) { onUpdate.Add(1) })
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+
+	const updates = 100
+	const readers = 4
+	var wg sync.WaitGroup
+	last := make([]string, readers)
+	for i := 0; i < readers; i++ {
+		ch := f.Subscribe()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for contents := range ch {
+				last[i] = contents
+			}
+		}(i)
+	}
+	stalled := f.Subscribe() // never read, must not block the updates
+
+	for i := 1; i <= updates; i++ {
+		vehicle.Set([]byte(strconv.Itoa(i)), nil)
+		_, _, err := f.Update()
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, updates+1, onUpdate.Load())
+	assert.Equal(t, strconv.Itoa(updates), <-stalled) // only the latest is kept
+
+	// Unsubscribe closes the channel and stops further sends
+	f.Unsubscribe(stalled)
+	_, ok := <-stalled
+	assert.False(t, ok)
+	f.Unsubscribe(stalled) // no-op
+
+	require.NoError(t, f.Close())
+	wg.Wait()
+	for i := 0; i < readers; i++ {
+		assert.Equal(t, strconv.Itoa(updates), last[i])
+	}
+	_, ok = <-f.Subscribe() // closed right away after Close
+	assert.False(t, ok)
+}
+
+func TestFetcherEmptyContent(t *testing.T) {
+	var updates []string
+	parser := func(buf []byte) (string, error) { return string(buf), nil }
+
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	f := NewFetcher("test", time.Hour, vehicle, parser, func(s string) { updates = append(updates, s) })
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+	hash := f.ContentHash()
+
+	// an empty download is a failed update, the previous contents stay
+	vehicle.Set([]byte{}, nil)
+	_, _, err = f.Update()
+	assert.ErrorIs(t, err, ErrEmptyContent)
+	assert.Equal(t, 1, f.FailureCount())
+	assert.EqualValues(t, 1, f.backoff.Attempt())
+	assert.Equal(t, hash, f.ContentHash())
+	assert.Equal(t, []string{"payload:\n- a"}, updates)
+	assert.Empty(t, vehicle.wrote[1:])
+
+	// unless empty is valid for the provider
+	updates = nil
+	vehicle = &mockVehicle{buf: []byte("payload:\n- a")}
+	f = NewFetcher("test", time.Hour, vehicle, parser, func(s string) { updates = append(updates, s) }, WithAllowEmpty[string](true))
+	defer f.Close()
+	_, err = f.Initial()
+	require.NoError(t, err)
+	vehicle.Set([]byte{}, nil)
+	contents, same, err := f.Update()
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Empty(t, contents)
+	assert.Equal(t, []string{"payload:\n- a", ""}, updates)
+	assert.Zero(t, f.ContentSize())
+}
+
+func TestFetcherAdaptiveInterval(t *testing.T) {
+	vehicle := &mockVehicle{buf: []byte("payload:\n- a")}
+	f := NewFetcher("test", time.Hour, vehicle, yamlParser, nil, WithAdaptiveInterval[string](2, 2, 5*time.Hour))
+	defer f.Close()
+	_, err := f.Initial()
+	require.NoError(t, err)
+
+	update := func() {
+		_, _, err := f.Update()
+		require.NoError(t, err)
+	}
+	update()
+	assert.Equal(t, time.Hour, f.Interval()) // one unchanged update isn't enough
+	update()
+	assert.Equal(t, 2*time.Hour, f.Interval())
+	update()
+	update()
+	assert.Equal(t, 4*time.Hour, f.Interval())
+	update()
+	update()
+	assert.Equal(t, 5*time.Hour, f.Interval()) // capped
+	update()
+	update()
+	assert.Equal(t, 5*time.Hour, f.Interval())
+
+	// a change brings the configured interval back and starts counting again
+	vehicle.Set([]byte("payload:\n- b"), nil)
+	update()
+	assert.Equal(t, time.Hour, f.Interval())
+	update()
+	assert.Equal(t, time.Hour, f.Interval())
+	update()
+	assert.Equal(t, 2*time.Hour, f.Interval())
+
+	// SetInterval sets a new base
+	f.SetInterval(3 * time.Hour)
+	vehicle.Set([]byte("payload:\n- c"), nil)
+	update()
+	assert.Equal(t, 3*time.Hour, f.Interval())
+}
+
+func TestFetcherUnixVehicle(t *testing.T) {
+	// t.TempDir can exceed the length limit of a socket path
+	dir, err := os.MkdirTemp("", "mihomo")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "provider.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	var hits atomic.Int32
+	var content atomic.Value
+	content.Store("payload:\n- a")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/rules.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content.Load().(string)))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	path := filepath.Join(dir, "rules.yaml")
+	vehicle := NewUnixVehicle(socketPath, "http://localhost/rules.yaml", path, nil, DefaultHttpTimeout, 0)
+	assert.Equal(t, types.Unix, vehicle.Type())
+	assert.Equal(t, socketPath, vehicle.SocketPath())
+
+	rawParser := func(buf []byte) (string, error) { return string(buf), nil }
+	var loaded atomic.Value
+	f := NewFetcher("test", time.Hour, vehicle, rawParser, func(contents string) { loaded.Store(contents) })
+	defer f.Close()
+	contents, err := f.Initial()
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- a", contents)
+	assert.EqualValues(t, 1, hits.Load())
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "payload:\n- a", string(buf))
+
+	// polled like an http vehicle, not watched like a file
+	content.Store("payload:\n- b")
+	f.SetInterval(20 * time.Millisecond)
+	assert.Eventually(t, func() bool { return loaded.Load() == "payload:\n- b" }, time.Second, 5*time.Millisecond)
+
+	// nothing is dialed but the socket
+	bad := NewUnixVehicle(filepath.Join(dir, "missing.sock"), "http://localhost/rules.yaml", "", nil, DefaultHttpTimeout, 0)
+	_, _, err = bad.Read(context.Background(), utils.HashType{})
+	assert.Error(t, err)
+}
+
+func TestFetcherFailOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0o644))
+	remoteErr := errors.New("remote down")
+	rawParser := func(buf []byte) (string, error) {
+		if !strings.HasPrefix(string(buf), "payload:") {
+			return "", errNotYAML
+		}
+		return string(buf), nil
+	}
+
+	// fail closed by default, the remote error is returned
+	vehicle := &mockVehicle{path: path, err: remoteErr}
+	f := NewFetcher("test", time.Hour, vehicle, rawParser, nil)
+	defer f.Close()
+	_, err := f.Initial()
+	assert.ErrorIs(t, err, remoteErr)
+	assert.Equal(t, 2, f.FailureCount()) // the local parse and the download
+
+	// fail open starts empty and the pull loop picks the content up once the remote is back
+	var loaded atomic.Value
+	vehicle = &mockVehicle{path: path, err: remoteErr}
+	f = NewFetcher("test", 20*time.Millisecond, vehicle, rawParser, func(s string) { loaded.Store(s) }, WithFailOpen[string](true))
+	defer f.Close()
+	contents, err := f.Initial()
+	require.NoError(t, err)
+	assert.Empty(t, contents)
+	assert.Empty(t, loaded.Load())
+
+	vehicle.Set([]byte("payload:\n- a"), nil)
+	assert.Eventually(t, func() bool { return loaded.Load() == "payload:\n- a" }, time.Second, 5*time.Millisecond)
+}
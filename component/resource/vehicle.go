@@ -1,22 +1,37 @@
 package resource
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/metacubex/mihomo/common/atomic"
 	"github.com/metacubex/mihomo/common/utils"
 	mihomoHttp "github.com/metacubex/mihomo/component/http"
 	"github.com/metacubex/mihomo/component/profile/cachefile"
+	C "github.com/metacubex/mihomo/constant"
 	types "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/log"
 )
 
 const (
 	DefaultHttpTimeout = time.Second * 20
+	// DefaultMaxBodySize bounds the body HTTPVehicle reads when no size limit is set
+	DefaultMaxBodySize int64 = 256 << 20
 
 	fileMode os.FileMode = 0o666
 	dirMode  os.FileMode = 0o755
@@ -24,6 +39,9 @@ const (
 
 var (
 	etag = false
+
+	ErrBodyTooLarge = errors.New("response body too large")
+	ErrEmptyContent = errors.New("empty content")
 )
 
 func ETag() bool {
@@ -34,7 +52,15 @@ func SetETag(b bool) {
 	etag = b
 }
 
-func safeWrite(path string, buf []byte) error {
+// writeTempFile is replaced in tests to simulate a write failing halfway
+var writeTempFile = func(f *os.File, buf []byte) error {
+	_, err := f.Write(buf)
+	return err
+}
+
+// safeWrite writes to a temp file in the same directory and renames it into
+// place, so a crash mid-write never leaves a partial file behind
+func safeWrite(path string, buf []byte) (err error) {
 	dir := filepath.Dir(path)
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -43,11 +69,37 @@ func safeWrite(path string, buf []byte) error {
 		}
 	}
 
-	return os.WriteFile(path, buf, fileMode)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if err = writeTempFile(f, buf); err != nil {
+		return err
+	}
+	// CreateTemp makes 0600 files, keep the mode of the file being replaced
+	mode := fileMode &^ 0o022
+	if stat, statErr := os.Stat(path); statErr == nil {
+		mode = stat.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
 
 type FileVehicle struct {
-	path string
+	path       string
+	watchPaths []string
 }
 
 func (f *FileVehicle) Type() types.VehicleType {
@@ -62,12 +114,34 @@ func (f *FileVehicle) Url() string {
 	return "file://" + f.path
 }
 
+// SetWatchPaths adds files the content depends on, a change to any of them
+// reloads the content as if path itself changed
+func (f *FileVehicle) SetWatchPaths(paths []string) {
+	f.watchPaths = paths
+}
+
+// WatchPaths returns every file to watch, path first
+func (f *FileVehicle) WatchPaths() []string {
+	return append([]string{f.path}, f.watchPaths...)
+}
+
 func (f *FileVehicle) Read(ctx context.Context, oldHash utils.HashType) (buf []byte, hash utils.HashType, err error) {
 	buf, err = os.ReadFile(f.path)
 	if err != nil {
 		return
 	}
-	hash = utils.MakeHash(buf)
+	if len(f.watchPaths) == 0 {
+		hash = utils.MakeHash(buf)
+		return
+	}
+	// hash the watched files too, so a change to any of them is not "unchanged"
+	all := append([]byte(nil), buf...)
+	for _, path := range f.watchPaths {
+		if watched, err := os.ReadFile(path); err == nil {
+			all = append(all, watched...)
+		}
+	}
+	hash = utils.MakeHash(all)
 	return
 }
 
@@ -83,15 +157,33 @@ func NewFileVehicle(path string) *FileVehicle {
 	return &FileVehicle{path: path}
 }
 
+// httpValidator holds the cache validators of the last successful fetch
+type httpValidator struct {
+	url          string
+	hash         utils.HashType
+	etag         string
+	lastModified string
+}
+
 type HTTPVehicle struct {
-	url       string
-	path      string
-	proxy     string
-	header    http.Header
-	timeout   time.Duration
-	sizeLimit int64
-	inRead    func(response *http.Response)
-	provider  types.ProxyProvider
+	url        string
+	path       string
+	proxy      string
+	dialer     C.Dialer
+	header     http.Header
+	timeout    time.Duration
+	sizeLimit  int64
+	inRead     func(response *http.Response)
+	provider   types.ProxyProvider
+	validator  atomic.TypedValue[httpValidator]
+	decompress bool
+	mirrors    []string
+	preferred  atomic.Int32 // index of the last url that worked, 0 is url itself
+	memoryOnly bool
+	cacheDir   string
+
+	contentTypes      []string
+	strictContentType bool
 }
 
 func (h *HTTPVehicle) Url() string {
@@ -103,6 +195,31 @@ func (h *HTTPVehicle) Type() types.VehicleType {
 }
 
 func (h *HTTPVehicle) Path() string {
+	if h.memoryOnly {
+		return ""
+	}
+	if h.cacheDir != "" {
+		return filepath.Join(h.cacheDir, h.cacheName())
+	}
+	return h.path
+}
+
+// cacheName keys the cache file on the whole configured path, so paths that only share
+// the file name don't overwrite each other. It's the path relative to the home dir, or a
+// hash of it when the path is outside.
+func (h *HTTPVehicle) cacheName() string {
+	if rel, err := filepath.Rel(C.Path.HomeDir(), h.path); err == nil && filepath.IsLocal(rel) {
+		return rel
+	}
+	return utils.MakeHash([]byte(h.path)).String() + "-" + filepath.Base(h.path)
+}
+
+// SeedPath returns the configured path when a cache dir is set, the content there
+// is read until the cache has its own copy
+func (h *HTTPVehicle) SeedPath() string {
+	if h.memoryOnly || h.cacheDir == "" {
+		return ""
+	}
 	return h.path
 }
 
@@ -111,31 +228,144 @@ func (h *HTTPVehicle) Proxy() string {
 }
 
 func (h *HTTPVehicle) Write(buf []byte) error {
-	return safeWrite(h.path, buf)
+	if h.memoryOnly {
+		return nil
+	}
+	return safeWrite(h.Path(), buf)
+}
+
+// SetMemoryOnly keeps the fetched content in memory only, Path returns empty
+// and Write does nothing, so every start fetches from remote
+func (h *HTTPVehicle) SetMemoryOnly(memoryOnly bool) {
+	h.memoryOnly = memoryOnly
+}
+
+// SetCacheDir makes Path point into dir, keyed on the configured path, so the content is
+// written there while the configured path, e.g. in a read-only config dir, is left alone
+func (h *HTTPVehicle) SetCacheDir(dir string) {
+	h.cacheDir = dir
+}
+
+// SetDialer makes Read dial through d, e.g. a proxy dialer, in place of the proxy set
+// by name. A failing d fails the read, nothing is dialed directly instead.
+func (h *HTTPVehicle) SetDialer(d C.Dialer) {
+	h.dialer = d
 }
 
 func (h *HTTPVehicle) SetInRead(fn func(response *http.Response)) {
 	h.inRead = fn
 }
 
+// SetDecompress makes Read decode gzip/deflate bodies by Content-Encoding,
+// so the parser and the hash always see the decompressed bytes
+func (h *HTTPVehicle) SetDecompress(decompress bool) {
+	h.decompress = decompress
+}
+
+// SetMirrors sets fallback urls tried in order when url fails, the one that
+// succeeds is tried first next time
+func (h *HTTPVehicle) SetMirrors(mirrors []string) {
+	h.mirrors = mirrors
+}
+
+// SetContentTypes makes Read reject responses whose Content-Type matches none
+// of contentTypes, "type/*" matches any subtype. A response without
+// Content-Type is only rejected in strict mode
+func (h *HTTPVehicle) SetContentTypes(contentTypes []string, strict bool) {
+	h.contentTypes = contentTypes
+	h.strictContentType = strict
+}
+
+func (h *HTTPVehicle) checkContentType(contentType string) error {
+	if len(h.contentTypes) == 0 {
+		return nil
+	}
+	if contentType == "" {
+		if h.strictContentType {
+			return fmt.Errorf("missing content type, expected one of %s", strings.Join(h.contentTypes, ", "))
+		}
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	for _, expected := range h.contentTypes {
+		if prefix, ok := strings.CutSuffix(expected, "/*"); ok {
+			if typ, _, _ := strings.Cut(mediaType, "/"); strings.EqualFold(typ, prefix) {
+				return nil
+			}
+		} else if strings.EqualFold(mediaType, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected content type %s, expected one of %s", contentType, strings.Join(h.contentTypes, ", "))
+}
+
 func (h *HTTPVehicle) Read(ctx context.Context, oldHash utils.HashType) (buf []byte, hash utils.HashType, err error) {
+	if len(h.mirrors) == 0 {
+		return h.read(ctx, h.url, oldHash)
+	}
+	urls := append([]string{h.url}, h.mirrors...)
+	preferred := int(h.preferred.Load())
+	errs := make([]error, 0, len(urls))
+	for i := range urls {
+		idx := (preferred + i) % len(urls)
+		buf, hash, err = h.read(ctx, urls[idx], oldHash)
+		if err == nil {
+			h.preferred.Store(int32(idx))
+			return
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", urls[idx], err))
+	}
+	return nil, utils.HashType{}, errors.Join(errs...)
+}
+
+func (h *HTTPVehicle) read(ctx context.Context, url string, oldHash utils.HashType) (buf []byte, hash utils.HashType, err error) {
 	ctx, cancel := context.WithTimeout(ctx, h.timeout)
 	defer cancel()
 	header := h.header
-	setIfNoneMatch := false
-	if etag && oldHash.IsValid() {
-		etagWithHash := cachefile.Cache().GetETagWithHash(h.url)
-		if oldHash.Equal(etagWithHash.Hash) && etagWithHash.ETag != "" {
+	cloned := false
+	setHeader := func(key, value string) {
+		if !cloned {
 			if header == nil {
 				header = http.Header{}
 			} else {
 				header = header.Clone()
 			}
-			header.Set("If-None-Match", etagWithHash.ETag)
-			setIfNoneMatch = true
+			cloned = true
+		}
+		header.Set(key, value)
+	}
+	conditional := false
+	if validator, ok := h.validator.LoadOk(); ok && validator.url == url && oldHash.IsValid() && oldHash.Equal(validator.hash) {
+		// only revalidate the content the caller already holds
+		if validator.etag != "" {
+			setHeader("If-None-Match", validator.etag)
+			conditional = true
+		}
+		if validator.lastModified != "" {
+			setHeader("If-Modified-Since", validator.lastModified)
+			conditional = true
+		}
+	} else if etag && oldHash.IsValid() {
+		etagWithHash := cachefile.Cache().GetETagWithHash(url)
+		if oldHash.Equal(etagWithHash.Hash) && etagWithHash.ETag != "" {
+			setHeader("If-None-Match", etagWithHash.ETag)
+			conditional = true
 		}
 	}
-	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, h.url, http.MethodGet, header, nil, h.proxy)
+	if h.decompress && header.Get("Accept-Encoding") == "" {
+		// net/http only decodes the gzip it asks for itself, ask for both and decode here
+		setHeader("Accept-Encoding", "gzip, deflate")
+	}
+	log.Debugln("[Provider] fetching %s with header %v", url, redactHeader(header))
+	var resp *http.Response
+	if h.dialer != nil {
+		resp, err = mihomoHttp.HttpRequestWithDialer(ctx, url, http.MethodGet, header, nil, h.dialer)
+	} else {
+		resp, err = mihomoHttp.HttpRequestWithProxy(ctx, url, http.MethodGet, header, nil, h.proxy)
+	}
 	if err != nil {
 		return
 	}
@@ -146,23 +376,52 @@ func (h *HTTPVehicle) Read(ctx context.Context, oldHash utils.HashType) (buf []b
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		if setIfNoneMatch && resp.StatusCode == http.StatusNotModified {
+		if conditional && resp.StatusCode == http.StatusNotModified {
 			return nil, oldHash, nil
 		}
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			err = &RetryAfterError{Status: resp.Status, RetryAfter: retryAfter}
+			return
+		}
 		err = errors.New(resp.Status)
 		return
 	}
+	if err = h.checkContentType(resp.Header.Get("Content-Type")); err != nil {
+		return
+	}
 	var reader io.Reader = resp.Body
-	if h.sizeLimit > 0 {
-		reader = io.LimitReader(reader, h.sizeLimit)
+	if h.decompress {
+		if reader, err = decompressReader(resp.Header.Get("Content-Encoding"), reader); err != nil {
+			return
+		}
+	}
+	limit := h.sizeLimit
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
 	}
-	buf, err = io.ReadAll(reader)
+	if resp.ContentLength > limit && !h.decompress {
+		err = fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrBodyTooLarge, resp.ContentLength, limit)
+		return
+	}
+	// read one byte past the limit to tell a body of exactly limit bytes from a larger one
+	buf, err = io.ReadAll(io.LimitReader(reader, limit+1))
 	if err != nil {
 		return
 	}
+	if int64(len(buf)) > limit {
+		buf = nil
+		err = fmt.Errorf("%w: exceeds the limit of %d bytes", ErrBodyTooLarge, limit)
+		return
+	}
 	hash = utils.MakeHash(buf)
+	h.validator.Store(httpValidator{
+		url:          url,
+		hash:         hash,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	})
 	if etag {
-		cachefile.Cache().SetETagWithHash(h.url, cachefile.EtagWithHash{
+		cachefile.Cache().SetETagWithHash(url, cachefile.EtagWithHash{
 			Hash: hash,
 			ETag: resp.Header.Get("ETag"),
 			Time: time.Now(),
@@ -171,6 +430,127 @@ func (h *HTTPVehicle) Read(ctx context.Context, oldHash utils.HashType) (buf []b
 	return
 }
 
+// sensitiveHeaders are redacted by redactHeader, along with any header whose
+// name mentions a token, secret or key
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactHeader returns a copy of header safe to log, values of sensitive
+// headers are replaced
+func redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for key, values := range header {
+		sensitive := false
+		for _, name := range sensitiveHeaders {
+			if strings.EqualFold(key, name) {
+				sensitive = true
+				break
+			}
+		}
+		lower := strings.ToLower(key)
+		if strings.Contains(lower, "token") || strings.Contains(lower, "secret") || strings.Contains(lower, "key") {
+			sensitive = true
+		}
+		if !sensitive {
+			redacted[key] = values
+			continue
+		}
+		masked := make([]string, len(values))
+		for i := range values {
+			masked[i] = "<redacted>"
+		}
+		redacted[key] = masked
+	}
+	return redacted
+}
+
+// RetryAfterError is returned by HTTPVehicle.Read when the server asks to
+// retry later, e.g. 429 or 503 with a Retry-After header
+type RetryAfterError struct {
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Status, e.RetryAfter)
+}
+
+// parseRetryAfter accepts both delay-seconds and HTTP-date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if retryAfter := time.Until(date); retryAfter > 0 {
+			return retryAfter, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func decompressReader(encoding string, reader io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return reader, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(reader)
+	case "deflate":
+		// "deflate" should be zlib wrapped, but some servers send raw deflate
+		bufReader := bufio.NewReader(reader)
+		header, err := bufReader.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(bufReader)
+		}
+		return flate.NewReader(bufReader), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// UnixVehicle fetches over HTTP from a server listening on a Unix domain socket, every
+// connection goes to socketPath and the host in url is only sent as the Host header
+type UnixVehicle struct {
+	*HTTPVehicle
+	socketPath string
+}
+
+func (u *UnixVehicle) Type() types.VehicleType {
+	return types.Unix
+}
+
+func (u *UnixVehicle) SocketPath() string {
+	return u.socketPath
+}
+
+// unixDialer dials path whatever address it is asked for
+type unixDialer struct {
+	path string
+}
+
+func (d unixDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", d.path)
+}
+
+func (d unixDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	return nil, errors.New("unix socket vehicle doesn't support udp")
+}
+
+// NewUnixVehicle returns a vehicle that issues a GET for url over the Unix socket at socketPath,
+// e.g. url "http://localhost/rules.yaml", the rest works like NewHTTPVehicle
+func NewUnixVehicle(socketPath string, url string, path string, header http.Header, timeout time.Duration, sizeLimit int64) *UnixVehicle {
+	vehicle := NewHTTPVehicle(url, path, "", header, timeout, sizeLimit)
+	vehicle.SetDialer(unixDialer{path: socketPath})
+	return &UnixVehicle{HTTPVehicle: vehicle, socketPath: socketPath}
+}
+
 func NewHTTPVehicle(url string, path string, proxy string, header http.Header, timeout time.Duration, sizeLimit int64) *HTTPVehicle {
 	return &HTTPVehicle{
 		url:       url,
@@ -126,6 +126,16 @@ type EncryptedClientHelloKey = utls.EncryptedClientHelloKey
 
 type Config = utls.Config
 
+type ConnectionState = utls.ConnectionState
+
+type ClientHelloInfo = utls.ClientHelloInfo
+
+type ClientSessionCache = utls.ClientSessionCache
+
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	return utls.NewLRUClientSessionCache(capacity)
+}
+
 func UConfig(config *tls.Config) *utls.Config {
 	return &utls.Config{
 		Rand:                  config.Rand,
@@ -108,8 +108,36 @@ type ProxyInfo struct {
 	Interface   string
 	RoutingMark int
 	DialerProxy string
+	ECH         ECHState
+	Addr        string // configured server host:port, without credentials
 }
 
+// Capabilities is a bitset of the features an adapter supports
+type Capabilities uint8
+
+const (
+	CapUDP Capabilities = 1 << iota
+	CapXUDP
+	CapTFO
+	CapMPTCP
+	CapUOT
+)
+
+// Has reports whether all of the given capabilities are set
+func (c Capabilities) Has(caps Capabilities) bool {
+	return c&caps == caps
+}
+
+// ECHState is the outcome of Encrypted Client Hello, empty for adapters not reporting it
+type ECHState string
+
+const (
+	ECHNotConfigured ECHState = "not-configured"
+	ECHPending       ECHState = "pending" // configured, no handshake done yet
+	ECHAccepted      ECHState = "accepted"
+	ECHRejected      ECHState = "rejected" // handshake done without ech
+)
+
 type ProxyAdapter interface {
 	Name() string
 	Type() AdapterType
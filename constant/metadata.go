@@ -186,6 +186,9 @@ type Metadata struct {
 	SpecialRules string     `json:"specialRules"`
 	RemoteDst    string     `json:"remoteDestination"`
 	DSCP         uint8      `json:"dscp"`
+	// IPVersion asks for an ip version when dialing this connection, it overrides the
+	// proxy's ip-version unless left DualStack, see outbound.Base.DialOptionsFor
+	IPVersion DNSPrefer `json:"-"`
 
 	RawSrcAddr net.Addr `json:"-"`
 	RawDstAddr net.Addr `json:"-"`
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/metacubex/mihomo/common/structure"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/proxydialer"
 	"github.com/metacubex/mihomo/component/resource"
 	C "github.com/metacubex/mihomo/constant"
 	P "github.com/metacubex/mihomo/constant/provider"
@@ -12,15 +14,20 @@ import (
 )
 
 type ruleProviderSchema struct {
-	Type      string   `provider:"type"`
-	Behavior  string   `provider:"behavior"`
-	Path      string   `provider:"path,omitempty"`
-	URL       string   `provider:"url,omitempty"`
-	Proxy     string   `provider:"proxy,omitempty"`
-	Format    string   `provider:"format,omitempty"`
-	Interval  int      `provider:"interval,omitempty"`
-	SizeLimit int64    `provider:"size-limit,omitempty"`
-	Payload   []string `provider:"payload,omitempty"`
+	Type        string              `provider:"type"`
+	Behavior    string              `provider:"behavior"`
+	Path        string              `provider:"path,omitempty"`
+	URL         string              `provider:"url,omitempty"`
+	Mirrors     []string            `provider:"mirrors,omitempty"`
+	Proxy       string              `provider:"proxy,omitempty"`
+	DialerProxy string              `provider:"dialer-proxy,omitempty"`
+	Format      string              `provider:"format,omitempty"`
+	Interval    int                 `provider:"interval,omitempty"`
+	SizeLimit   int64               `provider:"size-limit,omitempty"`
+	MemoryOnly  bool                `provider:"memory-only,omitempty"`
+	CacheDir    string              `provider:"cache-dir,omitempty"`
+	Payload     []string            `provider:"payload,omitempty"`
+	Header      map[string][]string `provider:"header,omitempty"`
 }
 
 func ParseRuleProvider(name string, mapping map[string]any, parse common.ParseRuleFunc) (P.RuleProvider, error) {
@@ -51,7 +58,21 @@ func ParseRuleProvider(name string, mapping map[string]any, parse common.ParseRu
 				return nil, C.Path.ErrNotSafePath(path)
 			}
 		}
-		vehicle = resource.NewHTTPVehicle(schema.URL, path, schema.Proxy, nil, resource.DefaultHttpTimeout, schema.SizeLimit)
+		httpVehicle := resource.NewHTTPVehicle(schema.URL, path, schema.Proxy, schema.Header, resource.DefaultHttpTimeout, schema.SizeLimit)
+		httpVehicle.SetDecompress(true)
+		httpVehicle.SetMirrors(schema.Mirrors)
+		httpVehicle.SetMemoryOnly(schema.MemoryOnly)
+		if schema.DialerProxy != "" {
+			httpVehicle.SetDialer(proxydialer.NewLazyByName(schema.DialerProxy, dialer.NewDialer()))
+		}
+		if schema.CacheDir != "" {
+			cacheDir := C.Path.Resolve(schema.CacheDir)
+			if !C.Path.IsSafePath(cacheDir) {
+				return nil, C.Path.ErrNotSafePath(cacheDir)
+			}
+			httpVehicle.SetCacheDir(cacheDir)
+		}
+		vehicle = httpVehicle
 	case "inline":
 		return NewInlineProvider(name, behavior, schema.Payload, parse), nil
 	default:
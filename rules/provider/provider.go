@@ -111,7 +111,7 @@ func (rp *ruleSetProvider) Initial() error {
 }
 
 func (rp *ruleSetProvider) Update() error {
-	_, _, err := rp.Fetcher.Update()
+	_, _, err := rp.Fetcher.Refresh()
 	return err
 }
 
@@ -152,7 +152,7 @@ func NewRuleSetProvider(name string, behavior P.RuleBehavior, format P.RuleForma
 	}
 	rp.Fetcher = resource.NewFetcher(name, interval, vehicle, func(bytes []byte) (ruleStrategy, error) {
 		return rulesParse(bytes, newStrategy(behavior, parse), format)
-	}, onUpdate)
+	}, onUpdate, resource.WithResourceType[ruleStrategy](P.Rule.String()))
 
 	wrapper := &RuleSetProvider{
 		rp,
@@ -1,12 +1,15 @@
 package congestion
 
 import (
-	"github.com/metacubex/quic-go/congestion"
+	"sync/atomic"
 	"time"
+
+	"github.com/metacubex/quic-go/congestion"
 )
 
 const (
-	initMaxDatagramSize = 1252
+	initMaxDatagramSize  = 1252
+	initCongestionWindow = 10240 // bytes, used until the first rtt sample
 
 	pktInfoSlotCount = 5 // slot index is based on seconds, so this is basically how many seconds we sample
 	minSampleCount   = 50
@@ -17,8 +20,9 @@ var _ congestion.CongestionControlEx = &BrutalSender{}
 
 type BrutalSender struct {
 	rttStats        congestion.RTTStatsProvider
-	bps             congestion.ByteCount
+	bps             atomic.Uint64
 	maxDatagramSize congestion.ByteCount
+	initCwnd        congestion.ByteCount // packets, 0 for initCongestionWindow
 	pacer           *pacer
 
 	pktInfoSlots [pktInfoSlotCount]pktInfo
@@ -33,16 +37,32 @@ type pktInfo struct {
 
 func NewBrutalSender(bps congestion.ByteCount) *BrutalSender {
 	bs := &BrutalSender{
-		bps:             bps,
 		maxDatagramSize: initMaxDatagramSize,
 		ackRate:         1,
 	}
+	bs.bps.Store(uint64(bps))
 	bs.pacer = newPacer(func() congestion.ByteCount {
-		return congestion.ByteCount(float64(bs.bps) / bs.ackRate)
+		return congestion.ByteCount(float64(bs.bps.Load()) / bs.ackRate)
 	})
 	return bs
 }
 
+// BPS returns the target send rate in bytes per second
+func (b *BrutalSender) BPS() congestion.ByteCount {
+	return congestion.ByteCount(b.bps.Load())
+}
+
+// SetBPS changes the target send rate, it is safe to call while the connection is in use
+func (b *BrutalSender) SetBPS(bps congestion.ByteCount) {
+	b.bps.Store(uint64(bps))
+}
+
+// SetInitCongestionWindow sets the window in packets used before the first rtt sample,
+// once the rtt is known the window follows the target send rate as usual
+func (b *BrutalSender) SetInitCongestionWindow(packets congestion.ByteCount) {
+	b.initCwnd = packets
+}
+
 func (b *BrutalSender) SetRTTStatsProvider(rttStats congestion.RTTStatsProvider) {
 	b.rttStats = rttStats
 }
@@ -62,9 +82,12 @@ func (b *BrutalSender) CanSend(bytesInFlight congestion.ByteCount) bool {
 func (b *BrutalSender) GetCongestionWindow() congestion.ByteCount {
 	rtt := maxDuration(b.rttStats.LatestRTT(), b.rttStats.SmoothedRTT())
 	if rtt <= 0 {
-		return 10240
+		if b.initCwnd > 0 {
+			return b.initCwnd * b.maxDatagramSize
+		}
+		return initCongestionWindow
 	}
-	return congestion.ByteCount(float64(b.bps) * rtt.Seconds() * 1.5 / b.ackRate)
+	return congestion.ByteCount(float64(b.bps.Load()) * rtt.Seconds() * 1.5 / b.ackRate)
 }
 
 func (b *BrutalSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount,
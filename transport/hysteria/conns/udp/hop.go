@@ -25,6 +25,7 @@ type ObfsUDPHopClientPacketConn struct {
 	serverAddr  net.Addr // Combined udpHopAddr
 	serverAddrs []net.Addr
 	hopInterval time.Duration
+	keepLocal   bool // hop the server port only, the server keeps seeing the same client address
 
 	obfs obfs.Obfuscator
 
@@ -59,8 +60,10 @@ type udpPacket struct {
 	addr net.Addr
 }
 
-func NewObfsUDPHopClientPacketConn(server string, serverPorts string, hopInterval time.Duration, obfs obfs.Obfuscator, dialer utils.PacketDialer) (net.PacketConn, error) {
-	ports, err := parsePorts(serverPorts)
+// NewObfsUDPHopClientPacketConn dials server hopping between serverPorts. With keepLocal the local
+// socket is kept across hops, so the connection is never migrated to a new client address.
+func NewObfsUDPHopClientPacketConn(server string, serverPorts string, hopInterval time.Duration, keepLocal bool, obfs obfs.Obfuscator, dialer utils.PacketDialer) (net.PacketConn, error) {
+	ports, err := ParsePorts(serverPorts)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +88,7 @@ func NewObfsUDPHopClientPacketConn(server string, serverPorts string, hopInterva
 		serverAddr:  &hopAddr,
 		serverAddrs: serverAddrs,
 		hopInterval: hopInterval,
+		keepLocal:   keepLocal,
 		obfs:        obfs,
 		addrIndex:   randv2.IntN(len(serverAddrs)),
 		recvQueue:   make(chan *udpPacket, packetQueueSize),
@@ -147,6 +151,10 @@ func (c *ObfsUDPHopClientPacketConn) hop(dialer utils.PacketDialer, rAddr net.Ad
 	if c.closed {
 		return
 	}
+	if c.keepLocal {
+		c.addrIndex = randv2.IntN(len(c.serverAddrs))
+		return
+	}
 	newConn, err := dialer.ListenPacket(rAddr)
 	if err != nil {
 		// Skip this hop if failed to listen
@@ -323,10 +331,10 @@ func (c *ObfsUDPHopClientPacketConnWithSyscall) SyscallConn() (syscall.RawConn,
 	return sc.SyscallConn()
 }
 
-// parsePorts parses the multi-port server address and returns the host and ports.
+// ParsePorts parses the multi-port server address and returns the host and ports.
 // Supports both comma-separated single ports and dash-separated port ranges.
 // Format: "host:port1,port2-port3,port4"
-func parsePorts(serverPorts string) (ports []uint16, err error) {
+func ParsePorts(serverPorts string) (ports []uint16, err error) {
 	portStrs := strings.Split(serverPorts, ",")
 	for _, portStr := range portStrs {
 		if strings.Contains(portStr, "-") {
@@ -5,11 +5,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/metacubex/mihomo/common/atomic"
+	"github.com/metacubex/mihomo/common/contextutils"
 	tlsC "github.com/metacubex/mihomo/component/tls"
 	"github.com/metacubex/mihomo/transport/hysteria/obfs"
 	"github.com/metacubex/mihomo/transport/hysteria/pmtud_fix"
@@ -24,32 +27,111 @@ import (
 
 var (
 	ErrClosed = errors.New("closed")
+	ErrAuth   = errors.New("auth error")
+
+	ErrRejected = errors.New("connection rejected")
+
+	ErrUDPRejected = errors.New("udp rejected")
+
+	ErrDatagramTooLarge = errors.New("hysteria: datagram too large")
 )
 
 type CongestionFactory func(refBPS uint64) congestion.CongestionControl
 
+// StreamObserver is optionally implemented by the PacketDialer passed to DialTCP and DialUDP,
+// it is told once the stream of a successful dial is closed
+type StreamObserver interface {
+	StreamClosed()
+}
+
+// ConnectObserver is optionally implemented by the PacketDialer passed to DialTCP and DialUDP,
+// it is told when a new connection to the server has been established for the dial
+type ConnectObserver interface {
+	Connected()
+}
+
+// ObfsOverride is optionally implemented by the PacketDialer passed to DialTCP and DialUDP to dial
+// with another obfuscator than the client's, nil for none, when override is true. Such a dial gets
+// a connection of its own, closed along with its stream.
+type ObfsOverride interface {
+	ObfsOverride() (obfuscator obfs.Obfuscator, override bool)
+}
+
+// DedicatedConn is optionally implemented by the PacketDialer passed to DialTCP and DialUDP. A dial
+// with a non nil DedicatedKey doesn't share the client's connection, which was dialed with another
+// dialer: dials with equal keys share a connection of their own, reused like the client's and closed
+// along with the client. A key which can't key a map gets a connection per stream instead.
+type DedicatedConn interface {
+	DedicatedKey() any
+}
+
+// connSlot holds the connection shared by the dials of a DedicatedKey
+type connSlot struct {
+	access  sync.Mutex // held while a stream is opened, so the connection is dialed once
+	session atomic.TypedValue[quic.Connection]
+}
+
+// ServerInfo is what the server announced when the latest own connection was established, see
+// Client.ServerInfo
+type ServerInfo struct {
+	Version     uint8  // protocol version the server accepted
+	Message     string // message of the server hello
+	SendBPS     uint64 // rates of the server hello, in bytes per second
+	RecvBPS     uint64
+	ALPN        string // negotiated application protocol
+	Datagrams   bool   // the server accepts QUIC datagrams, which native udp relies on
+	UDPRejected bool   // the server has turned down a udp session
+}
+
+// connCongestion is the congestion control of a connection and the rate the server announced on it
+type connCongestion struct {
+	control   congestion.CongestionControl
+	serverBPS uint64
+}
+
 type Client struct {
 	transport         *transport.ClientTransport
 	serverAddr        string
 	serverPorts       string
 	protocol          string
-	sendBPS, recvBPS  uint64
-	auth              []byte
+	sendBPS, recvBPS  atomic.Uint64
+	auth              atomic.TypedValue[[]byte]
 	congestionFactory CongestionFactory
 	obfuscator        obfs.Obfuscator
 
-	tlsConfig  *tlsC.Config
-	quicConfig *quic.Config
+	tlsConfig   *tlsC.Config
+	quicConfig  *quic.Config
+	serverNames atomic.TypedValue[[]string]
 
 	quicSession    quic.Connection
 	reconnectMutex sync.Mutex
 	closed         bool
+	streamSeq      uint64 // count of opened streams, protected by reconnectMutex
+
+	dedicatedSlots map[any]*connSlot // by DedicatedKey, protected by reconnectMutex
 
 	udpSessionMutex sync.RWMutex
-	udpSessionMap   map[uint32]chan *udpMessage
+	udpSessionMaps  map[quic.Connection]map[uint32]chan *udpMessage // udp sessions by the connection they are opened on
 	udpDefragger    defragger
 	hopInterval     time.Duration
 	fastOpen        bool
+
+	congestionMutex       sync.Mutex                          // connections are dialed concurrently when they aren't shared
+	ignoreServerBandwidth bool                                // protected by congestionMutex
+	serverBPS             uint64                              // rate announced on the latest connection, protected by congestionMutex
+	congestions           map[quic.Connection]*connCongestion // of the live connections, protected by congestionMutex
+	congestionBPS         atomic.Uint64
+	clamped               atomic.Bool
+
+	connReuse     bool // protected by reconnectMutex
+	activeStreams atomic.Int64
+
+	handshaked  atomic.Bool
+	echAccepted atomic.Bool
+	serverInfo  atomic.TypedValue[*ServerInfo]
+	udpRejected atomic.Bool
+
+	datagramSize atomic.Int64 // largest datagram payload of the connection, learned once a write has to fragment
 }
 
 func NewClient(serverAddr string, serverPorts string, protocol string, auth []byte, tlsConfig *tlsC.Config, quicConfig *quic.Config,
@@ -61,79 +143,283 @@ func NewClient(serverAddr string, serverPorts string, protocol string, auth []by
 		serverAddr:        serverAddr,
 		serverPorts:       serverPorts,
 		protocol:          protocol,
-		sendBPS:           sendBPS,
-		recvBPS:           recvBPS,
-		auth:              auth,
 		congestionFactory: congestionFactory,
 		obfuscator:        obfuscator,
 		tlsConfig:         tlsConfig,
 		quicConfig:        quicConfig,
 		hopInterval:       hopInterval,
 		fastOpen:          fastOpen,
+		connReuse:         true,
 	}
+	c.sendBPS.Store(sendBPS)
+	c.recvBPS.Store(recvBPS)
+	c.auth.Store(auth)
 	return c, nil
 }
 
-func (c *Client) connectToServer(dialer utils.PacketDialer) error {
-	qs, err := c.transport.QUICDial(c.protocol, c.serverAddr, c.serverPorts, c.tlsConfig, c.quicConfig, c.obfuscator, c.hopInterval, dialer)
-	if err != nil {
-		return err
+// Auth returns the auth payload sent in the client hello
+func (c *Client) Auth() []byte {
+	return c.auth.Load()
+}
+
+// SetIgnoreServerBandwidth makes later connections feed the local send rate to the
+// congestion control instead of the rate announced by the server
+func (c *Client) SetIgnoreServerBandwidth(ignore bool) {
+	c.congestionMutex.Lock()
+	defer c.congestionMutex.Unlock()
+	c.ignoreServerBandwidth = ignore
+}
+
+// SetRates changes the send and receive rates in bytes per second. Later connections announce
+// them in the client hello, the live ones only apply the new send rate to their congestion
+// control, each still capped by the rate the server announced on it unless the server bandwidth
+// is ignored.
+func (c *Client) SetRates(up, down uint64) {
+	c.congestionMutex.Lock()
+	defer c.congestionMutex.Unlock()
+	c.sendBPS.Store(up)
+	c.recvBPS.Store(down)
+	if len(c.congestions) == 0 {
+		return
 	}
-	// Control stream
-	ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
-	stream, err := qs.OpenStreamSync(ctx)
-	ctxCancel()
+	refBPS := c.refBPS(up, c.serverBPS)
+	c.congestionBPS.Store(refBPS)
+	c.clamped.Store(refBPS != up)
+	for _, cc := range c.congestions {
+		if setter, ok := cc.control.(interface{ SetBPS(congestion.ByteCount) }); ok {
+			setter.SetBPS(congestion.ByteCount(c.refBPS(up, cc.serverBPS)))
+		}
+	}
+}
+
+// refBPS returns the rate handed to the congestion control of a connection the server announced
+// serverBPS on, with congestionMutex held
+func (c *Client) refBPS(sendBPS, serverBPS uint64) uint64 {
+	if !c.ignoreServerBandwidth && serverBPS < sendBPS {
+		return serverBPS
+	}
+	return sendBPS
+}
+
+// SetConnReuse controls whether streams share one QUIC connection. When enabled (the default)
+// every stream is multiplexed over the current connection, which is only replaced once opening
+// a stream on it fails: streams in flight on a dead connection error out and the next dial
+// reconnects. When disabled every stream dials its own connection, closed along with the stream.
+func (c *Client) SetConnReuse(reuse bool) {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+	c.connReuse = reuse
+}
+
+// ActiveStreams returns the number of TCP and UDP streams opened and not yet closed
+func (c *Client) ActiveStreams() int {
+	return int(c.activeStreams.Load())
+}
+
+// ECHAccepted reports whether the server accepted Encrypted Client Hello on the latest own
+// connection, handshaked is false until one is established. Own connections are dialed with the
+// client's obfuscator and without a DedicatedKey, the side connections of the other dials don't count.
+func (c *Client) ECHAccepted() (accepted bool, handshaked bool) {
+	return c.echAccepted.Load(), c.handshaked.Load()
+}
+
+// ServerInfo returns what the server announced on the latest own connection, ok is false until
+// one is established, see ECHAccepted
+func (c *Client) ServerInfo() (info ServerInfo, ok bool) {
+	latest := c.serverInfo.Load()
+	if latest == nil {
+		return ServerInfo{}, false
+	}
+	info = *latest
+	info.UDPRejected = c.udpRejected.Load()
+	return info, true
+}
+
+// MaxUDPPayloadSize returns the largest udp payload the connection carries, derived from the
+// datagram size it negotiated once a write had to fragment, the protocol limit until then.
+// Destinations given by long domain names leave a little less
+func (c *Client) MaxUDPPayloadSize() int {
+	if size := c.datagramSize.Load(); size > 0 {
+		return maxFragPayloadSize(udpMessage{}, int(size))
+	}
+	return MaxUDPPayloadSize
+}
+
+// CongestionBPS returns the send rate handed to the congestion control of the current connection
+func (c *Client) CongestionBPS() uint64 {
+	return c.congestionBPS.Load()
+}
+
+// Clamped reports whether the current connection uses the server announced rate
+// in place of the local send rate
+func (c *Client) Clamped() bool {
+	return c.clamped.Load()
+}
+
+// HopInterval returns the port hopping interval
+func (c *Client) HopInterval() time.Duration {
+	return c.hopInterval
+}
+
+// SetServerNames makes every connection to the server send an SNI picked at random
+// from names, the ServerName of the tls config is used when names is empty
+func (c *Client) SetServerNames(names []string) {
+	c.serverNames.Store(names)
+}
+
+// dialTLSConfig returns the tls config of a new connection to the server
+func (c *Client) dialTLSConfig() *tlsC.Config {
+	names := c.serverNames.Load()
+	if len(names) == 0 {
+		return c.tlsConfig
+	}
+	tlsConfig := c.tlsConfig.Clone()
+	tlsConfig.ServerName = names[randv2.IntN(len(names))]
+	return tlsConfig
+}
+
+// SetAuth replaces the auth payload, it takes effect on the next connection to the server
+func (c *Client) SetAuth(auth []byte) {
+	c.auth.Store(auth)
+}
+
+// dialObfuscator returns the obfuscator of a connection dialed with dialer, see ObfsOverride
+func (c *Client) dialObfuscator(dialer utils.PacketDialer) (obfs.Obfuscator, bool) {
+	if o, ok := dialer.(ObfsOverride); ok {
+		if obfuscator, override := o.ObfsOverride(); override {
+			return obfuscator, true
+		}
+	}
+	return c.obfuscator, false
+}
+
+func (c *Client) connectToServer(dialer utils.PacketDialer) (quic.Connection, error) {
+	obfuscator, _ := c.dialObfuscator(dialer)
+	qs, err := c.transport.QUICDial(c.protocol, c.serverAddr, c.serverPorts, c.dialTLSConfig(), c.quicConfig, obfuscator, c.hopInterval, c.fastOpen, dialer)
 	if err != nil {
-		_ = qs.CloseWithError(closeErrorCodeProtocol, "protocol error")
-		return err
+		return nil, err
+	}
+	sh, err := c.openControlStream(qs)
+	if earlyConn, isEarly := qs.(quic.EarlyConnection); isEarly && errors.Is(err, quic.Err0RTTRejected) {
+		// the server refused our early data, redo the control stream after the handshake
+		ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
+		var nextConn quic.Connection
+		nextConn, err = earlyConn.NextConnection(ctx)
+		ctxCancel()
+		if err == nil {
+			qs = nextConn
+			sh, err = c.openControlStream(qs)
+		}
 	}
-	ok, msg, err := c.handleControlStream(qs, stream)
 	if err != nil {
 		_ = qs.CloseWithError(closeErrorCodeProtocol, "protocol error")
-		return err
+		return nil, err
 	}
-	if !ok {
+	if !sh.OK {
 		_ = qs.CloseWithError(closeErrorCodeAuth, "auth error")
-		return fmt.Errorf("auth error: %s", msg)
+		return nil, fmt.Errorf("%w: %s", ErrAuth, sh.Message)
 	}
 	// All good
-	c.udpSessionMap = make(map[uint32]chan *udpMessage)
-	go c.handleMessage(qs)
-	c.quicSession = qs
-	return nil
+	if isOwnConn(dialer) {
+		state := qs.ConnectionState()
+		c.echAccepted.Store(state.TLS.ECHAccepted)
+		c.serverInfo.Store(&ServerInfo{
+			Version:   protocolVersion,
+			Message:   sh.Message,
+			SendBPS:   sh.Rate.SendBPS,
+			RecvBPS:   sh.Rate.RecvBPS,
+			ALPN:      state.TLS.NegotiatedProtocol,
+			Datagrams: state.SupportsDatagrams,
+		})
+		c.handshaked.Store(true)
+	}
+	if observer, ok := dialer.(ConnectObserver); ok {
+		observer.Connected()
+	}
+	sessionMap := make(map[uint32]chan *udpMessage)
+	c.udpSessionMutex.Lock()
+	if c.udpSessionMaps == nil {
+		c.udpSessionMaps = make(map[quic.Connection]map[uint32]chan *udpMessage)
+	}
+	c.udpSessionMaps[qs] = sessionMap
+	c.udpSessionMutex.Unlock()
+	go c.handleMessage(qs, sessionMap)
+	return qs, nil
 }
 
-func (c *Client) handleControlStream(qs quic.Connection, stream quic.Stream) (bool, string, error) {
+func (c *Client) openControlStream(qs quic.Connection) (serverHello, error) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
+	stream, err := qs.OpenStreamSync(ctx)
+	ctxCancel()
+	if err != nil {
+		return serverHello{}, err
+	}
+	return c.handleControlStream(qs, stream)
+}
+
+func (c *Client) handleControlStream(qs quic.Connection, stream quic.Stream) (serverHello, error) {
 	// Send protocol version
 	_, err := stream.Write([]byte{protocolVersion})
 	if err != nil {
-		return false, "", err
+		return serverHello{}, err
 	}
 	// Send client hello
 	err = struc.Pack(stream, &clientHello{
 		Rate: transmissionRate{
-			SendBPS: c.sendBPS,
-			RecvBPS: c.recvBPS,
+			SendBPS: c.sendBPS.Load(),
+			RecvBPS: c.recvBPS.Load(),
 		},
-		Auth: c.auth,
+		Auth: c.auth.Load(),
 	})
 	if err != nil {
-		return false, "", err
+		return serverHello{}, err
 	}
 	// Receive server hello
 	var sh serverHello
 	err = struc.Unpack(stream, &sh)
 	if err != nil {
-		return false, "", err
+		return serverHello{}, err
 	}
 	// Set the congestion accordingly
-	if sh.OK && c.congestionFactory != nil {
-		qs.SetCongestionControl(c.congestionFactory(sh.Rate.RecvBPS))
+	if sh.OK {
+		c.congestionMutex.Lock()
+		defer c.congestionMutex.Unlock()
+		sendBPS := c.sendBPS.Load()
+		refBPS := sh.Rate.RecvBPS
+		if c.ignoreServerBandwidth {
+			refBPS = sendBPS
+		}
+		c.serverBPS = sh.Rate.RecvBPS
+		c.congestionBPS.Store(refBPS)
+		c.clamped.Store(refBPS != sendBPS)
+		if c.congestionFactory != nil {
+			control := c.congestionFactory(refBPS)
+			qs.SetCongestionControl(control)
+			if c.congestions == nil {
+				c.congestions = make(map[quic.Connection]*connCongestion)
+			}
+			c.congestions[qs] = &connCongestion{control: control, serverBPS: sh.Rate.RecvBPS}
+			go c.forgetCongestion(qs)
+		}
 	}
-	return sh.OK, sh.Message, nil
+	return sh, nil
 }
 
-func (c *Client) handleMessage(qs quic.Connection) {
+// forgetCongestion drops the congestion control of qs once it's closed
+func (c *Client) forgetCongestion(qs quic.Connection) {
+	<-qs.Context().Done()
+	c.congestionMutex.Lock()
+	defer c.congestionMutex.Unlock()
+	delete(c.congestions, qs)
+}
+
+// handleMessage dispatches the datagrams of qs to the udp sessions opened on it
+func (c *Client) handleMessage(qs quic.Connection, sessionMap map[uint32]chan *udpMessage) {
+	defer func() {
+		c.udpSessionMutex.Lock()
+		delete(c.udpSessionMaps, qs)
+		c.udpSessionMutex.Unlock()
+	}()
 	for {
 		msg, err := qs.ReceiveDatagram(context.Background())
 		if err != nil {
@@ -149,7 +435,7 @@ func (c *Client) handleMessage(qs quic.Connection) {
 			continue
 		}
 		c.udpSessionMutex.RLock()
-		ch, ok := c.udpSessionMap[dfMsg.SessionID]
+		ch, ok := sessionMap[dfMsg.SessionID]
 		if ok {
 			select {
 			case ch <- dfMsg:
@@ -164,34 +450,193 @@ func (c *Client) handleMessage(qs quic.Connection) {
 
 func (c *Client) openStreamWithReconnect(dialer utils.PacketDialer) (quic.Connection, quic.Stream, error) {
 	c.reconnectMutex.Lock()
-	defer c.reconnectMutex.Unlock()
 	if c.closed {
+		c.reconnectMutex.Unlock()
 		return nil, nil, ErrClosed
 	}
-	if c.quicSession == nil {
-		if err := c.connectToServer(dialer); err != nil {
+	key, dedicated := dedicatedKey(dialer)
+	if _, override := c.dialObfuscator(dialer); !c.connReuse || override || dedicated && key == nil {
+		// nothing to share, so the handshake runs without holding up the other dials
+		c.streamSeq++
+		c.reconnectMutex.Unlock()
+		return c.openStreamOnNewConn(dialer)
+	}
+	if dedicated {
+		slot, ok := c.dedicatedSlots[key]
+		if !ok {
+			if c.dedicatedSlots == nil {
+				c.dedicatedSlots = make(map[any]*connSlot)
+			}
+			slot = &connSlot{}
+			c.dedicatedSlots[key] = slot
+		}
+		c.streamSeq++
+		c.reconnectMutex.Unlock()
+		return c.openStreamOnSlot(slot, dialer)
+	}
+	defer c.reconnectMutex.Unlock()
+	c.streamSeq++
+	qs, stream, err := c.openStreamOn(c.quicSession, dialer)
+	c.quicSession = qs
+	if err != nil {
+		return nil, nil, err
+	}
+	return qs, c.wrapStream(stream, nil), nil
+}
+
+// openStreamOn opens a stream on qs, connecting first when qs is nil and again once opening a
+// stream on qs fails for good. It returns the connection to keep for the next streams, even on error.
+func (c *Client) openStreamOn(qs quic.Connection, dialer utils.PacketDialer) (quic.Connection, quic.Stream, error) {
+	if qs == nil {
+		var err error
+		qs, err = c.connectToServer(dialer)
+		if err != nil {
 			// Still error, oops
 			return nil, nil, err
 		}
 	}
-	stream, err := c.quicSession.OpenStream()
+	stream, err := qs.OpenStream()
 	if err == nil {
 		// All good
-		return c.quicSession, &wrappedQUICStream{stream}, nil
+		return qs, stream, nil
 	}
 	// Something is wrong
 	if nErr, ok := err.(net.Error); ok && nErr.Temporary() {
 		// Temporary error, just return
-		return nil, nil, err
+		return qs, nil, err
 	}
 	// Permanent error, need to reconnect
-	if err := c.connectToServer(dialer); err != nil {
+	newQs, err := c.connectToServer(dialer)
+	if err != nil {
 		// Still error, oops
-		return nil, nil, err
+		return qs, nil, err
 	}
 	// We are not going to try again even if it still fails the second time
-	stream, err = c.quicSession.OpenStream()
-	return c.quicSession, &wrappedQUICStream{stream}, err
+	stream, err = newQs.OpenStream()
+	return newQs, stream, err
+}
+
+// openStreamOnSlot opens a stream on the connection of slot, only dials with the same DedicatedKey
+// wait for its handshake. It's called without reconnectMutex held.
+func (c *Client) openStreamOnSlot(slot *connSlot, dialer utils.PacketDialer) (quic.Connection, quic.Stream, error) {
+	slot.access.Lock()
+	qs, stream, err := c.openStreamOn(slot.session.Load(), dialer)
+	slot.session.Store(qs)
+	slot.access.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.reconnectMutex.Lock()
+	closed := c.closed
+	c.reconnectMutex.Unlock()
+	if closed { // Close may have missed the connection stored above
+		_ = qs.CloseWithError(closeErrorCodeGeneric, "")
+		return nil, nil, ErrClosed
+	}
+	return qs, c.wrapStream(stream, nil), nil
+}
+
+// isOwnConn reports whether a connection dialed with dialer is one of the client's own, dialed with
+// its obfuscator and without a DedicatedKey
+func isOwnConn(dialer utils.PacketDialer) bool {
+	if o, ok := dialer.(ObfsOverride); ok {
+		if _, override := o.ObfsOverride(); override {
+			return false
+		}
+	}
+	_, dedicated := dedicatedKey(dialer)
+	return !dedicated
+}
+
+// dedicatedKey returns the DedicatedKey of dialer, dedicated with a nil key when the key can't key a map
+func dedicatedKey(dialer utils.PacketDialer) (key any, dedicated bool) {
+	d, ok := dialer.(DedicatedConn)
+	if !ok {
+		return nil, false
+	}
+	key = d.DedicatedKey()
+	if key == nil {
+		return nil, false
+	}
+	if !hashable(key) {
+		return nil, true
+	}
+	return key, true
+}
+
+// hashable reports whether key can key a map, a comparable type may still hold an uncomparable value
+func hashable(key any) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	_ = map[any]struct{}{key: {}}
+	return true
+}
+
+// openStreamOnNewConn opens a stream on a connection of its own, which is closed with the stream.
+// It's called without reconnectMutex held.
+func (c *Client) openStreamOnNewConn(dialer utils.PacketDialer) (quic.Connection, quic.Stream, error) {
+	qs, err := c.connectToServer(dialer)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.reconnectMutex.Lock()
+	closed := c.closed
+	c.reconnectMutex.Unlock()
+	if closed {
+		_ = qs.CloseWithError(closeErrorCodeGeneric, "")
+		return nil, nil, ErrClosed
+	}
+	stream, err := qs.OpenStream()
+	if err != nil {
+		_ = qs.CloseWithError(closeErrorCodeGeneric, "")
+		return nil, nil, err
+	}
+	return qs, c.wrapStream(stream, func() {
+		_ = qs.CloseWithError(closeErrorCodeGeneric, "")
+	}), nil
+}
+
+// observeStream tells dialer once stream is closed if it's a StreamObserver
+func observeStream(stream quic.Stream, dialer utils.PacketDialer) {
+	if observer, ok := dialer.(StreamObserver); ok {
+		stream.(*wrappedQUICStream).addOnClose(observer.StreamClosed)
+	}
+}
+
+// wrapStream counts stream as active until it's closed, then runs onClose if not nil
+func (c *Client) wrapStream(stream quic.Stream, onClose func()) quic.Stream {
+	c.activeStreams.Add(1)
+	return &wrappedQUICStream{Stream: stream, onClose: func() {
+		c.activeStreams.Add(-1)
+		if onClose != nil {
+			onClose()
+		}
+	}}
+}
+
+// Connect establishes the shared connection ahead of the first stream. It's a no-op when a
+// healthy connection already exists, or when connections aren't reused.
+func (c *Client) Connect(dialer utils.PacketDialer) error {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if !c.connReuse {
+		return nil
+	}
+	if c.quicSession != nil && c.quicSession.Context().Err() == nil {
+		return nil
+	}
+	qs, err := c.connectToServer(dialer)
+	if err != nil {
+		return err
+	}
+	c.quicSession = qs
+	return nil
 }
 
 func (c *Client) DialTCP(host string, port uint16, dialer utils.PacketDialer) (net.Conn, error) {
@@ -221,10 +666,11 @@ func (c *Client) DialTCP(host string, port uint16, dialer utils.PacketDialer) (n
 		}
 		if !sr.OK {
 			_ = stream.Close()
-			return nil, fmt.Errorf("connection rejected: %s", sr.Message)
+			return nil, fmt.Errorf("%w: %s", ErrRejected, sr.Message)
 		}
 	}
 
+	observeStream(stream, dialer)
 	return &quicConn{
 		Orig:             stream,
 		PseudoLocalAddr:  session.LocalAddr(),
@@ -255,18 +701,24 @@ func (c *Client) DialUDP(dialer utils.PacketDialer) (UDPConn, error) {
 	}
 	if !sr.OK {
 		_ = stream.Close()
-		return nil, fmt.Errorf("connection rejected: %s", sr.Message)
+		c.udpRejected.Store(true)
+		return nil, fmt.Errorf("%w: %s", ErrUDPRejected, sr.Message)
 	}
 
 	// Create a session in the map
 	c.udpSessionMutex.Lock()
 	nCh := make(chan *udpMessage, 1024)
-	// Store the current session map for CloseFunc below
-	// to ensures that we are adding and removing sessions on the same map,
-	// as reconnecting will reassign the map
-	sessionMap := c.udpSessionMap
+	// Store the session map of this connection for CloseFunc below
+	// to ensures that we are adding and removing sessions on the same map
+	sessionMap, ok := c.udpSessionMaps[session]
+	if !ok { // the connection is already dead
+		c.udpSessionMutex.Unlock()
+		_ = stream.Close()
+		return nil, ErrClosed
+	}
 	sessionMap[sr.UDPSessionID] = nCh
 	c.udpSessionMutex.Unlock()
+	observeStream(stream, dialer)
 
 	pktConn := &quicPktConn{
 		Session: session,
@@ -281,11 +733,63 @@ func (c *Client) DialUDP(dialer utils.PacketDialer) (UDPConn, error) {
 		},
 		UDPSessionID: sr.UDPSessionID,
 		MsgCh:        nCh,
+		DatagramSize: &c.datagramSize,
 	}
 	go pktConn.Hold()
 	return pktConn, nil
 }
 
+// Ping measures the round trip of an empty stream to the server, which closes it back without
+// allocating anything as there is no request to read. It reuses the current connection if there
+// is one, otherwise the connection established for it is closed after.
+func (c *Client) Ping(ctx context.Context, dialer utils.PacketDialer) (time.Duration, error) {
+	c.reconnectMutex.Lock()
+	fresh := c.quicSession == nil
+	seq := c.streamSeq + 1 // the stream we are going to open
+	c.reconnectMutex.Unlock()
+
+	session, stream, err := c.openStreamWithReconnect(dialer)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = stream.Close()
+		if !fresh {
+			return
+		}
+		c.reconnectMutex.Lock()
+		defer c.reconnectMutex.Unlock()
+		if c.quicSession == session && c.streamSeq == seq { // nobody else is using it
+			_ = session.CloseWithError(closeErrorCodeGeneric, "")
+			c.quicSession = nil
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	stop := contextutils.AfterFunc(ctx, func() {
+		_ = stream.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	start := time.Now()
+	if err = stream.(*wrappedQUICStream).CloseWrite(); err != nil {
+		return 0, err
+	}
+	_, err = stream.Read(make([]byte, 1))
+	if err != io.EOF {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err == nil {
+			err = errors.New("unexpected data on ping stream")
+		}
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
 func (c *Client) Close() error {
 	c.reconnectMutex.Lock()
 	defer c.reconnectMutex.Unlock()
@@ -294,6 +798,11 @@ func (c *Client) Close() error {
 		err = c.quicSession.CloseWithError(closeErrorCodeGeneric, "")
 	}
 	c.closed = true
+	for _, slot := range c.dedicatedSlots {
+		if qs := slot.session.Load(); qs != nil {
+			_ = qs.CloseWithError(closeErrorCodeGeneric, "")
+		}
+	}
 	return err
 }
 
@@ -314,7 +823,7 @@ func (w *quicConn) Read(b []byte) (n int, err error) {
 		}
 		if !sr.OK {
 			_ = w.Close()
-			return 0, fmt.Errorf("connection rejected: %s", sr.Message)
+			return 0, fmt.Errorf("%w: %s", ErrRejected, sr.Message)
 		}
 		w.Established = true
 	}
@@ -365,6 +874,7 @@ type quicPktConn struct {
 	CloseFunc    func()
 	UDPSessionID uint32
 	MsgCh        <-chan *udpMessage
+	DatagramSize *atomic.Int64
 }
 
 func (c *quicPktConn) Hold() {
@@ -389,6 +899,9 @@ func (c *quicPktConn) ReadFrom() ([]byte, string, error) {
 }
 
 func (c *quicPktConn) WriteTo(p []byte, addr string) error {
+	if len(p) > MaxUDPPayloadSize {
+		return fmt.Errorf("%w: %d bytes exceeds the protocol limit %d", ErrDatagramTooLarge, len(p), MaxUDPPayloadSize)
+	}
 	host, port, err := utils.SplitHostPort(addr)
 	if err != nil {
 		return err
@@ -408,6 +921,11 @@ func (c *quicPktConn) WriteTo(p []byte, addr string) error {
 		var errSize *quic.DatagramTooLargeError
 		if errors.As(err, &errSize) {
 			// need to frag
+			c.DatagramSize.Store(errSize.MaxDatagramPayloadSize)
+			if maxSize := maxFragPayloadSize(msg, int(errSize.MaxDatagramPayloadSize)); len(p) > maxSize {
+				return fmt.Errorf("%w: %d bytes exceeds %d, what the negotiated datagram size %d carries",
+					ErrDatagramTooLarge, len(p), maxSize, errSize.MaxDatagramPayloadSize)
+			}
 			msg.MsgID = uint16(randv2.IntN(0xFFFF)) + 1 // msgID must be > 0 when fragCount > 1
 			fragMsgs := fragUDPMessage(msg, int(errSize.MaxDatagramPayloadSize))
 			for _, fragMsg := range fragMsgs {
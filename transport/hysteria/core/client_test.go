@@ -0,0 +1,601 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/component/ca"
+	tlsC "github.com/metacubex/mihomo/component/tls"
+	hyCongestion "github.com/metacubex/mihomo/transport/hysteria/congestion"
+	"github.com/metacubex/mihomo/transport/hysteria/obfs"
+	"github.com/metacubex/mihomo/transport/hysteria/transport"
+	"github.com/metacubex/mihomo/transport/hysteria/utils"
+
+	"github.com/lunixbochs/struc"
+	"github.com/metacubex/quic-go"
+	"github.com/metacubex/quic-go/congestion"
+	utls "github.com/metacubex/utls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a minimal hysteria server, it echoes TCP streams and accepts UDP sessions
+type testServer struct {
+	listener    *quic.EarlyListener
+	auth        []byte
+	connections atomic.Int32
+	udpSessions atomic.Uint32
+	recvBPS     atomic.Uint64 // announced receive rate, the client's send rate when zero
+	rejectUDP   atomic.Bool
+
+	mutex  sync.Mutex
+	hellos []clientHello
+}
+
+func newTestServer(t *testing.T, auth []byte) *testServer {
+	certificate, privateKey, _, err := ca.NewRandomTLSKeyPair(ca.KeyPairTypeP256)
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair([]byte(certificate), []byte(privateKey))
+	require.NoError(t, err)
+	tlsConfig := &tlsC.Config{
+		Certificates: []tlsC.Certificate{tlsC.UCertificate(cert)},
+		NextProtos:   []string{"hysteria"},
+	}
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{EnableDatagrams: true, Allow0RTT: true})
+	require.NoError(t, err)
+	s := &testServer{listener: listener, auth: auth}
+	go s.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) Hellos() []clientHello {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]clientHello(nil), s.hellos...)
+}
+
+func (s *testServer) serve() {
+	for {
+		qs, err := s.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.connections.Add(1)
+		go s.handleConnection(qs)
+	}
+}
+
+func (s *testServer) handleConnection(qs quic.Connection) {
+	stream, err := qs.AcceptStream(context.Background())
+	if err != nil {
+		return
+	}
+	version := make([]byte, 1)
+	if _, err = io.ReadFull(stream, version); err != nil {
+		return
+	}
+	var ch clientHello
+	if err = struc.Unpack(stream, &ch); err != nil {
+		return
+	}
+	s.mutex.Lock()
+	s.hellos = append(s.hellos, ch)
+	s.mutex.Unlock()
+	ok := s.auth == nil || string(ch.Auth) == string(s.auth)
+	rate := ch.Rate
+	if recvBPS := s.recvBPS.Load(); recvBPS != 0 {
+		rate.RecvBPS = recvBPS
+	}
+	err = struc.Pack(stream, &serverHello{OK: ok, Rate: rate, Message: "auth"})
+	if err != nil || !ok {
+		return
+	}
+	for {
+		stream, err := qs.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.handleStream(stream)
+	}
+}
+
+func (s *testServer) handleStream(stream quic.Stream) {
+	defer stream.Close()
+	var req clientRequest
+	if err := struc.Unpack(stream, &req); err != nil {
+		return
+	}
+	if req.UDP && s.rejectUDP.Load() {
+		_ = struc.Pack(stream, &serverResponse{OK: false, Message: "udp disabled"})
+		return
+	}
+	if req.UDP {
+		_ = struc.Pack(stream, &serverResponse{OK: true, UDPSessionID: s.udpSessions.Add(1)})
+		_, _ = io.Copy(io.Discard, stream)
+		return
+	}
+	if err := struc.Pack(stream, &serverResponse{OK: true}); err != nil {
+		return
+	}
+	_, _ = io.Copy(stream, stream)
+}
+
+type testDialer struct{}
+
+func (d *testDialer) ListenPacket(rAddr net.Addr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", nil)
+}
+
+func (d *testDialer) Context() context.Context {
+	return context.Background()
+}
+
+func (d *testDialer) RemoteAddr(host string) (net.Addr, error) {
+	return net.ResolveUDPAddr("udp", host)
+}
+
+func newTestClient(t *testing.T, addr string, auth []byte) *Client {
+	return newTestClientWithFastOpen(t, addr, auth, false)
+}
+
+func newTestClientWithFastOpen(t *testing.T, addr string, auth []byte, fastOpen bool) *Client {
+	tlsConfig := &tlsC.Config{
+		ServerName:         "hysteria.test",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"hysteria"},
+		MinVersion:         tlsC.VersionTLS13,
+		// the random test certificate carries no validity period,
+		// which would make cached sessions look expired
+		InsecureSkipTimeVerify: true,
+	}
+	if fastOpen {
+		tlsConfig.ClientSessionCache = tlsC.NewLRUClientSessionCache(0)
+	}
+	client, err := NewClient(addr, "", "udp", auth, tlsConfig, &quic.Config{EnableDatagrams: true},
+		&transport.ClientTransport{}, 1000000, 1000000, nil, nil, 10*time.Second, fastOpen)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestClientPing(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := newTestClient(t, server.Addr(), []byte("auth"))
+
+	// no connection yet, the one established for ping is torn down
+	rtt, err := client.Ping(context.Background(), &testDialer{})
+	require.NoError(t, err)
+	assert.Greater(t, rtt, time.Duration(0))
+	assert.Less(t, rtt, time.Second)
+	assert.Nil(t, client.quicSession)
+	assert.Zero(t, server.udpSessions.Load(), "ping must not allocate a session on the server")
+
+	// an open connection is reused
+	conn, err := client.DialTCP("example.com", 80, &testDialer{})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = client.Ping(context.Background(), &testDialer{})
+	require.NoError(t, err)
+	assert.NotNil(t, client.quicSession)
+	assert.EqualValues(t, 2, server.connections.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.Ping(ctx, &testDialer{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// barrierDialer holds every dial in RemoteAddr until n of them are connecting at once
+type barrierDialer struct {
+	testDialer
+	n       int32
+	arrived atomic.Int32
+	all     chan struct{}
+}
+
+func (d *barrierDialer) RemoteAddr(host string) (net.Addr, error) {
+	if d.arrived.Add(1) == d.n {
+		close(d.all)
+	}
+	select {
+	case <-d.all:
+	case <-time.After(5 * time.Second):
+	}
+	return d.testDialer.RemoteAddr(host)
+}
+
+func TestClientConcurrentNewConns(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := newTestClient(t, server.Addr(), nil)
+	client.SetConnReuse(false)
+
+	const n = 4
+	dialer := &barrierDialer{n: n, all: make(chan struct{})}
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := client.DialTCP("127.0.0.1", 80, dialer)
+			if assert.NoError(t, err) {
+				conns <- conn
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	// serialized dials would each wait out the barrier
+	assert.Less(t, time.Since(start), 3*time.Second, "the handshakes of unshared connections must overlap")
+	assert.EqualValues(t, n, server.connections.Load())
+
+	// Close isn't held up by a handshake in flight
+	blocked := &barrierDialer{n: 2, all: make(chan struct{})}
+	go func() { _, _ = client.DialTCP("127.0.0.1", 80, blocked) }()
+	assert.Eventually(t, func() bool { return blocked.arrived.Load() == 1 }, time.Second, 10*time.Millisecond)
+	closed := make(chan struct{})
+	go func() { _ = client.Close(); close(closed) }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked behind a handshake")
+	}
+	close(blocked.all)
+}
+
+type notifySessionCache struct {
+	tlsC.ClientSessionCache
+	put chan struct{}
+}
+
+func (c *notifySessionCache) Put(sessionKey string, cs *utls.ClientSessionState) {
+	c.ClientSessionCache.Put(sessionKey, cs)
+	select {
+	case c.put <- struct{}{}:
+	default:
+	}
+}
+
+func TestClientFastOpenResumption(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := newTestClientWithFastOpen(t, server.Addr(), nil, true)
+	cache := &notifySessionCache{ClientSessionCache: client.tlsConfig.ClientSessionCache, put: make(chan struct{}, 1)}
+	client.tlsConfig.ClientSessionCache = cache
+
+	echo := func() {
+		conn, err := client.DialTCP("example.com", 80, &testDialer{})
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	}
+
+	echo()
+	assert.False(t, client.quicSession.ConnectionState().TLS.DidResume)
+	select {
+	case <-cache.put:
+	case <-time.After(time.Second):
+		t.Fatal("no session ticket received")
+	}
+
+	// drop the connection, the next dial must reconnect with the cached ticket
+	client.reconnectMutex.Lock()
+	_ = client.quicSession.CloseWithError(closeErrorCodeGeneric, "")
+	client.quicSession = nil
+	client.reconnectMutex.Unlock()
+
+	echo()
+	if earlyConn, ok := client.quicSession.(quic.EarlyConnection); ok {
+		<-earlyConn.HandshakeComplete()
+	}
+	state := client.quicSession.ConnectionState()
+	assert.True(t, state.TLS.DidResume)
+	assert.True(t, state.Used0RTT)
+	assert.EqualValues(t, 2, server.connections.Load())
+}
+
+func TestClientIgnoreServerBandwidth(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		server := newTestServer(t, nil)
+		server.recvBPS.Store(250000)
+		client := newTestClient(t, server.Addr(), nil)
+		client.SetIgnoreServerBandwidth(ignore)
+
+		_, err := client.Ping(context.Background(), &testDialer{})
+		require.NoError(t, err)
+		if ignore {
+			assert.EqualValues(t, 1000000, client.CongestionBPS())
+			assert.False(t, client.Clamped())
+		} else {
+			assert.EqualValues(t, 250000, client.CongestionBPS())
+			assert.True(t, client.Clamped())
+		}
+	}
+}
+
+func TestClientSetRates(t *testing.T) {
+	server := newTestServer(t, nil)
+	server.recvBPS.Store(600000)
+	var senders []*hyCongestion.BrutalSender
+	client, err := NewClient(server.Addr(), "", "udp", nil, &tlsC.Config{
+		ServerName:         "hysteria.test",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"hysteria"},
+	}, &quic.Config{EnableDatagrams: true}, &transport.ClientTransport{}, 1000000, 1000000,
+		func(refBPS uint64) congestion.CongestionControl {
+			sender := hyCongestion.NewBrutalSender(congestion.ByteCount(refBPS))
+			senders = append(senders, sender)
+			return sender
+		}, nil, 10*time.Second, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Len(t, senders, 1)
+	assert.EqualValues(t, 600000, senders[0].BPS())
+
+	// below the server announced rate the live sender follows
+	client.SetRates(400000, 2000000)
+	assert.EqualValues(t, 400000, senders[0].BPS())
+	assert.EqualValues(t, 400000, client.CongestionBPS())
+	assert.False(t, client.Clamped())
+
+	// above it the server rate still caps the live sender
+	client.SetRates(800000, 2000000)
+	assert.EqualValues(t, 600000, senders[0].BPS())
+	assert.True(t, client.Clamped())
+
+	client.SetIgnoreServerBandwidth(true)
+	client.SetRates(900000, 2000000)
+	assert.EqualValues(t, 900000, senders[0].BPS())
+	assert.False(t, client.Clamped())
+
+	// a new connection announces the updated rates
+	client.SetConnReuse(false)
+	conn2, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	defer conn2.Close()
+	hellos := server.Hellos()
+	require.Len(t, hellos, 2)
+	assert.EqualValues(t, 900000, hellos[1].Rate.SendBPS)
+	assert.EqualValues(t, 2000000, hellos[1].Rate.RecvBPS)
+	require.Len(t, senders, 2)
+	assert.EqualValues(t, 900000, senders[1].BPS())
+
+	// both live connections follow, not only the latest
+	client.SetRates(500000, 2000000)
+	assert.EqualValues(t, 500000, senders[0].BPS())
+	assert.EqualValues(t, 500000, senders[1].BPS())
+	client.SetIgnoreServerBandwidth(false)
+	client.SetRates(700000, 2000000)
+	assert.EqualValues(t, 600000, senders[0].BPS())
+	assert.EqualValues(t, 600000, senders[1].BPS())
+
+	// a closed connection is forgotten
+	require.NoError(t, conn2.Close())
+	assert.Eventually(t, func() bool {
+		client.congestionMutex.Lock()
+		defer client.congestionMutex.Unlock()
+		return len(client.congestions) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClientServerInfo(t *testing.T) {
+	server := newTestServer(t, nil)
+	server.recvBPS.Store(600000)
+	server.rejectUDP.Store(true)
+	client := newTestClient(t, server.Addr(), nil)
+
+	_, ok := client.ServerInfo()
+	assert.False(t, ok)
+
+	conn, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	defer conn.Close()
+	info, ok := client.ServerInfo()
+	require.True(t, ok)
+	assert.Equal(t, protocolVersion, info.Version)
+	assert.Equal(t, "auth", info.Message)
+	assert.EqualValues(t, 600000, info.RecvBPS)
+	assert.EqualValues(t, 1000000, info.SendBPS) // echoed by the stub server
+	assert.Equal(t, "hysteria", info.ALPN)
+	assert.True(t, info.Datagrams)
+	assert.False(t, info.UDPRejected)
+
+	_, err = client.DialUDP(&testDialer{})
+	assert.ErrorIs(t, err, ErrUDPRejected)
+	info, ok = client.ServerInfo()
+	require.True(t, ok)
+	assert.True(t, info.UDPRejected)
+
+	// side connections don't replace what the own connection was told
+	server.recvBPS.Store(300000)
+	for _, dialer := range []utils.PacketDialer{&keyedDialer{key: "side"}, &noObfsDialer{}} {
+		side, err := client.DialTCP("127.0.0.1", 80, dialer)
+		require.NoError(t, err)
+		_ = side.Close()
+	}
+	info, _ = client.ServerInfo()
+	assert.EqualValues(t, 600000, info.RecvBPS)
+
+	client.SetConnReuse(false) // every connection is an own one then
+	unshared, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	_ = unshared.Close()
+	info, _ = client.ServerInfo()
+	assert.EqualValues(t, 300000, info.RecvBPS)
+}
+
+// countingObfuscator leaves packets as they are and counts them
+type countingObfuscator struct {
+	packets atomic.Int64
+}
+
+func (o *countingObfuscator) Obfuscate(in []byte, out []byte) int {
+	o.packets.Add(1)
+	return copy(out, in)
+}
+
+func (o *countingObfuscator) Deobfuscate(in []byte, out []byte) int {
+	o.packets.Add(1)
+	return copy(out, in)
+}
+
+type noObfsDialer struct {
+	testDialer
+}
+
+func (d *noObfsDialer) ObfsOverride() (obfs.Obfuscator, bool) {
+	return nil, true
+}
+
+func TestClientObfsOverride(t *testing.T) {
+	server := newTestServer(t, nil)
+	obfuscator := &countingObfuscator{}
+	client, err := NewClient(server.Addr(), "", "udp", nil, &tlsC.Config{
+		ServerName:         "hysteria.test",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"hysteria"},
+	}, &quic.Config{EnableDatagrams: true}, &transport.ClientTransport{}, 1000000, 1000000, nil, obfuscator, 10*time.Second, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	echo := func(conn net.Conn) {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+	}
+
+	conn, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(conn)
+	assert.Greater(t, obfuscator.packets.Load(), int64(0))
+
+	before := obfuscator.packets.Load()
+	plain, err := client.DialTCP("127.0.0.1", 80, &noObfsDialer{})
+	require.NoError(t, err)
+	echo(plain)
+	assert.EqualValues(t, 2, server.connections.Load()) // a connection of its own
+	require.NoError(t, plain.Close())
+
+	// the shared connection still goes through the obfuscator
+	echo(conn)
+	assert.Greater(t, obfuscator.packets.Load(), before)
+	before = obfuscator.packets.Load()
+	other, err := client.DialTCP("127.0.0.1", 80, &testDialer{})
+	require.NoError(t, err)
+	defer other.Close()
+	echo(other)
+	assert.Greater(t, obfuscator.packets.Load(), before)
+	assert.EqualValues(t, 2, server.connections.Load())
+}
+
+type keyedDialer struct {
+	testDialer
+	key any
+}
+
+func (d *keyedDialer) DedicatedKey() any {
+	return d.key
+}
+
+func TestClientDedicatedKey(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := newTestClient(t, server.Addr(), nil)
+	dial := func(key any) net.Conn {
+		conn, err := client.DialTCP("127.0.0.1", 80, &keyedDialer{key: key})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	shared := dial(nil) // no key, the client's connection
+	a := dial("a")
+	dial("a")
+	assert.EqualValues(t, 2, server.connections.Load(), "dials with equal keys share a connection")
+	dial("b")
+	assert.EqualValues(t, 3, server.connections.Load())
+
+	// a key which can't key a map gets a connection per stream
+	dial([]int{1})
+	dial([]int{1})
+	assert.EqualValues(t, 5, server.connections.Load())
+	assert.Len(t, client.dedicatedSlots, 2)
+
+	require.NoError(t, client.Close())
+	for _, conn := range []net.Conn{shared, a} {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, os.ErrDeadlineExceeded, "the connection must be closed with the client")
+	}
+	_, err := client.DialTCP("127.0.0.1", 80, &keyedDialer{key: "a"})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+// testDatagramSession takes datagrams of up to size bytes
+type testDatagramSession struct {
+	quic.Connection
+	size int
+	sent int
+}
+
+func (s *testDatagramSession) SendDatagram(p []byte) error {
+	if len(p) > s.size {
+		return &quic.DatagramTooLargeError{MaxDatagramPayloadSize: int64(s.size)}
+	}
+	s.sent++
+	return nil
+}
+
+func TestClientMaxUDPPayloadSize(t *testing.T) {
+	c := &Client{}
+	assert.Equal(t, MaxUDPPayloadSize, c.MaxUDPPayloadSize())
+
+	session := &testDatagramSession{size: 100}
+	conn := &quicPktConn{Session: session, DatagramSize: &c.datagramSize}
+	require.NoError(t, conn.WriteTo(make([]byte, 1000), "1.2.3.4:53"))
+	assert.Greater(t, session.sent, 1)
+	assert.Equal(t, (100-udpMessage{}.HeaderSize())*maxFragCount, c.MaxUDPPayloadSize())
+
+	// a payload fits as long as it doesn't take more fragments than FragCount counts
+	maxSize := (100 - udpMessage{Host: "1.2.3.4"}.HeaderSize()) * maxFragCount
+	session.sent = 0
+	require.NoError(t, conn.WriteTo(make([]byte, maxSize), "1.2.3.4:53"))
+	assert.Equal(t, maxFragCount, session.sent)
+
+	session.sent = 0
+	err := conn.WriteTo(make([]byte, maxSize+1), "1.2.3.4:53")
+	assert.ErrorIs(t, err, ErrDatagramTooLarge)
+	assert.ErrorContains(t, err, "negotiated datagram size 100")
+	assert.Zero(t, session.sent)
+
+	err = conn.WriteTo(make([]byte, MaxUDPPayloadSize+1), "1.2.3.4:53")
+	assert.ErrorIs(t, err, ErrDatagramTooLarge)
+	assert.Zero(t, session.sent)
+}
@@ -27,6 +27,19 @@ func fragUDPMessage(m udpMessage, maxSize int) []udpMessage {
 	return frags
 }
 
+// maxFragPayloadSize returns the largest payload m can carry split into fragments
+// of at most datagramSize bytes
+func maxFragPayloadSize(m udpMessage, datagramSize int) int {
+	size := (datagramSize - m.HeaderSize()) * maxFragCount
+	if size < 0 {
+		return 0
+	}
+	if size > MaxUDPPayloadSize {
+		return MaxUDPPayloadSize
+	}
+	return size
+}
+
 type defragger struct {
 	msgID uint16
 	frags []*udpMessage
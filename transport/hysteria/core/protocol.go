@@ -1,6 +1,7 @@
 package core
 
 import (
+	"math"
 	"time"
 )
 
@@ -12,6 +13,12 @@ const (
 	closeErrorCodeGeneric  = 0
 	closeErrorCodeProtocol = 1
 	closeErrorCodeAuth     = 2
+
+	// MaxUDPPayloadSize is the largest payload a udpMessage can carry, bounded by its uint16 DataLen.
+	// Larger payloads are fragmented across QUIC datagrams but never split across messages.
+	MaxUDPPayloadSize = math.MaxUint16
+	// maxFragCount is the most fragments a udpMessage can be split into, bounded by its uint8 FragCount
+	maxFragCount = math.MaxUint8
 )
 
 type transmissionRate struct {
@@ -2,14 +2,19 @@ package core
 
 import (
 	"context"
-	"github.com/metacubex/quic-go"
+	"sync"
 	"time"
+
+	"github.com/metacubex/quic-go"
 )
 
 // Handle stream close properly
 // Ref: https://github.com/libp2p/go-libp2p-quic-transport/blob/master/stream.go
 type wrappedQUICStream struct {
 	Stream quic.Stream
+
+	onClose   func() // run once on the first Close
+	closeOnce sync.Once
 }
 
 func (s *wrappedQUICStream) StreamID() quic.StreamID {
@@ -34,9 +39,30 @@ func (s *wrappedQUICStream) Write(p []byte) (n int, err error) {
 
 func (s *wrappedQUICStream) Close() error {
 	s.Stream.CancelRead(0)
+	err := s.Stream.Close()
+	if s.onClose != nil {
+		s.closeOnce.Do(s.onClose)
+	}
+	return err
+}
+
+// CloseWrite sends FIN without giving up the read side like Close does
+func (s *wrappedQUICStream) CloseWrite() error {
 	return s.Stream.Close()
 }
 
+// addOnClose runs f on the first Close after the onClose set so far, the stream must
+// not be in use yet
+func (s *wrappedQUICStream) addOnClose(f func()) {
+	onClose := s.onClose
+	s.onClose = func() {
+		if onClose != nil {
+			onClose()
+		}
+		f()
+	}
+}
+
 func (s *wrappedQUICStream) CancelWrite(code quic.StreamErrorCode) {
 	s.Stream.CancelWrite(code)
 }
@@ -15,25 +15,26 @@ import (
 	"github.com/metacubex/quic-go"
 )
 
-type ClientTransport struct{}
+type ClientTransport struct {
+	// DisableMigration keeps the local socket when port hopping, only the server port changes.
+	// The client never moves a connection to another socket otherwise.
+	DisableMigration bool
+}
 
 func (ct *ClientTransport) quicPacketConn(proto string, rAddr net.Addr, serverPorts string, obfs obfsPkg.Obfuscator, hopInterval time.Duration, dialer utils.PacketDialer) (net.PacketConn, error) {
 	server := rAddr.String()
 	if len(proto) == 0 || proto == "udp" {
+		if serverPorts != "" { // the hop conn listens on its own
+			return udp.NewObfsUDPHopClientPacketConn(server, serverPorts, hopInterval, ct.DisableMigration, obfs, dialer)
+		}
 		conn, err := dialer.ListenPacket(rAddr)
 		if err != nil {
 			return nil, err
 		}
 		if obfs != nil {
-			if serverPorts != "" {
-				return udp.NewObfsUDPHopClientPacketConn(server, serverPorts, hopInterval, obfs, dialer)
-			}
 			oc := udp.NewObfsUDPConn(conn, obfs)
 			return oc, nil
 		} else {
-			if serverPorts != "" {
-				return udp.NewObfsUDPHopClientPacketConn(server, serverPorts, hopInterval, nil, dialer)
-			}
 			return conn, nil
 		}
 	} else if proto == "wechat-video" {
@@ -62,7 +63,9 @@ func (ct *ClientTransport) quicPacketConn(proto string, rAddr net.Addr, serverPo
 	}
 }
 
-func (ct *ClientTransport) QUICDial(proto string, server string, serverPorts string, tlsConfig *tlsC.Config, quicConfig *quic.Config, obfs obfsPkg.Obfuscator, hopInterval time.Duration, dialer utils.PacketDialer) (quic.Connection, error) {
+// QUICDial dials the server, with early set it returns a quic.EarlyConnection which can send 0-RTT data
+// when the tls config holds a session ticket for the server
+func (ct *ClientTransport) QUICDial(proto string, server string, serverPorts string, tlsConfig *tlsC.Config, quicConfig *quic.Config, obfs obfsPkg.Obfuscator, hopInterval time.Duration, early bool, dialer utils.PacketDialer) (quic.Connection, error) {
 	serverUDPAddr, err := dialer.RemoteAddr(server)
 	if err != nil {
 		return nil, err
@@ -76,7 +79,12 @@ func (ct *ClientTransport) QUICDial(proto string, server string, serverPorts str
 	transport := quic.Transport{Conn: pktConn}
 	transport.SetCreatedConn(true) // auto close conn
 	transport.SetSingleUse(true)   // auto close transport
-	qs, err := transport.Dial(dialer.Context(), serverUDPAddr, tlsConfig, quicConfig)
+	var qs quic.Connection
+	if early {
+		qs, err = transport.DialEarly(dialer.Context(), serverUDPAddr, tlsConfig, quicConfig)
+	} else {
+		qs, err = transport.Dial(dialer.Context(), serverUDPAddr, tlsConfig, quicConfig)
+	}
 	if err != nil {
 		_ = pktConn.Close()
 		return nil, err
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	N "github.com/metacubex/mihomo/common/net"
+	"github.com/metacubex/mihomo/component/dialer"
 	C "github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/log"
 
@@ -62,25 +63,25 @@ func (t *PoolClient) ListenPacketWithDialer(ctx context.Context, metadata *C.Met
 	return N.NewRefPacketConn(pc, t), nil
 }
 
-func (t *PoolClient) dial(ctx context.Context, dialer C.Dialer, dialFn DialFunc) (transport *quic.Transport, addr net.Addr, err error) {
+func (t *PoolClient) dial(ctx context.Context, cDialer C.Dialer, dialFn DialFunc) (transport *quic.Transport, addr net.Addr, err error) {
 	t.dialResultMutex.Lock()
-	dr, ok := t.dialResultMap[dialer]
+	dr, ok := t.dialResultMap[cDialer]
 	t.dialResultMutex.Unlock()
 	if ok {
 		return dr.transport, dr.addr, dr.err
 	}
 
-	transport, addr, err = dialFn(ctx, dialer)
+	transport, addr, err = dialFn(ctx, cDialer)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if _, ok := transport.Conn.(*net.UDPConn); ok { // only cache the system's UDPConn
+	if dialer.IsSystemPacketConn(transport.Conn) { // only cache the system's UDPConn
 		transport.SetSingleUse(false) // don't close transport in each dial
 		dr.transport, dr.addr, dr.err = transport, addr, err
 
 		t.dialResultMutex.Lock()
-		t.dialResultMap[dialer] = dr
+		t.dialResultMap[cDialer] = dr
 		t.dialResultMutex.Unlock()
 	}
 